@@ -0,0 +1,100 @@
+package analysis
+
+import (
+	"math"
+	"slices"
+	"sort"
+)
+
+// ClockSample is one reading of a program clock: the clock value in
+// seconds, the byte position that carried it and, for network sources, the
+// local time it arrived at in seconds (NaN when unknown).
+type ClockSample struct {
+	Pos     float64
+	Clock   float64
+	Arrival float64
+}
+
+// ClockIntervals returns the mean and the longest gap between consecutive
+// clock values.
+func ClockIntervals(samples []ClockSample) (mean, longest float64) {
+	if len(samples) < 2 {
+		return 0, 0
+	}
+
+	for i := 1; i < len(samples); i++ {
+		longest = math.Max(longest, samples[i].Clock-samples[i-1].Clock)
+	}
+
+	mean = (samples[len(samples)-1].Clock - samples[0].Clock) / float64(len(samples)-1)
+	return mean, longest
+}
+
+// ClockJitter returns the spread of the clock around a line fitted against
+// the arrival time in seconds. Without an arrival time on every sample it
+// fits against the byte position instead, which only stands for time on a
+// constant bit rate multiplex, and reports that assumption in cbr.
+func ClockJitter(samples []ClockSample) (jitter float64, cbr bool, err error) {
+	cbr = slices.ContainsFunc(samples, func(s ClockSample) bool { return math.IsNaN(s.Arrival) })
+
+	fit := make([]Sample, len(samples))
+	for i, s := range samples {
+		fit[i] = Sample{Time: s.Arrival, Offset: s.Clock}
+		if cbr {
+			fit[i].Time = s.Pos
+		}
+	}
+
+	estimate, err := EstimateDrift(fit)
+	if err != nil {
+		return 0, cbr, err
+	}
+	return estimate.Residual, cbr, nil
+}
+
+// ArrivalDrift fits the clock minus the arrival time against the arrival
+// time: the slope is the rate error of the sender clock against the local
+// one. It needs samples with an arrival time.
+func ArrivalDrift(samples []ClockSample) (DriftEstimate, error) {
+	fit := []Sample{}
+	for _, s := range samples {
+		if !math.IsNaN(s.Arrival) {
+			fit = append(fit, Sample{Time: s.Arrival, Offset: s.Clock - s.Arrival})
+		}
+	}
+	return EstimateDrift(fit)
+}
+
+// ClockAt returns the clock at byte position pos, interpolated between the
+// samples around it or extrapolated from the nearest two. samples must be
+// sorted by position.
+func ClockAt(samples []ClockSample, pos float64) (float64, bool) {
+	if len(samples) < 2 {
+		return 0, false
+	}
+
+	i := sort.Search(len(samples), func(i int) bool { return samples[i].Pos > pos })
+	i = min(max(i, 1), len(samples)-1)
+
+	before, after := samples[i-1], samples[i]
+	if after.Pos == before.Pos {
+		return before.Clock, true
+	}
+
+	return before.Clock + (pos-before.Pos)*(after.Clock-before.Clock)/(after.Pos-before.Pos), true
+}
+
+// TimestampsAgainstClock fits the PTS minus the clock at the position of each
+// frame against that clock. The intercept is the decoder buffer delay and
+// the slope the rate at which the stream leaves its clock.
+func TimestampsAgainstClock(samples []ClockSample, positions []float64, pts []float64) (DriftEstimate, error) {
+	fit := []Sample{}
+	for i, pos := range positions {
+		clock, ok := ClockAt(samples, pos)
+		if !ok {
+			break
+		}
+		fit = append(fit, Sample{Time: clock, Offset: pts[i] - clock})
+	}
+	return EstimateDrift(fit)
+}
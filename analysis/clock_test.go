@@ -0,0 +1,47 @@
+package analysis
+
+import (
+	"math"
+	"testing"
+)
+
+func TestClockJitter(t *testing.T) {
+	// A PCR every 40 ms on a variable bit rate: the byte position grows
+	// faster and faster, the clock arrives 1 ms early or late in turn
+	vbr := func(arrival bool) []ClockSample {
+		samples := make([]ClockSample, 50)
+		for i := range samples {
+			clock := 0.04 * float64(i)
+			samples[i] = ClockSample{Pos: 188 * 1000 * clock * (1 + clock), Clock: 10 + clock, Arrival: math.NaN()}
+			if arrival {
+				samples[i].Arrival = clock + 0.001*float64(1-2*(i%2))
+			}
+		}
+		return samples
+	}
+
+	tests := []struct {
+		name      string
+		samples   []ClockSample
+		low, high float64
+		wantCBR   bool
+	}{
+		{"against arrival", vbr(true), 0.0009, 0.0011, false},
+		{"against position", vbr(false), 0.01, math.Inf(1), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jitter, cbr, err := ClockJitter(tt.samples)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cbr != tt.wantCBR {
+				t.Errorf("cbr %v, want %v", cbr, tt.wantCBR)
+			}
+			if jitter < tt.low || jitter > tt.high {
+				t.Errorf("jitter %.4f, want %.4f .. %.4f", jitter, tt.low, tt.high)
+			}
+		})
+	}
+}
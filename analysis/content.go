@@ -0,0 +1,197 @@
+package analysis
+
+import (
+	"errors"
+	"math"
+)
+
+// ErrNoEvents is returned when an envelope is flat: silent audio or a still
+// picture give nothing to line up.
+var ErrNoEvents = errors.New("no sound or picture changes to correlate")
+
+// AudioEnvelope returns the onset strength of mono PCM in bins of
+// sampleRate/binRate samples: how much the log energy rose from the bin
+// before, zero when it fell.
+func AudioEnvelope(pcm []int16, sampleRate, binRate int) []float64 {
+	size := sampleRate / binRate
+	if size < 1 {
+		return nil
+	}
+
+	envelope := make([]float64, len(pcm)/size)
+	previous := 0.0
+
+	for i := range envelope {
+		energy := 0.0
+		for _, s := range pcm[i*size : (i+1)*size] {
+			energy += float64(s) * float64(s)
+		}
+
+		// The floor keeps the log of digital silence finite
+		level := math.Log10(energy/float64(size) + 1)
+		if i > 0 {
+			envelope[i] = math.Max(level-previous, 0)
+		}
+		previous = level
+	}
+
+	return envelope
+}
+
+// MotionEnvelope returns, for every frame of frameSize bytes of 8-bit gray
+// pixels, how much brighter its pixels got than in the frame before, on
+// average. Movement and a light turning on raise it, a light turning off
+// does not, so an event is counted once. The first frame is 0.
+func MotionEnvelope(frames []byte, frameSize int) []float64 {
+	if frameSize < 1 {
+		return nil
+	}
+
+	envelope := make([]float64, len(frames)/frameSize)
+
+	for i := 1; i < len(envelope); i++ {
+		previous := frames[(i-1)*frameSize : i*frameSize]
+		current := frames[i*frameSize : (i+1)*frameSize]
+
+		total := 0
+		for j := range current {
+			if d := int(current[j]) - int(previous[j]); d > 0 {
+				total += d
+			}
+		}
+		envelope[i] = float64(total) / float64(frameSize)
+	}
+
+	return envelope
+}
+
+// Resample returns the envelope sampled at rate to instead of from,
+// interpolating linearly.
+func Resample(envelope []float64, from, to float64) []float64 {
+	if len(envelope) == 0 || from <= 0 || to <= 0 {
+		return nil
+	}
+
+	n := int(float64(len(envelope)) * to / from)
+	result := make([]float64, n)
+
+	for i := range result {
+		x := float64(i) * from / to
+		j := int(x)
+		if j >= len(envelope)-1 {
+			result[i] = envelope[len(envelope)-1]
+			continue
+		}
+		frac := x - float64(j)
+		result[i] = envelope[j]*(1-frac) + envelope[j+1]*frac
+	}
+
+	return result
+}
+
+// Correlation is the best alignment of two envelopes. Lag is how many
+// seconds the events of the second envelope come after those of the first,
+// Peak the Pearson correlation at that lag and Prominence how many
+// standard deviations the peak stands above the correlation at the other
+// lags.
+type Correlation struct {
+	Lag        float64
+	Peak       float64
+	Prominence float64
+}
+
+// CrossCorrelate finds the lag, up to maxLag seconds either way, at which b
+// best matches a. Both envelopes are sampled at rate.
+func CrossCorrelate(a, b []float64, rate, maxLag float64) (Correlation, error) {
+	za, ok := zscores(a)
+	if !ok {
+		return Correlation{}, ErrNoEvents
+	}
+	zb, ok := zscores(b)
+	if !ok {
+		return Correlation{}, ErrNoEvents
+	}
+
+	lags := int(maxLag * rate)
+	values := make([]float64, 2*lags+1)
+	best := -1
+
+	for k := range values {
+		lag := k - lags
+
+		sum, n := 0.0, 0
+		for i := max(0, -lag); i < len(za) && i+lag < len(zb); i++ {
+			sum += za[i] * zb[i+lag]
+			n++
+		}
+
+		// Too little overlap correlates by chance
+		if n < len(za)/2 {
+			values[k] = math.NaN()
+			continue
+		}
+
+		values[k] = sum / float64(n)
+		if best < 0 || values[k] > values[best] {
+			best = k
+		}
+	}
+
+	if best < 0 {
+		return Correlation{}, ErrNotEnoughSamples
+	}
+
+	result := Correlation{Peak: values[best], Lag: float64(best-lags) / rate}
+
+	// Parabolic interpolation between the bins around the peak
+	if best > 0 && best < len(values)-1 && !math.IsNaN(values[best-1]) && !math.IsNaN(values[best+1]) {
+		left, centre, right := values[best-1], values[best], values[best+1]
+		if denominator := left - 2*centre + right; denominator != 0 {
+			result.Lag += 0.5 * (left - right) / denominator / rate
+		}
+	}
+
+	sum, squares, n := 0.0, 0.0, 0
+	for _, v := range values {
+		if !math.IsNaN(v) {
+			sum += v
+			squares += v * v
+			n++
+		}
+	}
+	mean := sum / float64(n)
+	if spread := math.Sqrt(math.Max(squares/float64(n)-mean*mean, 0)); spread > 0 {
+		result.Prominence = (result.Peak - mean) / spread
+	}
+
+	return result, nil
+}
+
+// zscores returns the values minus their mean divided by their standard
+// deviation, false when they do not vary.
+func zscores(values []float64) ([]float64, bool) {
+	if len(values) == 0 {
+		return nil, false
+	}
+
+	mean := 0.0
+	for _, v := range values {
+		mean += v
+	}
+	mean /= float64(len(values))
+
+	variance := 0.0
+	for _, v := range values {
+		variance += (v - mean) * (v - mean)
+	}
+	deviation := math.Sqrt(variance / float64(len(values)))
+	if deviation == 0 {
+		return nil, false
+	}
+
+	result := make([]float64, len(values))
+	for i, v := range values {
+		result[i] = (v - mean) / deviation
+	}
+	return result, true
+}
@@ -0,0 +1,170 @@
+// Package analysis holds the timestamp statistics used by the analyzers.
+// It works on plain numbers so it can be exercised without ffmpeg.
+package analysis
+
+import (
+	"errors"
+	"math"
+)
+
+// Sample is one paired audio/video measurement: the media time it was
+// taken at and the audio PTS minus video PTS offset at that time.
+type Sample struct {
+	Time   float64
+	Offset float64
+}
+
+type Verdict string
+
+const (
+	InSync           Verdict = "in sync"
+	FixedOffset      Verdict = "fixed offset"
+	ProgressiveDrift Verdict = "progressive drift"
+)
+
+// DriftEstimate is a least-squares fit of Offset = Intercept + Slope*Time.
+// Time is measured from the first sample, so Intercept is the offset at
+// the start of the window.
+type DriftEstimate struct {
+	Samples int
+	Span    float64
+
+	Slope       float64
+	SlopeStdErr float64
+	SlopeLow    float64
+	SlopeHigh   float64
+
+	Intercept       float64
+	InterceptStdErr float64
+	InterceptLow    float64
+	InterceptHigh   float64
+
+	R2 float64
+	// Residual is the standard deviation of the offsets around the fit,
+	// i.e. the timestamp jitter that is not explained by drift.
+	Residual float64
+}
+
+// ErrNotEnoughSamples is returned when there are fewer than three samples,
+// the minimum needed for a fit with a residual error.
+var ErrNotEnoughSamples = errors.New("not enough samples to estimate drift")
+
+// EstimateDrift fits a line through all samples and returns the slope and
+// intercept with 95% confidence intervals.
+func EstimateDrift(samples []Sample) (DriftEstimate, error) {
+	n := len(samples)
+	if n < 3 {
+		return DriftEstimate{}, ErrNotEnoughSamples
+	}
+
+	t0 := samples[0].Time
+	var meanT, meanO float64
+	for _, s := range samples {
+		meanT += s.Time - t0
+		meanO += s.Offset
+	}
+	meanT /= float64(n)
+	meanO /= float64(n)
+
+	var sxx, sxy, syy float64
+	for _, s := range samples {
+		dt := s.Time - t0 - meanT
+		do := s.Offset - meanO
+		sxx += dt * dt
+		sxy += dt * do
+		syy += do * do
+	}
+
+	est := DriftEstimate{Samples: n, Span: samples[n-1].Time - t0}
+
+	if sxx == 0 {
+		return DriftEstimate{}, errors.New("samples do not span any media time")
+	}
+
+	est.Slope = sxy / sxx
+	est.Intercept = meanO - est.Slope*meanT
+
+	var sse float64
+	for _, s := range samples {
+		r := s.Offset - (est.Intercept + est.Slope*(s.Time-t0))
+		sse += r * r
+	}
+
+	if syy > 0 {
+		est.R2 = 1 - sse/syy
+	} else {
+		est.R2 = 1
+	}
+
+	df := n - 2
+	s2 := sse / float64(df)
+	est.Residual = math.Sqrt(s2)
+	est.SlopeStdErr = math.Sqrt(s2 / sxx)
+	est.InterceptStdErr = math.Sqrt(s2 * (1/float64(n) + meanT*meanT/sxx))
+
+	t := studentT975(df)
+	est.SlopeLow = est.Slope - t*est.SlopeStdErr
+	est.SlopeHigh = est.Slope + t*est.SlopeStdErr
+	est.InterceptLow = est.Intercept - t*est.InterceptStdErr
+	est.InterceptHigh = est.Intercept + t*est.InterceptStdErr
+
+	return est, nil
+}
+
+// PPM is the drift rate in parts per million of media time.
+func (d DriftEstimate) PPM() float64 {
+	return d.Slope * 1e6
+}
+
+// MsPerHour is the offset accumulated over one hour of media.
+func (d DriftEstimate) MsPerHour() float64 {
+	return d.Slope * 3600 * 1000
+}
+
+// TotalDrift is the offset change predicted by the fit over the window.
+func (d DriftEstimate) TotalDrift() float64 {
+	return d.Slope * d.Span
+}
+
+// Classify decides between in sync, fixed offset and progressive drift.
+// Drift is reported when the slope confidence interval excludes zero and
+// the drift over the window stands out of the timestamp jitter; a fixed
+// offset when the intercept interval excludes zero and exceeds the jitter.
+// resolution is the timestamp precision below which differences are noise.
+func (d DriftEstimate) Classify(resolution float64) Verdict {
+	noise := math.Max(d.Residual, resolution)
+
+	slopeSignificant := d.SlopeLow > 0 || d.SlopeHigh < 0
+	if slopeSignificant && math.Abs(d.TotalDrift()) > noise {
+		return ProgressiveDrift
+	}
+
+	interceptSignificant := d.InterceptLow > 0 || d.InterceptHigh < 0
+	if interceptSignificant && math.Abs(d.Intercept) > noise {
+		return FixedOffset
+	}
+
+	return InSync
+}
+
+// studentT975 returns the two-sided 95% critical value of Student's t
+// distribution with df degrees of freedom.
+func studentT975(df int) float64 {
+	table := []float64{
+		12.706, 4.303, 3.182, 2.776, 2.571, 2.447, 2.365, 2.306, 2.262, 2.228,
+		2.201, 2.179, 2.160, 2.145, 2.131, 2.120, 2.110, 2.101, 2.093, 2.086,
+		2.080, 2.074, 2.069, 2.064, 2.060, 2.056, 2.052, 2.048, 2.045, 2.042,
+	}
+
+	if df <= 0 {
+		return math.Inf(1)
+	}
+	if df <= len(table) {
+		return table[df-1]
+	}
+
+	// Cornish-Fisher expansion around the normal quantile.
+	z := 1.959964
+	g := float64(df)
+	return z + (z*z*z+z)/(4*g) + (5*math.Pow(z, 5)+16*z*z*z+3*z)/(96*g*g)
+}
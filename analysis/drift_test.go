@@ -0,0 +1,247 @@
+package analysis
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+// line returns n samples one second apart on offset = intercept + slope*t.
+func line(n int, intercept, slope float64) []Sample {
+	samples := make([]Sample, n)
+	for i := range samples {
+		samples[i] = Sample{Time: 100 + float64(i), Offset: intercept + slope*float64(i)}
+	}
+	return samples
+}
+
+func near(got, want, tolerance float64) bool {
+	return math.Abs(got-want) <= tolerance
+}
+
+func TestEstimateDrift(t *testing.T) {
+	tests := []struct {
+		name    string
+		samples []Sample
+		want    DriftEstimate
+	}{
+		{
+			name:    "exact line",
+			samples: line(10, 0.1, 0.001),
+			want: DriftEstimate{
+				Samples: 10, Span: 9,
+				Slope: 0.001, SlopeLow: 0.001, SlopeHigh: 0.001,
+				Intercept: 0.1, InterceptLow: 0.1, InterceptHigh: 0.1,
+				R2: 1,
+			},
+		},
+		{
+			// Worked by hand: sxx 10, sxy 8, syy 10, sse 3.6, t(3) 3.182
+			name:    "scattered",
+			samples: []Sample{{0, 1}, {1, 3}, {2, 2}, {3, 5}, {4, 4}},
+			want: DriftEstimate{
+				Samples: 5, Span: 4,
+				Slope: 0.8, SlopeStdErr: math.Sqrt(0.12),
+				SlopeLow: 0.8 - 3.182*math.Sqrt(0.12), SlopeHigh: 0.8 + 3.182*math.Sqrt(0.12),
+				Intercept: 1.4, InterceptStdErr: math.Sqrt(0.72),
+				InterceptLow: 1.4 - 3.182*math.Sqrt(0.72), InterceptHigh: 1.4 + 3.182*math.Sqrt(0.72),
+				R2:       0.64,
+				Residual: math.Sqrt(1.2),
+			},
+		},
+		{
+			// The fewest samples that leave a residual: one degree of
+			// freedom, t 12.706
+			name:    "three samples",
+			samples: []Sample{{0, 0}, {1, 1}, {2, 0}},
+			want: DriftEstimate{
+				Samples: 3, Span: 2,
+				SlopeStdErr: math.Sqrt(1.0 / 3),
+				SlopeLow:    -12.706 * math.Sqrt(1.0/3), SlopeHigh: 12.706 * math.Sqrt(1.0/3),
+				Intercept: 1.0 / 3, InterceptStdErr: math.Sqrt(2.0 / 3 * (1.0/3 + 1.0/2)),
+				InterceptLow:  1.0/3 - 12.706*math.Sqrt(2.0/3*(1.0/3+1.0/2)),
+				InterceptHigh: 1.0/3 + 12.706*math.Sqrt(2.0/3*(1.0/3+1.0/2)),
+				R2:            0,
+				Residual:      math.Sqrt(2.0 / 3),
+			},
+		},
+		{
+			// Zero variance in the offsets: nothing to explain, R² is 1
+			// and the intervals collapse on the estimate
+			name:    "constant offset",
+			samples: line(5, -0.25, 0),
+			want: DriftEstimate{
+				Samples: 5, Span: 4,
+				Intercept: -0.25, InterceptLow: -0.25, InterceptHigh: -0.25,
+				R2: 1,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := EstimateDrift(tt.samples)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got.Samples != tt.want.Samples || !near(got.Span, tt.want.Span, 1e-9) {
+				t.Errorf("%d samples over %v, want %d over %v", got.Samples, got.Span, tt.want.Samples, tt.want.Span)
+			}
+
+			for _, f := range []struct {
+				name      string
+				got, want float64
+			}{
+				{"slope", got.Slope, tt.want.Slope},
+				{"slope stderr", got.SlopeStdErr, tt.want.SlopeStdErr},
+				{"slope low", got.SlopeLow, tt.want.SlopeLow},
+				{"slope high", got.SlopeHigh, tt.want.SlopeHigh},
+				{"intercept", got.Intercept, tt.want.Intercept},
+				{"intercept stderr", got.InterceptStdErr, tt.want.InterceptStdErr},
+				{"intercept low", got.InterceptLow, tt.want.InterceptLow},
+				{"intercept high", got.InterceptHigh, tt.want.InterceptHigh},
+				{"R²", got.R2, tt.want.R2},
+				{"residual", got.Residual, tt.want.Residual},
+			} {
+				if !near(f.got, f.want, 1e-9) {
+					t.Errorf("%s %v, want %v", f.name, f.got, f.want)
+				}
+			}
+		})
+	}
+}
+
+func TestEstimateDriftErrors(t *testing.T) {
+	for n := range 3 {
+		if _, err := EstimateDrift(line(n, 0, 0.001)); !errors.Is(err, ErrNotEnoughSamples) {
+			t.Errorf("%d samples: error %v, want %v", n, err, ErrNotEnoughSamples)
+		}
+	}
+
+	// Zero variance in time leaves the slope undefined
+	sameTime := []Sample{{5, 0.1}, {5, 0.2}, {5, 0.3}}
+	_, err := EstimateDrift(sameTime)
+	if err == nil || errors.Is(err, ErrNotEnoughSamples) {
+		t.Errorf("samples at one time: error %v, want a span error", err)
+	}
+}
+
+func TestDriftEstimateUnits(t *testing.T) {
+	estimate := DriftEstimate{Slope: 2e-5, Span: 600}
+
+	if !near(estimate.PPM(), 20, 1e-9) {
+		t.Errorf("PPM %v, want 20", estimate.PPM())
+	}
+	if !near(estimate.MsPerHour(), 72, 1e-9) {
+		t.Errorf("MsPerHour %v, want 72", estimate.MsPerHour())
+	}
+	if !near(estimate.TotalDrift(), 0.012, 1e-12) {
+		t.Errorf("TotalDrift %v, want 0.012", estimate.TotalDrift())
+	}
+}
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		name       string
+		estimate   DriftEstimate
+		resolution float64
+		want       Verdict
+	}{
+		{
+			name:       "nothing",
+			estimate:   DriftEstimate{Span: 10},
+			resolution: 0.001,
+			want:       InSync,
+		},
+		{
+			name:       "drift above the resolution",
+			estimate:   DriftEstimate{Span: 10, Slope: 0.001, SlopeLow: 0.0005, SlopeHigh: 0.0015},
+			resolution: 0.001,
+			want:       ProgressiveDrift,
+		},
+		{
+			name:       "drift below the resolution",
+			estimate:   DriftEstimate{Span: 10, Slope: 0.00005, SlopeLow: 0.00001, SlopeHigh: 0.0001},
+			resolution: 0.001,
+			want:       InSync,
+		},
+		{
+			name:       "drift within the jitter",
+			estimate:   DriftEstimate{Span: 10, Slope: 0.001, SlopeLow: 0.0005, SlopeHigh: 0.0015, Residual: 0.02},
+			resolution: 0.001,
+			want:       InSync,
+		},
+		{
+			name:       "slope interval across zero",
+			estimate:   DriftEstimate{Span: 10, Slope: 0.001, SlopeLow: -0.0005, SlopeHigh: 0.0025},
+			resolution: 0.001,
+			want:       InSync,
+		},
+		{
+			name:       "negative drift",
+			estimate:   DriftEstimate{Span: 10, Slope: -0.001, SlopeLow: -0.0015, SlopeHigh: -0.0005},
+			resolution: 0.001,
+			want:       ProgressiveDrift,
+		},
+		{
+			name:       "fixed offset",
+			estimate:   DriftEstimate{Span: 10, Intercept: 0.2, InterceptLow: 0.19, InterceptHigh: 0.21},
+			resolution: 0.001,
+			want:       FixedOffset,
+		},
+		{
+			name:       "offset below the resolution",
+			estimate:   DriftEstimate{Span: 10, Intercept: 0.0005, InterceptLow: 0.0004, InterceptHigh: 0.0006},
+			resolution: 0.001,
+			want:       InSync,
+		},
+		{
+			name:       "offset interval across zero",
+			estimate:   DriftEstimate{Span: 10, Intercept: 0.2, InterceptLow: -0.1, InterceptHigh: 0.5},
+			resolution: 0.001,
+			want:       InSync,
+		},
+		{
+			name:       "drift wins over offset",
+			estimate:   DriftEstimate{Span: 10, Slope: 0.001, SlopeLow: 0.0005, SlopeHigh: 0.0015, Intercept: 0.2, InterceptLow: 0.19, InterceptHigh: 0.21},
+			resolution: 0.001,
+			want:       ProgressiveDrift,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.estimate.Classify(tt.resolution); got != tt.want {
+				t.Errorf("Classify = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStudentT975(t *testing.T) {
+	// Reference two-sided 95% critical values
+	tests := []struct {
+		df   int
+		want float64
+	}{
+		{1, 12.706},
+		{2, 4.303},
+		{10, 2.228},
+		{30, 2.042},
+		{40, 2.021},
+		{60, 2.000},
+		{120, 1.980},
+		{1000, 1.962},
+	}
+
+	for _, tt := range tests {
+		if got := studentT975(tt.df); !near(got, tt.want, 0.002) {
+			t.Errorf("t(%d) = %.4f, want %.3f", tt.df, got, tt.want)
+		}
+	}
+
+	if got := studentT975(0); !math.IsInf(got, 1) {
+		t.Errorf("t(0) = %v, want +Inf", got)
+	}
+}
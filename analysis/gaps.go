@@ -0,0 +1,122 @@
+package analysis
+
+import (
+	"math"
+	"sort"
+)
+
+type GapKind string
+
+const (
+	// Gap is a frame starting later than the previous one ends: frames
+	// are missing.
+	Gap GapKind = "gap"
+	// Duplicate is a frame with the timestamp of the previous one.
+	Duplicate GapKind = "duplicate"
+	// Overlap is a frame starting before the previous one ends.
+	Overlap GapKind = "overlap"
+)
+
+// GapEvent is a break in the timeline of one stream. Index is the frame
+// after the break in the slice given to FindGaps, Time the end of the
+// frame before it and Size the missing or overlapping media in seconds.
+type GapEvent struct {
+	Index int
+	Kind  GapKind
+	Time  float64
+	Size  float64
+	// Frames is Size in frame durations.
+	Frames float64
+}
+
+// FindGaps checks that every frame starts where the one before it, in
+// presentation order, ends. A step off by less than half a frame, or
+// resolution seconds, is jitter. Frames without a duration are given the
+// usual step of the stream.
+func FindGaps(frames []Timestamp, resolution float64) []GapEvent {
+	order := make([]int, len(frames))
+	times := make([]float64, len(frames))
+	for i := range order {
+		order[i] = i
+		times[i] = frames[i].Pts
+	}
+	sort.SliceStable(order, func(i, j int) bool { return frames[order[i]].Pts < frames[order[j]].Pts })
+	sort.Float64s(times)
+
+	step := FrameDuration(times)
+	events := []GapEvent{}
+
+	for k := 1; k < len(order); k++ {
+		previous, current := frames[order[k-1]], frames[order[k]]
+
+		duration := previous.Duration
+		if duration <= 0 {
+			duration = step
+		}
+		if duration <= 0 {
+			continue
+		}
+
+		end := previous.Pts + duration
+		tolerance := math.Max(resolution, duration/2)
+		event := GapEvent{Index: order[k], Time: end}
+
+		switch delta := current.Pts - previous.Pts; {
+		case delta < resolution:
+			event.Kind = Duplicate
+			event.Size = duration
+		case delta < duration-tolerance:
+			event.Kind = Overlap
+			event.Size = end - current.Pts
+		case delta > duration+tolerance:
+			event.Kind = Gap
+			event.Size = current.Pts - end
+		default:
+			continue
+		}
+
+		event.Frames = event.Size / duration
+		events = append(events, event)
+	}
+
+	return events
+}
+
+// OffsetJump returns the change of the offset across the media time range
+// [start, end]: the median offset of the n samples after end minus the one
+// of the n samples before start. ok is false when a side has no samples.
+func OffsetJump(samples []Sample, start, end float64, n int) (jump float64, ok bool) {
+	sorted := append([]Sample(nil), samples...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Time < sorted[j].Time })
+
+	first := sort.Search(len(sorted), func(i int) bool { return sorted[i].Time >= start })
+	last := sort.Search(len(sorted), func(i int) bool { return sorted[i].Time > end })
+
+	before := sorted[max(first-n, 0):first]
+	after := sorted[last:min(last+n, len(sorted))]
+	if len(before) == 0 || len(after) == 0 {
+		return 0, false
+	}
+
+	return MedianOffset(after) - MedianOffset(before), true
+}
+
+// MedianOffset returns the median offset of samples, zero when there are
+// none.
+func MedianOffset(samples []Sample) float64 {
+	if len(samples) == 0 {
+		return 0
+	}
+
+	offsets := make([]float64, len(samples))
+	for i, s := range samples {
+		offsets[i] = s.Offset
+	}
+	sort.Float64s(offsets)
+
+	middle := len(offsets) / 2
+	if len(offsets)%2 == 0 {
+		return (offsets[middle-1] + offsets[middle]) / 2
+	}
+	return offsets[middle]
+}
@@ -0,0 +1,125 @@
+package analysis
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Timestamp is the presentation interval of one frame, in seconds.
+type Timestamp struct {
+	Pts      float64
+	Duration float64
+}
+
+// Pairing selects how audio frames are matched to video frames.
+type Pairing string
+
+const (
+	// PairIndex matches the i-th video frame with the i-th audio frame.
+	// Audio and video frames usually have different durations, so this
+	// only makes sense for streams with equal frame rates.
+	PairIndex Pairing = "index"
+	// PairNearest matches each video frame with the audio frame whose
+	// PTS is closest to the video PTS. Video frames farther than one audio
+	// frame duration from any audio frame, in a hole of the audio or past
+	// its ends, are left unpaired.
+	PairNearest Pairing = "nearest"
+	// PairCover matches each video frame with the audio frame whose
+	// interval covers the video PTS. Video frames without a covering
+	// audio frame are left unpaired.
+	PairCover Pairing = "cover"
+)
+
+var Pairings = []string{string(PairNearest), string(PairCover), string(PairIndex)}
+
+// Pair is a video frame matched with an audio frame. Video and Audio are
+// indices into the slices given to PairFrames.
+type Pair struct {
+	Video  int
+	Audio  int
+	Offset float64
+}
+
+// PairFrames matches video frames to audio frames with the given strategy.
+// Offset is the audio PTS minus the video PTS of each pair.
+func PairFrames(video, audio []Timestamp, strategy Pairing) ([]Pair, error) {
+	pairs := []Pair{}
+
+	if strategy == PairIndex {
+		for i := 0; i < min(len(video), len(audio)); i++ {
+			pairs = append(pairs, Pair{Video: i, Audio: i, Offset: audio[i].Pts - video[i].Pts})
+		}
+		return pairs, nil
+	}
+
+	if strategy != PairNearest && strategy != PairCover {
+		return nil, fmt.Errorf("unknown pairing strategy %q", strategy)
+	}
+
+	if len(audio) == 0 {
+		return pairs, nil
+	}
+
+	// Audio timestamps are normally monotonic, but sort anyway so a
+	// reordered frame does not break the binary search.
+	order := make([]int, len(audio))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return audio[order[i]].Pts < audio[order[j]].Pts
+	})
+
+	// Usual audio frame duration, for the frames that do not carry one
+	times := make([]float64, len(order))
+	for i, ai := range order {
+		times[i] = audio[ai].Pts
+	}
+	step := FrameDuration(times)
+
+	for vi, v := range video {
+		// First audio frame starting after the video PTS
+		k := sort.Search(len(order), func(i int) bool {
+			return audio[order[i]].Pts > v.Pts
+		})
+
+		switch strategy {
+		case PairNearest:
+			best := -1
+			bestDist := math.Inf(1)
+			for _, c := range []int{k - 1, k} {
+				if c < 0 || c >= len(order) {
+					continue
+				}
+				if d := math.Abs(audio[order[c]].Pts - v.Pts); d < bestDist {
+					best, bestDist = order[c], d
+				}
+			}
+			limit := audio[best].Duration
+			if limit <= 0 {
+				limit = step
+			}
+			if limit > 0 && bestDist > limit {
+				continue
+			}
+			pairs = append(pairs, Pair{Video: vi, Audio: best, Offset: audio[best].Pts - v.Pts})
+		case PairCover:
+			if k == 0 {
+				continue
+			}
+			ai := order[k-1]
+			end := audio[ai].Pts + audio[ai].Duration
+			if audio[ai].Duration <= 0 && k < len(order) {
+				// Unknown duration, assume the frame lasts until the next one
+				end = audio[order[k]].Pts
+			}
+			if v.Pts >= end {
+				continue
+			}
+			pairs = append(pairs, Pair{Video: vi, Audio: ai, Offset: audio[ai].Pts - v.Pts})
+		}
+	}
+
+	return pairs, nil
+}
@@ -0,0 +1,164 @@
+package analysis
+
+import (
+	"math"
+	"testing"
+)
+
+// frames returns n timestamps step seconds apart from start.
+func frames(start, step float64, n int, duration float64) []Timestamp {
+	ts := make([]Timestamp, n)
+	for i := range ts {
+		ts[i] = Timestamp{Pts: start + float64(i)*step, Duration: duration}
+	}
+	return ts
+}
+
+func TestPairFrames(t *testing.T) {
+	video := frames(10, 0.04, 5, 0.04)
+
+	// Audio frames of 20 ms with a hole from 10.06 to 10.155
+	audio := append(frames(10, 0.02, 3, 0.02), frames(10.155, 0.02, 3, 0.02)...)
+
+	tests := []struct {
+		name     string
+		video    []Timestamp
+		audio    []Timestamp
+		strategy Pairing
+		want     []Pair
+	}{
+		{
+			name:     "index",
+			video:    video[:3],
+			audio:    audio,
+			strategy: PairIndex,
+			want:     []Pair{{0, 0, 0}, {1, 1, -0.02}, {2, 2, -0.04}},
+		},
+		{
+			name:     "nearest leaves frames in an audio hole unpaired",
+			video:    video,
+			audio:    audio,
+			strategy: PairNearest,
+			want:     []Pair{{0, 0, 0}, {1, 2, 0}, {4, 3, -0.005}},
+		},
+		{
+			name:     "nearest past the end of the audio",
+			video:    video,
+			audio:    audio[:2],
+			strategy: PairNearest,
+			want:     []Pair{{0, 0, 0}, {1, 1, -0.02}},
+		},
+		{
+			name:     "nearest without durations uses the usual step",
+			video:    video,
+			audio:    frames(10.005, 0.02, 3, 0),
+			strategy: PairNearest,
+			want:     []Pair{{0, 0, 0.005}, {1, 2, 0.005}},
+		},
+		{
+			name:     "nearest with the audio out of reach",
+			video:    video[:2],
+			audio:    frames(15, 0.02, 10, 0.02),
+			strategy: PairNearest,
+			want:     []Pair{},
+		},
+		{
+			name:     "cover",
+			video:    video,
+			audio:    audio,
+			strategy: PairCover,
+			want:     []Pair{{0, 0, 0}, {1, 2, 0}, {4, 3, -0.005}},
+		},
+		{
+			name:     "no audio",
+			video:    video,
+			audio:    nil,
+			strategy: PairNearest,
+			want:     []Pair{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := PairFrames(tt.video, tt.audio, tt.strategy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d pairs %v, want %v", len(got), got, tt.want)
+			}
+			for i := range got {
+				if got[i].Video != tt.want[i].Video || got[i].Audio != tt.want[i].Audio || math.Abs(got[i].Offset-tt.want[i].Offset) > 1e-9 {
+					t.Errorf("pair %d is %v, want %v", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestPairFramesUnknownStrategy(t *testing.T) {
+	if _, err := PairFrames(nil, nil, "closest"); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+// TestPairFramesAudioDropout pairs the frames of the audio_dropout
+// self-test scenario: 20 s of video and of 20 ms audio frames with the
+// audio from 20 s to 21 s lost. The video frames in the hole used to be
+// paired with audio up to half a second away, offsets that came from the
+// loss and not from the timing of the streams. Left unpaired, they leave
+// only pairs in sync, so trackdiff, drift and trackdrift must all find the
+// scenario in sync.
+func TestPairFramesAudioDropout(t *testing.T) {
+	video := frames(10, 0.04, 500, 0.04)
+	audio := append(frames(10, 0.02, 500, 0.02), frames(21, 0.02, 450, 0.02)...)
+
+	pairs, err := PairFrames(video, audio, PairNearest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	paired := map[int]bool{}
+	samples := make([]Sample, len(pairs))
+	var sum float64
+	for i, p := range pairs {
+		paired[p.Video] = true
+		samples[i] = Sample{Time: video[p.Video].Pts, Offset: p.Offset}
+		sum += p.Offset
+
+		if math.Abs(p.Offset) > 0.02+1e-9 {
+			t.Errorf("video frame at %.2f paired %.3f seconds away", video[p.Video].Pts, p.Offset)
+		}
+	}
+
+	// The frames after the first one of the hole are more than an audio
+	// frame away from any audio
+	for vi, v := range video {
+		if v.Pts > 20.01 && v.Pts < 20.99 && paired[vi] {
+			t.Errorf("video frame at %.2f in the hole is paired", v.Pts)
+		}
+	}
+
+	// trackdiff: the mean offset
+	if mean := sum / float64(len(pairs)); math.Abs(mean) > 0.001 {
+		t.Errorf("mean offset %.4f, want about 0", mean)
+	}
+
+	// drift: the fit over every pair
+	estimate, err := EstimateDrift(samples)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := estimate.Classify(0.001); got != InSync || math.Abs(estimate.PPM()) > 100 {
+		t.Errorf("drift fit %s at %.1f ppm, want in sync", got, estimate.PPM())
+	}
+
+	// trackdrift: the trend of 4 s windows every 2 s
+	trend, err := WindowTrend(SlidingWindows(samples, 4, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := trend.Classify(0.001); got != InSync || math.Abs(trend.PPM()) > 100 {
+		t.Errorf("window trend %s at %.1f ppm, want in sync", got, trend.PPM())
+	}
+}
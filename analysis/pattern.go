@@ -0,0 +1,117 @@
+package analysis
+
+import (
+	"math"
+	"sort"
+)
+
+// Luma returns the mean brightness of every frame of frameSize bytes of
+// 8-bit gray pixels.
+func Luma(frames []byte, frameSize int) []float64 {
+	if frameSize < 1 {
+		return nil
+	}
+
+	levels := make([]float64, len(frames)/frameSize)
+	for i := range levels {
+		total := 0
+		for _, p := range frames[i*frameSize : (i+1)*frameSize] {
+			total += int(p)
+		}
+		levels[i] = float64(total) / float64(frameSize)
+	}
+	return levels
+}
+
+// RMS returns the root mean square amplitude of pcm in bins of size
+// samples.
+func RMS(pcm []int16, size int) []float64 {
+	if size < 1 {
+		return nil
+	}
+
+	levels := make([]float64, len(pcm)/size)
+	for i := range levels {
+		energy := 0.0
+		for _, s := range pcm[i*size : (i+1)*size] {
+			energy += float64(s) * float64(s)
+		}
+		levels[i] = math.Sqrt(energy / float64(size))
+	}
+	return levels
+}
+
+// Bursts returns the times, in seconds, at which levels sampled at rate
+// rise above halfway between their median and their maximum. A rise less
+// than refractory seconds after the previous one belongs to the same
+// burst. No bursts are found when the maximum is less than minContrast
+// above the median.
+func Bursts(levels []float64, rate, minContrast, refractory float64) []float64 {
+	times := []float64{}
+	if len(levels) == 0 {
+		return times
+	}
+
+	sorted := append([]float64(nil), levels...)
+	sort.Float64s(sorted)
+	median, peak := sorted[len(sorted)/2], sorted[len(sorted)-1]
+
+	if peak-median < minContrast {
+		return times
+	}
+
+	threshold := median + (peak-median)/2
+	last := math.Inf(-1)
+
+	for i := 1; i < len(levels); i++ {
+		if levels[i] < threshold || levels[i-1] >= threshold {
+			continue
+		}
+
+		t := float64(i) / rate
+		if t-last >= refractory {
+			times = append(times, t)
+		}
+		last = t
+	}
+
+	return times
+}
+
+// EventPair is a flash matched with a beep, times in seconds.
+type EventPair struct {
+	Flash float64
+	Beep  float64
+}
+
+// Offset is how many seconds the beep comes after the flash.
+func (p EventPair) Offset() float64 {
+	return p.Beep - p.Flash
+}
+
+// PairEvents matches every flash with the nearest beep no more than
+// maxOffset seconds away. A beep is only used by the first flash to claim
+// it.
+func PairEvents(flashes, beeps []float64, maxOffset float64) []EventPair {
+	pairs := []EventPair{}
+	used := map[int]bool{}
+
+	for _, flash := range flashes {
+		best := -1
+		for j, beep := range beeps {
+			if used[j] || math.Abs(beep-flash) > maxOffset {
+				continue
+			}
+			if best < 0 || math.Abs(beep-flash) < math.Abs(beeps[best]-flash) {
+				best = j
+			}
+		}
+
+		if best >= 0 {
+			used[best] = true
+			pairs = append(pairs, EventPair{Flash: flash, Beep: beeps[best]})
+		}
+	}
+
+	return pairs
+}
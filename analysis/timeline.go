@@ -0,0 +1,50 @@
+package analysis
+
+import "sort"
+
+// Discontinuity is a jump in the timestamps of one stream: a step backwards,
+// as after a reconnect resets the timestamps, or forwards by more than the
+// allowed number of frame durations.
+type Discontinuity struct {
+	// Index is the first frame after the jump.
+	Index int
+	// Time is the timestamp before the jump, in seconds.
+	Time float64
+	// Jump is the step beyond one frame duration, negative backwards.
+	Jump float64
+}
+
+// FrameDuration returns the median step between consecutive timestamps,
+// zero when there are none.
+func FrameDuration(times []float64) float64 {
+	steps := []float64{}
+	for i := 1; i < len(times); i++ {
+		if step := times[i] - times[i-1]; step > 0 {
+			steps = append(steps, step)
+		}
+	}
+
+	if len(steps) == 0 {
+		return 0
+	}
+
+	sort.Float64s(steps)
+	return steps[len(steps)/2]
+}
+
+// FindDiscontinuities returns the places where times, which must be in
+// decoding order, step backwards or forwards by more than maxFrames times
+// the frame duration.
+func FindDiscontinuities(times []float64, maxFrames float64) []Discontinuity {
+	duration := FrameDuration(times)
+	result := []Discontinuity{}
+
+	for i := 1; i < len(times); i++ {
+		step := times[i] - times[i-1]
+		if step < 0 || (duration > 0 && step > maxFrames*duration) {
+			result = append(result, Discontinuity{Index: i, Time: times[i-1], Jump: step - duration})
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,66 @@
+package analysis
+
+import "sort"
+
+// Window is the mean offset of the samples whose time falls in
+// [Start, End).
+type Window struct {
+	Start   float64
+	End     float64
+	Samples int
+	Offset  float64
+}
+
+// Middle is the media time the window stands for.
+func (w Window) Middle() float64 {
+	return (w.Start + w.End) / 2
+}
+
+// SlidingWindows averages the offsets of samples over windows of length
+// seconds, starting every step seconds from the first sample. Windows are
+// cut while they lie within the samples, so the last one may be left out;
+// windows without samples are skipped.
+func SlidingWindows(samples []Sample, length, step float64) []Window {
+	windows := []Window{}
+	if len(samples) == 0 || length <= 0 || step <= 0 {
+		return windows
+	}
+
+	sorted := append([]Sample(nil), samples...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Time < sorted[j].Time })
+
+	first, last := sorted[0].Time, sorted[len(sorted)-1].Time
+
+	for n := 0; ; n++ {
+		start := first + float64(n)*step
+		end := start + length
+		if end > last+step/2 {
+			break
+		}
+
+		lo := sort.Search(len(sorted), func(i int) bool { return sorted[i].Time >= start })
+		hi := sort.Search(len(sorted), func(i int) bool { return sorted[i].Time >= end })
+		if lo == hi {
+			continue
+		}
+
+		var sum float64
+		for _, s := range sorted[lo:hi] {
+			sum += s.Offset
+		}
+		windows = append(windows, Window{Start: start, End: end, Samples: hi - lo, Offset: sum / float64(hi-lo)})
+	}
+
+	return windows
+}
+
+// WindowTrend fits a line through the mean offsets of windows, at their
+// middle. Averaging over a window removes most of the pairing jitter, so
+// what is left of the residual is how unevenly the offset moves.
+func WindowTrend(windows []Window) (DriftEstimate, error) {
+	samples := make([]Sample, len(windows))
+	for i, w := range windows {
+		samples[i] = Sample{Time: w.Middle(), Offset: w.Offset}
+	}
+	return EstimateDrift(samples)
+}
@@ -0,0 +1,116 @@
+package analysis
+
+import (
+	"errors"
+	"testing"
+)
+
+// seconds returns one sample per second at the given times, on a 1 ms/s
+// drift.
+func seconds(ts ...float64) []Sample {
+	samples := make([]Sample, len(ts))
+	for i, t := range ts {
+		samples[i] = Sample{Time: t, Offset: 0.001 * t}
+	}
+	return samples
+}
+
+func TestSlidingWindows(t *testing.T) {
+	tests := []struct {
+		name         string
+		samples      []Sample
+		length, step float64
+		want         []Window
+	}{
+		{
+			name:    "overlapping",
+			samples: seconds(0, 1, 2, 3, 4, 5, 6, 7, 8, 9),
+			length:  4, step: 2,
+			want: []Window{
+				{Start: 0, End: 4, Samples: 4, Offset: 0.0015},
+				{Start: 2, End: 6, Samples: 4, Offset: 0.0035},
+				{Start: 4, End: 8, Samples: 4, Offset: 0.0055},
+				{Start: 6, End: 10, Samples: 4, Offset: 0.0075},
+			},
+		},
+		{
+			name:    "unsorted",
+			samples: seconds(9, 3, 5, 1, 7, 0, 2, 8, 4, 6),
+			length:  4, step: 2,
+			want: []Window{
+				{Start: 0, End: 4, Samples: 4, Offset: 0.0015},
+				{Start: 2, End: 6, Samples: 4, Offset: 0.0035},
+				{Start: 4, End: 8, Samples: 4, Offset: 0.0055},
+				{Start: 6, End: 10, Samples: 4, Offset: 0.0075},
+			},
+		},
+		{
+			name:    "empty windows skipped",
+			samples: seconds(0, 1, 2, 3, 8, 9, 10, 11),
+			length:  2, step: 2,
+			want: []Window{
+				{Start: 0, End: 2, Samples: 2, Offset: 0.0005},
+				{Start: 2, End: 4, Samples: 2, Offset: 0.0025},
+				{Start: 8, End: 10, Samples: 2, Offset: 0.0085},
+				{Start: 10, End: 12, Samples: 2, Offset: 0.0105},
+			},
+		},
+		{
+			name:    "longer than the samples",
+			samples: seconds(0, 1, 2),
+			length:  10, step: 5,
+		},
+		{
+			name:   "no samples",
+			length: 4, step: 2,
+		},
+		{
+			name:    "no length",
+			samples: seconds(0, 1, 2, 3),
+			length:  0, step: 2,
+		},
+		{
+			name:    "no step",
+			samples: seconds(0, 1, 2, 3),
+			length:  2, step: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := SlidingWindows(tt.samples, tt.length, tt.step)
+
+			if len(got) != len(tt.want) {
+				t.Fatalf("%d windows %v, want %d", len(got), got, len(tt.want))
+			}
+			for i := range got {
+				w, want := got[i], tt.want[i]
+				if w.Samples != want.Samples || !near(w.Start, want.Start, 1e-9) ||
+					!near(w.End, want.End, 1e-9) || !near(w.Offset, want.Offset, 1e-9) {
+					t.Errorf("window %d %+v, want %+v", i, w, want)
+				}
+			}
+		})
+	}
+}
+
+func TestWindowTrend(t *testing.T) {
+	windows := SlidingWindows(seconds(0, 1, 2, 3, 4, 5, 6, 7, 8, 9), 4, 2)
+
+	trend, err := WindowTrend(windows)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The intercept is the offset at the middle of the first window
+	if !near(trend.Slope, 0.001, 1e-9) || !near(trend.Intercept, 0.0015, 1e-9) {
+		t.Errorf("slope %v, intercept %v", trend.Slope, trend.Intercept)
+	}
+	if trend.Samples != 4 || !near(trend.Span, 6, 1e-9) {
+		t.Errorf("%d samples over %v", trend.Samples, trend.Span)
+	}
+
+	if _, err := WindowTrend(windows[:2]); !errors.Is(err, ErrNotEnoughSamples) {
+		t.Errorf("2 windows: error %v, want %v", err, ErrNotEnoughSamples)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"os/exec"
+	"strings"
+)
+
+// Command is an ffmpeg or ffprobe invocation built one argument at a time
+// and executed without a shell, so URIs and other values from the cameras
+// CSV are passed through verbatim whatever characters they contain.
+type Command struct {
+	Name string
+	Args []string
+}
+
+func NewCommand(name string) *Command {
+	return &Command{Name: name}
+}
+
+// Arg appends arguments as they are.
+func (c *Command) Arg(args ...string) *Command {
+	c.Args = append(c.Args, args...)
+	return c
+}
+
+// Option appends "-name value".
+func (c *Command) Option(name string, value string) *Command {
+	return c.Arg("-"+name, value)
+}
+
+// OptionIf appends "-name value" when value is not empty.
+func (c *Command) OptionIf(name string, value string) *Command {
+	if value == "" {
+		return c
+	}
+	return c.Option(name, value)
+}
+
+// String returns the command line quoted for a POSIX shell, for logging and
+// copy-pasting, with URI credentials masked. It is never executed as such.
+func (c *Command) String() string {
+	words := make([]string, 0, len(c.Args)+1)
+	words = append(words, shellQuote(c.Name))
+	for _, arg := range c.Args {
+		words = append(words, shellQuote(Redact(arg)))
+	}
+	return strings.Join(words, " ")
+}
+
+// Cmd prepares the command so that it is killed together with every process
+// it spawned when ctx is done.
+func (c *Command) Cmd(ctx context.Context) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, c.Name, c.Args...)
+	killProcessGroup(cmd)
+	return cmd
+}
+
+func shellQuote(word string) string {
+	if word == "" {
+		return "''"
+	}
+
+	safe := strings.IndexFunc(word, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_./:=,+@%", r))
+	}) == -1
+
+	if safe {
+		return word
+	}
+	return "'" + strings.ReplaceAll(word, "'", `'\''`) + "'"
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"find_desync/analysis"
+)
+
+// The contentsync method decodes the audio to 8 kHz mono and the video to
+// small gray frames, and compares their envelopes in 10 ms bins.
+const (
+	contentSampleRate = 8000
+	contentFrameRate  = 25
+	contentWidth      = 64
+	contentHeight     = 36
+	contentBinRate    = 100
+	// contentMaxLag is the largest offset looked for, either way.
+	contentMaxLag = 2.0
+)
+
+// A correlation peak below contentMinPeak, or standing less than
+// contentMinProminence standard deviations above the other lags, may be
+// chance: the content gives no reliable offset.
+const (
+	contentMinPeak       = 0.2
+	contentMinProminence = 4.0
+)
+
+// lipSyncLead and lipSyncLag are the sound advance and delay viewers start
+// to notice, from ITU-R BT.1359.
+const (
+	lipSyncLead = 0.045
+	lipSyncLag  = 0.125
+)
+
+// ContentInconclusive is the contentsync verdict when sound and picture do
+// not correlate well enough to tell an offset.
+const ContentInconclusive = "inconclusive"
+
+// ContentInfo holds a contentsync measurement. Diff is how many seconds
+// the sound comes after the picture, negative when it comes first.
+type ContentInfo struct {
+	ApartName  string
+	CameraHash string
+	Source     string
+	Diff       float64
+	Peak       float64
+	Prominence float64
+	Confident  bool
+	Duration   float64
+	Verdict    string
+}
+
+func NewContentInfo(apartName, uri string) ContentInfo {
+	return ContentInfo{
+		ApartName:  apartName,
+		CameraHash: CameraID(uri),
+		Source:     Redact(uri),
+	}
+}
+
+// ContentSync measures the offset between what is heard and what is seen:
+// it cross-correlates the sound onsets with the changes of the picture,
+// whatever the timestamps claim.
+func (a *Analyzer) ContentSync(ctx context.Context, uri string, count int, apart string, direct bool, useTime bool) (ContentInfo, error) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+
+	length := count
+	if !useTime {
+		length = max(count/contentFrameRate, 1)
+	}
+
+	var sourceFile string
+
+	if !direct {
+		var err error
+		sourceFile, err = a.recordTempFile(ctx, uri, length, false)
+		if err != nil {
+			return ContentInfo{}, err
+		}
+		defer a.options.Workspace.Release(sourceFile)
+	} else {
+		sourceFile = uri
+	}
+
+	audio, video, err := a.decodeMedia(ctx, sourceFile, length, contentFrameRate)
+	if err != nil {
+		logger.Error(fmt.Sprintf("Error decoding: %v", err))
+		return ContentInfo{}, err
+	}
+
+	if len(audio) < 2 || len(video) < 2*contentWidth*contentHeight {
+		return ContentInfo{}, fmt.Errorf("decoded %d audio bytes and %d video bytes: %w", len(audio), len(video), analysis.ErrNotEnoughSamples)
+	}
+
+	soundEnvelope := analysis.AudioEnvelope(samples(audio), contentSampleRate, contentBinRate)
+	pictureEnvelope := analysis.Resample(analysis.MotionEnvelope(video, contentWidth*contentHeight), contentFrameRate, contentBinRate)
+
+	n := min(len(soundEnvelope), len(pictureEnvelope))
+	soundEnvelope, pictureEnvelope = soundEnvelope[:n], pictureEnvelope[:n]
+
+	fmt.Fprintf(a.out, "\n=== Stream: %s ===\n", Redact(uri))
+	fmt.Fprintf(a.out, "Correlating %.1f seconds of sound onsets and picture changes\n", float64(n)/contentBinRate)
+
+	correlation, err := analysis.CrossCorrelate(pictureEnvelope, soundEnvelope, contentBinRate, contentMaxLag)
+	if errors.Is(err, analysis.ErrNoEvents) {
+		// Silence or a still picture says nothing about the sync
+		a.yellow("Nothing to correlate: %v", err)
+		correlation, err = analysis.Correlation{}, nil
+	}
+	if err != nil {
+		a.yellow("Cannot correlate sound and picture: %v", err)
+		return ContentInfo{}, err
+	}
+
+	contentInfo := NewContentInfo(apart, uri)
+	contentInfo.Diff = correlation.Lag
+	contentInfo.Peak = correlation.Peak
+	contentInfo.Prominence = correlation.Prominence
+	contentInfo.Duration = float64(n) / contentBinRate
+	contentInfo.Confident = correlation.Peak >= contentMinPeak && correlation.Prominence >= contentMinProminence
+
+	switch {
+	case !contentInfo.Confident:
+		contentInfo.Verdict = ContentInconclusive
+	case contentInfo.Diff > lipSyncLag || contentInfo.Diff < -lipSyncLead:
+		contentInfo.Verdict = VerdictDesynced
+	default:
+		contentInfo.Verdict = VerdictInSync
+	}
+
+	fmt.Fprintf(a.out, "\n=== ANALYSIS ===\n")
+	fmt.Fprintf(a.out, "Sound after picture: %.3f seconds\n", contentInfo.Diff)
+	fmt.Fprintf(a.out, "Correlation:         %.2f, %.1f standard deviations above other offsets\n", contentInfo.Peak, contentInfo.Prominence)
+
+	switch contentInfo.Verdict {
+	case ContentInconclusive:
+		a.yellow("\nINCONCLUSIVE: sound and picture events do not line up clearly, try a longer window or a scene with motion and sound")
+	case VerdictDesynced:
+		if contentInfo.Diff > 0 {
+			a.red("\nSOUND LATE by %.0f ms", contentInfo.Diff*1000)
+		} else {
+			a.red("\nSOUND EARLY by %.0f ms", -contentInfo.Diff*1000)
+		}
+	default:
+		a.green("\nSound and picture are in sync")
+	}
+
+	return contentInfo, nil
+}
+
+// decodeMedia decodes length seconds of the source into raw PCM and gray
+// frames at frameRate in the workspace and returns their content.
+func (a *Analyzer) decodeMedia(ctx context.Context, url string, length int, frameRate int) ([]byte, []byte, error) {
+	camera := cameraName(ctx, url)
+
+	// Mono 16-bit samples and one byte per pixel
+	audioSize := int64(length) * contentSampleRate * 2
+	videoSize := int64(length) * int64(frameRate) * contentWidth * contentHeight
+
+	audioFile, _, err := a.options.Workspace.Create(camera, ".pcm", audioSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer a.options.Workspace.Discard(audioFile)
+
+	videoFile, _, err := a.options.Workspace.Create(camera, ".gray", videoSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer a.options.Workspace.Discard(videoFile)
+
+	fmt.Fprintf(a.out, "Decoding %s\n", Redact(url))
+
+	err = a.retry(ctx, "Decode", func() error {
+		return a.runner.Decode(ctx, DecodeRequest{
+			URL:        url,
+			Length:     length,
+			AudioFile:  audioFile,
+			VideoFile:  videoFile,
+			SampleRate: contentSampleRate,
+			FrameRate:  frameRate,
+			Width:      contentWidth,
+			Height:     contentHeight,
+		})
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	audio, err := os.ReadFile(audioFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	video, err := os.ReadFile(videoFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return audio, video, nil
+}
+
+// samples converts signed 16-bit little endian PCM.
+func samples(pcm []byte) []int16 {
+	result := make([]int16, len(pcm)/2)
+	for i := range result {
+		result[i] = int16(binary.LittleEndian.Uint16(pcm[2*i:]))
+	}
+	return result
+}
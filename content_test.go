@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+func TestContentSyncNoEvents(t *testing.T) {
+	const seconds = 10
+
+	silence := make([]byte, seconds*contentSampleRate*2)
+	still := bytes.Repeat([]byte{128}, seconds*contentFrameRate*contentWidth*contentHeight)
+
+	// A 1 kHz square wave and a picture changing every frame
+	tone := make([]byte, len(silence))
+	for i := 0; i < len(tone); i += 2 {
+		if i/2%8 < 4 {
+			tone[i+1] = 0x40
+		}
+	}
+	moving := make([]byte, len(still))
+	for i := range moving {
+		moving[i] = byte(i / (contentWidth * contentHeight) % 2 * 200)
+	}
+
+	tests := []struct {
+		name  string
+		audio []byte
+		video []byte
+	}{
+		{"silence", silence, moving},
+		{"still picture", tone, still},
+		{"silence and still picture", silence, still},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			analyzer := fakeAnalyzer(t, &FakeRunner{Audio: tt.audio, Video: tt.video})
+
+			info, err := analyzer.ContentSync(context.Background(), testURI, seconds, "Apart 1", true, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Verdict != ContentInconclusive || info.Confident {
+				t.Errorf("verdict %q, confident %v, want inconclusive", info.Verdict, info.Confident)
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+// Package credentials masks the user names and passwords of camera URIs
+// in any text shown to the user.
+package credentials
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// schemePattern matches the start of every URI in a text.
+var schemePattern = regexp.MustCompile(`[a-zA-Z][a-zA-Z0-9+.-]*://`)
+
+// hostPattern matches the host, and port, that follows the userinfo of a
+// URI, up to the path or the end of the URI.
+var hostPattern = regexp.MustCompile(`^(\[[0-9a-fA-F:.]+\]|[a-zA-Z0-9._-]+)(:[0-9]+)?([/?#\s'",;)]|$)`)
+
+// minSecretLength is the shortest registered password Mask hides outside
+// of a URI. Shorter ones, and user names, are common words and numbers that
+// would mask unrelated text.
+const minSecretLength = 6
+
+var (
+	mu      sync.RWMutex
+	secrets = map[string]bool{}
+)
+
+// Register remembers the password of a camera URI, so Mask hides it
+// wherever it shows up, even outside of a URI it can recognize. User names
+// and passwords shorter than minSecretLength are only masked inside URIs.
+func Register(uri string) {
+	m := schemePattern.FindStringIndex(uri)
+	if m == nil {
+		return
+	}
+
+	start, end, ok := userinfo(uri, m[1], len(uri))
+	if !ok {
+		return
+	}
+
+	_, password, found := strings.Cut(uri[start:end], ":")
+	if !found || len(password) < minSecretLength {
+		return
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	secrets[password] = true
+}
+
+// userinfo finds the userinfo of the URI whose scheme ends at from, the
+// text up to the last "@" followed by a host before limit or the end of
+// the line. Passwords from the cameras CSV are often not percent-encoded
+// and may hold any character.
+func userinfo(s string, from, limit int) (start, end int, ok bool) {
+	if nl := strings.IndexByte(s[from:limit], '\n'); nl >= 0 {
+		limit = from + nl
+	}
+
+	rest := s[from:limit]
+	for at := strings.LastIndexByte(rest, '@'); at >= 0; at = strings.LastIndexByte(rest[:at], '@') {
+		if hostPattern.MatchString(s[from+at+1:]) {
+			return from, from + at, true
+		}
+	}
+	return 0, 0, false
+}
+
+// Mask replaces the userinfo of every URI found in s with "***", and the
+// registered passwords wherever they are.
+func Mask(s string) string {
+	var b strings.Builder
+	masked := 0
+
+	matches := schemePattern.FindAllStringIndex(s, -1)
+	for i, m := range matches {
+		if m[0] < masked {
+			continue
+		}
+
+		limit := len(s)
+		if i+1 < len(matches) {
+			limit = matches[i+1][0]
+		}
+
+		start, end, ok := userinfo(s, m[1], limit)
+		if !ok {
+			continue
+		}
+
+		b.WriteString(s[masked:start])
+		b.WriteString("***")
+		masked = end
+	}
+	b.WriteString(s[masked:])
+
+	mu.RLock()
+	defer mu.RUnlock()
+
+	redacted := b.String()
+	for secret := range secrets {
+		redacted = strings.ReplaceAll(redacted, secret, "***")
+	}
+	return redacted
+}
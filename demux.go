@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"find_desync/mpegts"
+)
+
+// Demuxers: which reader extracts the frame timestamps. Auto uses the
+// built-in MPEG-TS demuxer for .ts files and udp:// sources and ffprobe
+// for everything else.
+const (
+	DemuxAuto    = "auto"
+	DemuxFFprobe = "ffprobe"
+	DemuxNative  = "native"
+)
+
+var Demuxers = []string{DemuxAuto, DemuxFFprobe, DemuxNative}
+
+// nativeDemux reports whether url is read by the built-in demuxer. Such
+// sources are never recorded first.
+func (a *Analyzer) nativeDemux(url string) bool {
+	switch a.options.Demuxer {
+	case DemuxNative:
+		return true
+	case DemuxFFprobe:
+		return false
+	}
+	return mpegts.IsTransportStream(url)
+}
+
+// demuxTS reads the frames and PCR of a transport stream with the limits
+// ffprobe would apply for the same request.
+func (a *Analyzer) demuxTS(ctx context.Context, req ProbeRequest) (*mpegts.Result, error) {
+	limit, err := parseReadIntervals(req.ReadIntervals)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Fprintf(a.out, "Demuxing %s (streams %q, %s)\n", Redact(req.URL), req.Streams, req.ReadIntervals)
+
+	demuxer := mpegts.NewDemuxer(req.Streams, limit)
+	if err := mpegts.Demux(ctx, req.URL, demuxer, a.options.ConnectTimeout); err != nil {
+		return nil, fmt.Errorf("demux %s: %w", Redact(req.URL), err)
+	}
+
+	return demuxer.Result()
+}
+
+// parseReadIntervals understands the two forms readIntervals produces:
+// "%+#N" for N packets and "%+N" for N seconds.
+func parseReadIntervals(intervals string) (mpegts.Limit, error) {
+	if intervals == "" {
+		return mpegts.Limit{}, nil
+	}
+
+	if count, ok := strings.CutPrefix(intervals, "%+#"); ok {
+		frames, err := strconv.Atoi(count)
+		if err != nil {
+			return mpegts.Limit{}, fmt.Errorf("invalid read interval %q", intervals)
+		}
+		return mpegts.Limit{Frames: frames}, nil
+	}
+
+	if count, ok := strings.CutPrefix(intervals, "%+"); ok {
+		seconds, err := strconv.ParseFloat(count, 64)
+		if err != nil {
+			return mpegts.Limit{}, fmt.Errorf("invalid read interval %q", intervals)
+		}
+		return mpegts.Limit{Duration: seconds}, nil
+	}
+
+	return mpegts.Limit{}, fmt.Errorf("unsupported read interval %q", intervals)
+}
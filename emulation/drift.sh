@@ -1,5 +1,3 @@
 #!/bin/bash
-
-ffmpeg -stream_loop -1 -i av_sync_test.mp4 \
-       -af "atempo=1.05" \
-       -c:v libx264 -c:a aac -f mpegts udp://localhost:1234
+# Sound played 5% fast, as with atempo=1.05: it gets 1 - 1/1.05 seconds earlier every second
+cd "$(dirname "$0")/.." && exec go run . generate --duration 3600 --drift-ppm -47619 -o udp://localhost:1234 "$@"
@@ -1,2 +1,3 @@
 #!/bin/bash
-ffmpeg -re -stream_loop -1 -i av_sync_test.mp4  -c copy -bsf:v setts=pts=PTS+5/TB   -f mpegts udp://localhost:1234
+# The picture is stamped 5 seconds late: the sound comes 5 seconds early
+cd "$(dirname "$0")/.." && exec go run . generate --duration 3600 --offset -5 -o udp://localhost:1234 "$@"
@@ -1,21 +1,26 @@
 package main
 
 import (
-	"crypto/md5"
+	"context"
 	"encoding/csv"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"math"
 	"os"
-	"os/exec"
-	"path/filepath"
+	"os/signal"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
+	"find_desync/analysis"
+	"find_desync/mpegts"
+	"find_desync/probe"
+
 	"github.com/akamensky/argparse"
 	"github.com/fatih/color"
 	"github.com/gocarina/gocsv"
@@ -27,178 +32,365 @@ type Camera struct {
 	Uri       string `csv:"uri"`
 	Apartment string `csv:"apart"`
 }
-type Frame struct {
-	StreamIndex int    `json:"stream_index"`
-	PtsTime     string `json:"pts_time"`
-}
 
-type MediaData struct {
-	Frames []Frame `json:"frames"`
-}
-
-type PacketInfo struct {
-	number        int
-	pts_time      float64
-	duration_time float64
+// FrameRow is one row of the per-frame table printed by the track methods.
+type FrameRow struct {
+	Number        int     `json:"number"`
+	VideoPts      float64 `json:"video_pts"`
+	VideoDuration float64 `json:"video_duration"`
+	AudioPts      float64 `json:"audio_pts"`
+	AudioDuration float64 `json:"audio_duration"`
+	Diff          float64 `json:"diff"`
+	Residual      float64 `json:"residual,omitempty"`
 }
 
+// DiffInfo holds an offset measurement. CameraHash identifies the camera
+// without revealing its URI, Source is the URI with credentials masked.
 type DiffInfo struct {
-	ApartName  string
-	CameraHash string
-	Diff       float64
+	ApartName   string
+	CameraHash  string
+	Source      string
+	Diff        float64
+	VideoFrames int
+	AudioFrames int
+	Rows        []FrameRow
 }
 
+// DriftInfo holds a drift measurement: Diff is the fixed offset at the start
+// of the window, TotalDurDiff the drift accumulated over it and DurDiffRate
+// the drift in seconds per second of media.
 type DriftInfo struct {
 	ApartName     string
 	CameraHash    string
+	Source        string
 	Diff          float64
 	TotalDurDiff  float64
 	DurDiffRate   float64
 	VideoDuration float64
 	AudioDuration float64
+	VideoFrames   int
+	AudioFrames   int
+	Rows          []FrameRow
+	Estimate      analysis.DriftEstimate
+	Verdict       analysis.Verdict
+	// Discontinuities lists the timestamp jumps of both streams. Estimate
+	// and the durations cover the longest of the Segments between them.
+	Discontinuities []DiscontinuityInfo
+	Segments        []SegmentInfo
 }
 
-func NewDriftInfo(apartName, cameraHash string, diff float64) DriftInfo {
+func NewDriftInfo(apartName, uri string, diff float64) DriftInfo {
 	return DriftInfo{
 		ApartName:  apartName,
-		CameraHash: cameraHash,
+		CameraHash: CameraID(uri),
+		Source:     Redact(uri),
 		Diff:       diff,
 	}
 }
 
-func NewDiffInfo(apartName, cameraHash string, diff float64) DiffInfo {
+func NewDiffInfo(apartName, uri string, diff float64) DiffInfo {
 	return DiffInfo{
 		ApartName:  apartName,
-		CameraHash: cameraHash,
+		CameraHash: CameraID(uri),
+		Source:     Redact(uri),
 		Diff:       diff,
 	}
 }
 
+// driftResolution is the timestamp precision, in seconds, below which
+// offset and drift are treated as measurement noise.
+const driftResolution = 0.001
+
+const (
+	ProbeInterleaved = "interleaved"
+	ProbeSeparate    = "separate"
+)
+
+// Capture modes: how a source is saved before it is probed. Copy keeps the
+// packets and timestamps as the camera sent them, transcode re-encodes to
+// H.264 and mu-law, which may alter the timestamps being measured, and none
+// probes the source directly.
+const (
+	CaptureCopy      = "copy"
+	CaptureTranscode = "transcode"
+	CaptureNone      = "none"
+)
+
+var Captures = []string{CaptureCopy, CaptureTranscode, CaptureNone}
+
+type Options struct {
+	// ProbeMode is ProbeInterleaved to read audio and video in one ffprobe
+	// session, or ProbeSeparate to run one session per stream.
+	ProbeMode string
+	// Pairing selects how audio frames are matched to video frames.
+	Pairing analysis.Pairing
+	// MaxJump is the timestamp step, in frame durations, above which a
+	// stream is split into separately analyzed segments. 10 when zero.
+	MaxJump float64
+	// Capture is one of Captures, CaptureCopy when empty.
+	Capture string
+	// Demuxer is one of Demuxers, DemuxAuto when empty.
+	Demuxer string
+	// ConnectTimeout bounds the wait for data from a network source read
+	// by the built-in demuxer.
+	ConnectTimeout time.Duration
+	// Output receives the human readable progress and results, os.Stdout
+	// when nil.
+	Output io.Writer
+	// Timeout bounds the whole measurement of one camera, recording
+	// included. Zero means no limit.
+	Timeout time.Duration
+	// Retry is applied to every recording and probe.
+	Retry RetryPolicy
+	// Workspace holds the recordings of the non direct mode, a temporary
+	// one in os.TempDir() when nil.
+	Workspace *Workspace
+}
+
 type Analyzer struct {
+	runner  Runner
+	options Options
+	out     io.Writer
+
+	// mu guards the accumulated results, methods may run concurrently.
+	mu          sync.Mutex
 	apartDiffs  []DiffInfo
 	apartDrifts []DriftInfo
 }
 
-func NewAnalyzer() Analyzer {
-	return Analyzer{
-		apartDiffs: []DiffInfo{},
+func NewAnalyzer(runner Runner, options Options) Analyzer {
+	if options.ProbeMode == "" {
+		options.ProbeMode = ProbeInterleaved
 	}
-}
 
-func recordTempFile(url string, length int, align bool) string {
-	fmt.Printf("Generate temp file from %s \n", url)
-	now := time.Now().UnixNano() / 1000
-	microtimeStr := strconv.FormatInt(now, 10)
-	hash := md5.Sum([]byte(microtimeStr))
-	strLength := strconv.Itoa(length)
-	filename := filepath.Join("./temp", fmt.Sprintf("%x", hash)+".mkv")
-	fmt.Println(filename)
-	rtspOpt := ""
-	videoFilter := "null"
-	audioFilter := "asetnsamples=320"
+	if options.Pairing == "" {
+		options.Pairing = analysis.PairNearest
+	}
 
-	if align {
-		audioFilter = audioFilter + ",asetpts=PTS-STARTPTS"
-		videoFilter = "setpts=PTS-STARTPTS"
+	if options.MaxJump <= 0 {
+		options.MaxJump = defaultMaxJump
 	}
 
-	if strings.Contains(url, "rtsp") {
-		rtspOpt = "-rtsp_transport tcp "
+	if options.Capture == "" {
+		options.Capture = CaptureCopy
 	}
 
-	cmdLine := "ffmpeg " + rtspOpt + "-i " + url + "  -c:v libx264 -c:a pcm_mulaw -vf '" + videoFilter + "' -af '" + audioFilter + "' -t " + strLength + " " + filename
+	if options.Demuxer == "" {
+		options.Demuxer = DemuxAuto
+	}
 
-	fmt.Println(cmdLine)
+	if options.Output == nil {
+		options.Output = os.Stdout
+	}
 
-	cmd := exec.Command("sh", "-c", cmdLine)
+	if options.Retry.Attempts < 1 {
+		options.Retry.Attempts = 1
+	}
 
-	_, err := cmd.CombinedOutput()
+	if options.Workspace == nil {
+		options.Workspace = NewWorkspace("", false, 0)
+	}
 
-	if err != nil {
-		fmt.Printf("Error command : %v", err)
+	return Analyzer{
+		runner:     runner,
+		options:    options,
+		out:        options.Output,
+		apartDiffs: []DiffInfo{},
 	}
+}
 
-	return filename
+func (a *Analyzer) red(format string, args ...interface{}) {
+	a.colored(color.FgRed, format, args...)
 }
 
-func recordTempFileCopy(url string, length int) string {
-	fmt.Printf("Generate temp file from %s \n", url)
-	now := time.Now().UnixNano() / 1000
-	microtimeStr := strconv.FormatInt(now, 10)
-	hash := md5.Sum([]byte(microtimeStr))
-	strLength := strconv.Itoa(length)
-	filename := filepath.Join("./temp", fmt.Sprintf("%x", hash)+".mkv")
-	fmt.Println(filename)
-	rtspOpt := ""
+func (a *Analyzer) yellow(format string, args ...interface{}) {
+	a.colored(color.FgYellow, format, args...)
+}
+
+func (a *Analyzer) green(format string, args ...interface{}) {
+	a.colored(color.FgGreen, format, args...)
+}
 
-	if strings.Contains(url, "rtsp") {
-		rtspOpt = "-rtsp_transport tcp "
+func (a *Analyzer) colored(attr color.Attribute, format string, args ...interface{}) {
+	if !strings.HasSuffix(format, "\n") {
+		format += "\n"
 	}
+	color.New(attr).Fprintf(a.out, format, args...)
+}
 
-	cmdLine := "ffmpeg " + rtspOpt + "-i " + url + "  -c copy  -t " + strLength + " " + filename
+// recordTempFile records the source into the workspace. The caller must
+// hand the file back with a.options.Workspace.Release.
+func (a *Analyzer) recordTempFile(ctx context.Context, url string, length int, align bool) (string, error) {
+	fmt.Fprintf(a.out, "Generate temp file from %s (%s)\n", Redact(url), a.options.Capture)
 
-	fmt.Println(cmdLine)
+	filename, maxSize, err := a.options.Workspace.Create(cameraName(ctx, url), ".mkv", 0)
+	if err != nil {
+		fmt.Fprintf(a.out, "Error workspace : %v\n", err)
+		return "", err
+	}
+	fmt.Fprintln(a.out, filename)
+
+	err = a.retry(ctx, "Recording", func() error {
+		return a.runner.Record(ctx, RecordRequest{
+			URL:      url,
+			Filename: filename,
+			Length:   length,
+			Capture:  a.options.Capture,
+			Align:    align,
+			MaxSize:  maxSize,
+		})
+	})
 
-	cmd := exec.Command("sh", "-c", cmdLine)
+	if err != nil {
+		fmt.Fprintf(a.out, "Error command : %v\n", err)
+		a.options.Workspace.Discard(filename)
+		return "", err
+	}
+	a.options.Workspace.Settle(filename)
 
-	_, err := cmd.CombinedOutput()
+	return filename, nil
+}
+
+// probeFrames runs the probe through the Analyzer's runner and decodes the
+// frames it reports.
+func (a *Analyzer) probeFrames(ctx context.Context, req ProbeRequest) (*probe.Result, error) {
+	if a.nativeDemux(req.URL) {
+		result, err := a.demuxTS(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		return &result.Result, nil
+	}
+
+	var output []byte
+	err := a.retry(ctx, "Probe", func() error {
+		var err error
+		output, err = a.runner.Probe(ctx, req)
+		return err
+	})
 
 	if err != nil {
-		fmt.Printf("Error command : %v", err)
+		return nil, err
 	}
 
-	return filename
+	result, err := probe.Decode(output)
+	if err != nil {
+		return nil, err
+	}
+
+	// ffprobe corrects a single rollover at most, a long capture may hold more
+	if wraps := result.Unwrap(mpegts.TimestampBits, mpegts.ClockRate); wraps > 0 {
+		a.yellow("Unwrapped %d timestamp rollovers", wraps)
+	}
+
+	return result, nil
+}
+
+// readIntervals builds the ffprobe -read_intervals value for count seconds or
+// count packets per stream.
+func readIntervals(count int, useTime bool, streams int) string {
+	if useTime {
+		return "%+" + strconv.Itoa(count)
+	}
+	return "%+#" + strconv.Itoa(count*streams)
 }
 
-func fillTemplate(content string, params map[string]string) string {
+// ErrNoAudioStream is returned for sources without audio, which have
+// nothing to be out of sync with.
+var ErrNoAudioStream = errors.New("no audio stream")
 
-	var cmdTemplate string = ""
+// probeTracks reads the video and audio frames of the source. In interleaved
+// mode both streams come from one ffprobe session, so on a live source they
+// cover the same time window and keep their arrival order.
+func (a *Analyzer) probeTracks(ctx context.Context, url string, count int, useTime bool) ([]probe.Frame, []probe.Frame, error) {
+	if a.options.ProbeMode == ProbeSeparate {
+		intervals := readIntervals(count, useTime, 1)
 
-	lines := strings.Split(string(content), "\n")
-	linesWithoutComments := []string{}
-	for i := 0; i < len(lines); i++ {
-		if !strings.HasPrefix(lines[i], "#") {
-			linesWithoutComments = append(linesWithoutComments, lines[i])
+		audioResult, err := a.probeFrames(ctx, ProbeRequest{URL: url, Streams: "a", ReadIntervals: intervals})
+		if err != nil {
+			return nil, nil, fmt.Errorf("audio probe: %w", err)
 		}
+
+		if _, ok := audioResult.Stream(probe.Audio); !ok {
+			return nil, nil, ErrNoAudioStream
+		}
+
+		videoResult, err := a.probeFrames(ctx, ProbeRequest{URL: url, Streams: "v", ReadIntervals: intervals})
+		if err != nil {
+			return nil, nil, fmt.Errorf("video probe: %w", err)
+		}
+
+		return videoResult.Select(probe.Video), audioResult.Select(probe.Audio), nil
+	}
+
+	result, err := a.probeFrames(ctx, ProbeRequest{URL: url, ReadIntervals: readIntervals(count, useTime, 2)})
+	if err != nil {
+		return nil, nil, err
 	}
-	cmdTemplate = strings.Join(linesWithoutComments, "\n")
 
-	for k, v := range params {
-		cmdTemplate = strings.ReplaceAll(cmdTemplate, "{%"+k+"}", v)
+	if _, ok := result.Stream(probe.Audio); !ok {
+		return nil, nil, ErrNoAudioStream
 	}
 
-	return cmdTemplate
+	return result.Select(probe.Video), result.Select(probe.Audio), nil
+}
+
+// pairTracks matches audio frames to video frames by presentation time using
+// the configured pairing strategy.
+func (a *Analyzer) pairTracks(video, audio []probe.Frame) ([]analysis.Pair, error) {
+	return analysis.PairFrames(timestamps(video), timestamps(audio), a.options.Pairing)
+}
+
+func timestamps(frames []probe.Frame) []analysis.Timestamp {
+	result := make([]analysis.Timestamp, len(frames))
+	for i, f := range frames {
+		result[i] = analysis.Timestamp{Pts: f.PtsTime(), Duration: f.DurationTime()}
+	}
+	return result
 }
 
 func (a *Analyzer) Reset() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
 	a.apartDiffs = []DiffInfo{}
+	a.apartDrifts = []DriftInfo{}
 }
 
-func (a *Analyzer) StartTimeDiff(url string, apart string) {
-	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+func (a *Analyzer) addDiff(diffInfo DiffInfo) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
 
-	params := map[string]string{
-		"url": url,
-	}
+	a.apartDiffs = append(a.apartDiffs, diffInfo)
+}
 
-	cmdTemplate := `ffprobe -analyzeduration 10M -probesize 10M  {%url} 2>&1`
-	cmdLine := fillTemplate(cmdTemplate, params)
+func (a *Analyzer) addDrift(driftInfo DriftInfo) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
 
-	fmt.Printf("\n=== Analyzing Start Times for %s ===\n", apart)
-	fmt.Println("Command:")
-	fmt.Println(cmdLine)
+	a.apartDrifts = append(a.apartDrifts, driftInfo)
+}
 
-	cmd := exec.Command("sh", "-c", cmdLine)
-	output, err := cmd.CombinedOutput()
+func (a *Analyzer) StartTimeDiff(ctx context.Context, url string, apart string) (DiffInfo, error) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+
+	fmt.Fprintf(a.out, "\n=== Analyzing Start Times for %s ===\n", apart)
+
+	var output []byte
+	err := a.retry(ctx, "Probe", func() error {
+		var err error
+		output, err = a.runner.StartTimes(ctx, url)
+		return err
+	})
 
 	if err != nil {
 		logger.Error(fmt.Sprintf("Error running ffprobe: %v", err))
-		return
+		return DiffInfo{}, err
 	}
 
 	outputStr := string(output)
-	fmt.Println("\nFFprobe output:")
-	fmt.Println(outputStr)
+	fmt.Fprintln(a.out, "\nFFprobe output:")
+	fmt.Fprintln(a.out, Redact(outputStr))
 
 	// Parse video stream start time
 	videoStartRegex := regexp.MustCompile(`Stream #\d+:\d+.*Video.*start\s+([\d.]+)`)
@@ -210,611 +402,507 @@ func (a *Analyzer) StartTimeDiff(url string, apart string) {
 
 	if len(videoMatches) < 2 {
 		logger.Warn("Could not find video stream start time")
-		return
+		return DiffInfo{}, errors.New("could not find video stream start time")
 	}
 
 	if len(audioMatches) < 2 {
 		logger.Warn("Could not find audio stream start time")
-		return
+		return DiffInfo{}, errors.New("could not find audio stream start time")
 	}
 
 	videoStart, err := strconv.ParseFloat(videoMatches[1], 64)
 	if err != nil {
 		logger.Error(fmt.Sprintf("Error parsing video start time: %v", err))
-		return
+		return DiffInfo{}, err
 	}
 
 	audioStart, err := strconv.ParseFloat(audioMatches[1], 64)
 	if err != nil {
 		logger.Error(fmt.Sprintf("Error parsing audio start time: %v", err))
-		return
+		return DiffInfo{}, err
 	}
 
 	diff := videoStart - audioStart
 
-	fmt.Printf("\n=== START TIME ANALYSIS ===\n")
-	fmt.Printf("Video start time: %.6f seconds\n", videoStart)
-	fmt.Printf("Audio start time: %.6f seconds\n", audioStart)
-	fmt.Printf("Difference:       %.6f seconds\n", diff)
+	fmt.Fprintf(a.out, "\n=== START TIME ANALYSIS ===\n")
+	fmt.Fprintf(a.out, "Video start time: %.6f seconds\n", videoStart)
+	fmt.Fprintf(a.out, "Audio start time: %.6f seconds\n", audioStart)
+	fmt.Fprintf(a.out, "Difference:       %.6f seconds\n", diff)
 
 	diffInfo := NewDiffInfo(apart, url, diff)
-	a.apartDiffs = append(a.apartDiffs, diffInfo)
+	a.addDiff(diffInfo)
 
-	if math.Abs(diff) > 0.1 {
-		color.Red("\nSTART TIME MISMATCH: %.6f seconds", diff)
+	if math.Abs(diff) > startDiffThreshold {
+		a.red("\nSTART TIME MISMATCH: %.6f seconds", diff)
 	} else if math.Abs(diff) > 0.01 {
-		color.Yellow("\nSmall start time difference: %.6f seconds", diff)
+		a.yellow("\nSmall start time difference: %.6f seconds", diff)
 	} else {
-		color.Green("\nStart times are aligned")
+		a.green("\nStart times are aligned")
 	}
+
+	return diffInfo, nil
 }
 
-func (a *Analyzer) PTSDiffDrift(uri string, time int, apart string, direct bool, useTime bool, track string) {
+func (a *Analyzer) PTSDiffDrift(ctx context.Context, uri string, time int, apart string, direct bool, useTime bool) (DriftInfo, error) {
 	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
 
-	videoPackets := []PacketInfo{}
-	audioPackets := []PacketInfo{}
-
 	var sourceFile string
 
 	if !direct {
-		sourceFile = recordTempFile(uri, time, false)
+		var err error
+		sourceFile, err = a.recordTempFile(ctx, uri, time, false)
+		if err != nil {
+			return DriftInfo{}, err
+		}
+		defer a.options.Workspace.Release(sourceFile)
 	} else {
 		sourceFile = uri
 	}
 
-	readIntervals := "%+#" + strconv.Itoa(time)
-	if useTime {
-		readIntervals = "%+" + strconv.Itoa(time)
-	}
-
-	params := map[string]string{
-		"url":           sourceFile,
-		"readIntervals": readIntervals,
-		"track":         track,
-	}
-
-	var rtspOpt string = ""
-
-	if strings.Contains(uri, "rtsp") {
-		rtspOpt = "-rtsp_transport tcp "
-	}
-
-	cmdVideoLine := fillTemplate(`ffprobe `+rtspOpt+` -v quiet -analyzeduration 5M -probesize 5M  \
-	   -i "{%url}" -select_streams {%track}  -show_frames -of csv=p=0 -read_intervals "{%readIntervals}" 2>/dev/null`, params)
-
-	cmdAudioLine := fillTemplate(`ffprobe `+rtspOpt+` -v quiet -analyzeduration 5M -probesize 5M  \
-		-i "{%url}" -select_streams {%track}  -show_frames -of csv=p=0 -read_intervals "{%readIntervals}" 2>/dev/null`, params)
-
-	fmt.Println("Debug audio cmd:" + cmdAudioLine)
-	cmdAudio := exec.Command("sh", "-c", cmdAudioLine)
-	outputAudio, erra := cmdAudio.CombinedOutput()
+	videoPackets, audioPackets, err := a.probeTracks(ctx, sourceFile, time, useTime)
 
-	cmdVideo := exec.Command("sh", "-c", cmdVideoLine)
-	outputVideo, errv := cmdVideo.CombinedOutput()
-
-	if erra != nil {
-		logger.Error(fmt.Sprintf("Error audio command : %v", erra))
-		return
-	}
-
-	if errv != nil {
-		logger.Error(fmt.Sprintf("Error video command: %v", errv))
-		return
+	if err != nil {
+		logger.Error(fmt.Sprintf("Error probe command: %v", err))
+		return DriftInfo{}, err
 	}
 
-	r, _ := regexp.Compile(`(?m)^(?:[\w\.]+,){4}([^,]+),(?:[\w\.]+,){5}([^,]+)`)
+	videoCuts, discontinuities := a.findDiscontinuities(videoPackets)
+	audioCuts, audioDiscontinuities := a.findDiscontinuities(audioPackets)
+	discontinuities = append(discontinuities, audioDiscontinuities...)
 
-	videoMatches := r.FindAllStringSubmatch(string(outputVideo), -1)
-	audioMatches := r.FindAllStringSubmatch(string(outputAudio), -1)
+	fits := []segmentFit{}
+	pairCount := 0
 
-	for i, match := range videoMatches {
-		ptsTime, err := strconv.ParseFloat(match[1], 64)
-		if err != nil {
-			fmt.Println("Video. Cannot parse pts time")
-			continue
-		}
+	for _, segment := range a.splitSegments(videoPackets, audioPackets, videoCuts, audioCuts) {
+		fit, err := a.fitSegment(segment)
 
-		dur, err := strconv.ParseFloat(match[2], 64)
 		if err != nil {
-			fmt.Println("Video. Cannot parse duration")
-			continue
+			logger.Error(fmt.Sprintf("Error pairing frames: %v", err))
+			return DriftInfo{}, err
 		}
 
-		videoPackets = append(videoPackets, PacketInfo{
-			number:        i + 1,
-			pts_time:      ptsTime,
-			duration_time: dur,
-		})
+		pairCount += len(fit.pairs)
+		fits = append(fits, fit)
 	}
 
-	for i, match := range audioMatches {
-		ptsTime, err := strconv.ParseFloat(match[1], 64)
-		if err != nil {
-			continue
-		}
-
-		dur, err := strconv.ParseFloat(match[2], 64)
-		if err != nil {
-			continue
-		}
-
-		audioPackets = append(audioPackets, PacketInfo{
-			number:        i + 1,
-			pts_time:      ptsTime,
-			duration_time: dur,
-		})
+	if pairCount < len(videoPackets) {
+		a.yellow("%d video frames have no matching audio. Possible desync", len(videoPackets)-pairCount)
 	}
 
-	fullPackets := min(len(videoPackets), len(audioPackets))
+	fmt.Fprintf(a.out, "\n=== Stream: %s ===\n", Redact(uri))
+	fmt.Fprintf(a.out, "Analyzing %d packet pairs (%s pairing)\n", pairCount, a.options.Pairing)
 
-	if len(videoPackets) > len(audioPackets) {
-		color.Yellow("Not enough audio packets. Possible desync")
-	}
+	a.printDiscontinuities(discontinuities)
 
-	if len(videoPackets) < len(audioPackets) {
-		color.Yellow("Not enough video packets. Possible desync")
-	}
+	main := longestFit(fits)
 
-	if fullPackets < 2 {
-		color.Yellow("Not enough packets to calculate drift")
-		return
+	if main < 0 {
+		err := analysis.ErrNotEnoughSamples
+		if len(fits) > 0 {
+			err = fits[0].err
+		}
+		a.yellow("Not enough packets to calculate drift: %v", err)
+		return DriftInfo{}, err
 	}
 
-	fmt.Printf("\n=== Stream: %s ===\n", uri)
-	fmt.Printf("Analyzing %d packet pairs\n", fullPackets)
+	estimate := fits[main].estimate
 
-	// Calculate PTS differences for each packet pair
-	audioPtsDiffs := make([]float64, fullPackets)
-	audioPtsDiffs[0] = 0
-	for i := 1; i < fullPackets; i++ {
-		audioPtsDiffs[i] = audioPackets[i].pts_time - audioPackets[i-1].pts_time
-	}
-
-	// Display table with drift calculation
+	// Display table with the offset of every pair and its deviation from
+	// the fit of its segment
 	headerFmt := color.New(color.FgGreen, color.Underline).SprintfFunc()
 	columnFmt := color.New(color.FgYellow).SprintfFunc()
 
-	tbl := table.New("#", "Video PTS time", "Audio PTS time", "Diff", "Drift from prev")
-	tbl.WithHeaderFormatter(headerFmt).WithFirstColumnFormatter(columnFmt)
-
-	// Sample evenly across the packets
-	sampleCount := fullPackets
-	step := fullPackets / sampleCount
+	tbl := table.New("#", "Video PTS time", "Audio PTS time", "Diff", "Residual")
+	tbl.WithHeaderFormatter(headerFmt).WithFirstColumnFormatter(columnFmt).WithWriter(a.out)
 
-	var totalDrift float64
-	var avgDiff float64
-	firstDiff := audioPtsDiffs[0]
-	lastDiff := audioPtsDiffs[fullPackets-1]
+	driftInfo := NewDriftInfo(apart, uri, estimate.Intercept)
+	driftInfo.Discontinuities = discontinuities
 
-	for i := 0; i < sampleCount; i++ {
-		idx := i * step
-		if idx >= fullPackets {
-			break
-		}
+	for _, fit := range fits {
+		driftInfo.Segments = append(driftInfo.Segments, segmentInfo(fit))
 
-		drift := 0.0
-		if idx > 0 {
-			prevIdx := (i - 1) * step
-			drift = audioPtsDiffs[idx] - audioPtsDiffs[prevIdx]
-			totalDrift += drift
+		for i, sample := range fit.samples {
+			residual := 0.0
+			if fit.err == nil {
+				residual = sample.Offset - (fit.estimate.Intercept + fit.estimate.Slope*(sample.Time-fit.samples[0].Time))
+			}
+			video := fit.video[fit.pairs[i].Video]
+			audio := fit.audio[fit.pairs[i].Audio]
+
+			driftInfo.Rows = append(driftInfo.Rows, FrameRow{
+				Number:        video.Number,
+				VideoPts:      video.PtsTime(),
+				VideoDuration: video.DurationTime(),
+				AudioPts:      audio.PtsTime(),
+				AudioDuration: audio.DurationTime(),
+				Diff:          sample.Offset,
+				Residual:      residual,
+			})
+
+			tbl.AddRow(
+				video.Number,
+				fmt.Sprintf("%.3f", video.PtsTime()),
+				fmt.Sprintf("%.3f", audio.PtsTime()),
+				fmt.Sprintf("%.3f", sample.Offset),
+				fmt.Sprintf("%.4f", residual),
+			)
 		}
+	}
 
-		avgDiff += audioPtsDiffs[idx]
+	tbl.Print()
 
-		tbl.AddRow(
-			audioPackets[idx].number,
-			fmt.Sprintf("%.3f", videoPackets[idx].pts_time),
-			fmt.Sprintf("%.3f", audioPackets[idx].pts_time),
-			fmt.Sprintf("%.3f", audioPtsDiffs[idx]),
-			fmt.Sprintf("%.4f", drift),
-		)
+	if len(fits) > 1 {
+		fmt.Fprintln(a.out)
+		a.printSegments(driftInfo.Segments, main)
 	}
 
-	tbl.Print()
+	verdict := estimate.Classify(driftResolution)
 
-	avgDiff /= float64(sampleCount)
-	totalDriftChange := lastDiff - firstDiff
-	driftRate := totalDriftChange / float64(fullPackets-1)
+	fmt.Fprintf(a.out, "\n=== ANALYSIS ===\n")
+	fmt.Fprintf(a.out, "Pairs:               %d over %.3f seconds\n", estimate.Samples, estimate.Span)
+	fmt.Fprintf(a.out, "Fixed offset:        %.3f seconds (95%% CI %.3f .. %.3f)\n", estimate.Intercept, estimate.InterceptLow, estimate.InterceptHigh)
+	fmt.Fprintf(a.out, "Drift rate:          %.1f ppm, %.1f ms/hour\n", estimate.PPM(), estimate.MsPerHour())
+	fmt.Fprintf(a.out, "Drift rate 95%% CI:   %.1f .. %.1f ppm\n", estimate.SlopeLow*1e6, estimate.SlopeHigh*1e6)
+	fmt.Fprintf(a.out, "Total drift change:  %.3f seconds\n", estimate.TotalDrift())
+	fmt.Fprintf(a.out, "R²:                  %.3f\n", estimate.R2)
+	fmt.Fprintf(a.out, "Jitter (residual):   %.4f seconds\n", estimate.Residual)
 
-	fmt.Printf("\n=== ANALYSIS ===\n")
-	fmt.Printf("First PTS diff:      %.3f seconds\n", firstDiff)
-	fmt.Printf("Last PTS diff:       %.3f seconds\n", lastDiff)
-	fmt.Printf("Average PTS diff:    %.3f seconds\n", avgDiff)
-	fmt.Printf("Total drift change:  %.3f seconds\n", totalDriftChange)
-	fmt.Printf("Drift per packet:    %.6f seconds\n", driftRate)
+	driftInfo.TotalDurDiff = estimate.TotalDrift()
+	driftInfo.DurDiffRate = estimate.Slope
+	driftInfo.VideoDuration = duration(fits[main].video)
+	driftInfo.AudioDuration = duration(fits[main].audio)
+	driftInfo.VideoFrames = len(videoPackets)
+	driftInfo.AudioFrames = len(audioPackets)
+	driftInfo.Estimate = estimate
+	driftInfo.Verdict = verdict
 
-	driftInfo := DiffInfo{
-		ApartName:  apart,
-		CameraHash: uri,
-		Diff:       totalDriftChange,
+	a.addDrift(driftInfo)
+
+	switch verdict {
+	case analysis.ProgressiveDrift:
+		a.red(" DRIFT DETECTED: %.3f seconds change over %d packets (%.1f ms/hour)", estimate.TotalDrift(), estimate.Samples, estimate.MsPerHour())
+	case analysis.FixedOffset:
+		a.yellow("\nFIXED OFFSET: %.3f seconds (no drift)", estimate.Intercept)
+	default:
+		a.green("\nStreams are in sync")
 	}
 
-	a.apartDiffs = append(a.apartDiffs, driftInfo)
+	return driftInfo, nil
+}
 
-	if math.Abs(totalDriftChange) > 0.1 {
-		color.Red(" DRIFT DETECTED: %.3f seconds change over %d packets", totalDriftChange, fullPackets)
-	} else if math.Abs(avgDiff) > 0.5 {
-		color.Yellow("\nFIXED OFFSET: %.3f seconds (no drift)", avgDiff)
-	} else {
-		color.Green("\nStreams are in sync")
+// duration is the PTS span of frames, zero when there are none.
+func duration(frames []probe.Frame) float64 {
+	if len(frames) == 0 {
+		return 0
 	}
-
-	os.Remove(sourceFile)
+	return frames[len(frames)-1].PtsTime() - frames[0].PtsTime()
 }
 
 func (a *Analyzer) CheckPTSDiffDrift() {
-	for _, item := range a.apartDiffs {
-		fmt.Printf("\nCamera: %s\n", item.ApartName)
-		fmt.Printf("  Total PTS diff drift: %.3f seconds\n", item.Diff)
-
-		if math.Abs(item.Diff) > 1 {
-			color.Red("DRIFT DETECTED")
-		} else {
-			color.Green("No significant drift")
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, item := range a.apartDrifts {
+		fmt.Fprintf(a.out, "\nCamera: %s %s\n", item.ApartName, item.Source)
+		fmt.Fprintf(a.out, "  Fixed offset: %.3f seconds\n", item.Diff)
+		fmt.Fprintf(a.out, "  Drift rate:   %.1f ppm (%.1f ms/hour), R² %.3f\n", item.Estimate.PPM(), item.Estimate.MsPerHour(), item.Estimate.R2)
+
+		switch item.Verdict {
+		case analysis.ProgressiveDrift:
+			a.red("DRIFT DETECTED")
+		case analysis.FixedOffset:
+			a.yellow("FIXED OFFSET")
+		default:
+			a.green("No significant drift")
 		}
 	}
 }
 
-func (a *Analyzer) TracksDiff(uri string, time int, apart string, direct bool, useTime bool) {
+func (a *Analyzer) TracksDiff(ctx context.Context, uri string, time int, apart string, direct bool, useTime bool) (DiffInfo, error) {
 
 	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
 
-	videoPackets := []PacketInfo{}
-	audioPackets := []PacketInfo{}
-
 	var sourceFile string
 
 	if !direct {
-		sourceFile = recordTempFile(uri, time, false)
+		var err error
+		sourceFile, err = a.recordTempFile(ctx, uri, time, false)
+		if err != nil {
+			return DiffInfo{}, err
+		}
+		defer a.options.Workspace.Release(sourceFile)
 	} else {
 		sourceFile = uri
 	}
 
-	readIntervals := "%+#" + strconv.Itoa(time)
-	if useTime {
-		readIntervals = "%+" + strconv.Itoa(time)
-	}
-
-	params := map[string]string{
-		"url":           sourceFile,
-		"readIntervals": readIntervals,
-	}
-
-	var rtspOpt string = ""
+	videoPackets, audioPackets, err := a.probeTracks(ctx, sourceFile, time, useTime)
 
-	if strings.Contains(uri, "rtsp") {
-		rtspOpt = "-rtsp_transport tcp "
-	}
-
-	cmdVideoLine := fillTemplate(`ffprobe  `+rtspOpt+` -v quiet -analyzeduration 5M -probesize 5M  -i "{%url}" -select_streams v -show_frames -of csv=p=0 -read_intervals "{%readIntervals}" 2>/dev/null`, params)
-
-	cmdAudioLine := fillTemplate(`ffprobe `+rtspOpt+` -v quiet -analyzeduration 5M -probesize 5M  -i "{%url}" -select_streams a -show_frames -of csv=p=0 -read_intervals "{%readIntervals}" 2>/dev/null`, params)
-
-	fmt.Println("Video command:")
-	fmt.Println(cmdVideoLine)
-
-	fmt.Println("Audio command:")
-	fmt.Println(cmdAudioLine)
-
-	cmdAudio := exec.Command("sh", "-c", cmdAudioLine)
-	outputAudio, erra := cmdAudio.CombinedOutput()
-
-	cmdVideo := exec.Command("sh", "-c", cmdVideoLine)
-	outputVideo, errv := cmdVideo.CombinedOutput()
-
-	if erra != nil {
-		logger.Error(fmt.Sprintf("Error audio command : %v", erra))
-		logger.Error(fmt.Sprintf("Audio packets: %s", string(outputAudio)))
-	}
-
-	if errv != nil {
-		logger.Error(fmt.Sprintf("Error video command: %v", errv))
-		logger.Error(fmt.Sprintf("Video : %s", string(outputVideo)))
-	}
-
-	r, _ := regexp.Compile(`(?m)^(?:[\w\.]+,){4}([^,]+),(?:[\w\.]+,){5}([^,]+)`)
-
-	videoMatches := r.FindAllStringSubmatch(string(outputVideo), -1)
-	audioMatches := r.FindAllStringSubmatch(string(outputAudio), -1)
-	fmt.Printf("Found %d video packets and %d audio packets\n", len(videoMatches), len(audioMatches))
-	for i, match := range videoMatches {
-		ptsTime, err := strconv.ParseFloat(match[1], 64)
-		if err != nil {
-			fmt.Printf("Cannot parse pts_time: %v", err)
-			continue
-		}
-
-		dur, err := strconv.ParseFloat(match[2], 64)
-		if err != nil {
-			fmt.Printf("Cannot parse duration: %v", err)
-			continue
-		}
-
-		videoPackets = append(videoPackets, PacketInfo{
-			number:        i + 1,
-			pts_time:      ptsTime,
-			duration_time: dur,
-		})
+	if err != nil {
+		logger.Error(fmt.Sprintf("Error probe command: %v", err))
+		return DiffInfo{}, err
 	}
 
-	for i, match := range audioMatches {
-		ptsTime, err := strconv.ParseFloat(match[1], 64)
-		if err != nil {
-			fmt.Printf("Cannot parse pts_time: %v", err)
-			continue
-		}
-
-		dur, err := strconv.ParseFloat(match[2], 64)
-		if err != nil {
-			fmt.Printf("Cannot parse duration: %v", err)
-			continue
-		}
-
-		audioPackets = append(audioPackets, PacketInfo{
-			number:        i + 1,
-			pts_time:      ptsTime,
-			duration_time: dur,
-		})
-	}
+	fmt.Fprintf(a.out, "Found %d video packets and %d audio packets\n", len(videoPackets), len(audioPackets))
 
 	headerFmt := color.New(color.FgGreen, color.Underline).SprintfFunc()
 	columnFmt := color.New(color.FgYellow).SprintfFunc()
 
 	tbl := table.New("#", "Video PTS time", "Video duration", "Audio PTS time", "Audio duration", "diff")
-	tbl.WithHeaderFormatter(headerFmt).WithFirstColumnFormatter(columnFmt)
+	tbl.WithHeaderFormatter(headerFmt).WithFirstColumnFormatter(columnFmt).WithWriter(a.out)
 
-	fullPackets := min(len(videoPackets), len(audioPackets))
+	pairs, err := a.pairTracks(videoPackets, audioPackets)
+
+	if err != nil {
+		logger.Error(fmt.Sprintf("Error pairing frames: %v", err))
+		return DiffInfo{}, err
+	}
 
 	diffInfo := NewDiffInfo(apart, uri, 0)
+	diffInfo.VideoFrames = len(videoPackets)
+	diffInfo.AudioFrames = len(audioPackets)
 
-	for i := 0; i < fullPackets; i++ {
-		diff := math.Abs(videoPackets[i].pts_time - audioPackets[i].pts_time)
+	for _, pair := range pairs {
+		video := videoPackets[pair.Video]
+		audio := audioPackets[pair.Audio]
+		diff := math.Abs(pair.Offset)
 		diffInfo.Diff += diff
-		tbl.AddRow(videoPackets[i].number, videoPackets[i].pts_time, videoPackets[i].duration_time,
-			audioPackets[i].pts_time, audioPackets[i].duration_time, diff)
+		diffInfo.Rows = append(diffInfo.Rows, FrameRow{
+			Number:        video.Number,
+			VideoPts:      video.PtsTime(),
+			VideoDuration: video.DurationTime(),
+			AudioPts:      audio.PtsTime(),
+			AudioDuration: audio.DurationTime(),
+			Diff:          diff,
+		})
+		tbl.AddRow(video.Number, video.PtsTime(), video.DurationTime(),
+			audio.PtsTime(), audio.DurationTime(), diff)
 	}
 
-	diffInfo.Diff /= float64(fullPackets)
+	if len(pairs) > 0 {
+		diffInfo.Diff /= float64(len(pairs))
+	}
 
-	a.apartDiffs = append(a.apartDiffs, diffInfo)
+	a.addDiff(diffInfo)
 
 	tbl.Print()
 
-	defer os.Remove(sourceFile)
-
+	return diffInfo, nil
 }
 
-func (a *Analyzer) TracksDrift(uri string, time int, apart string, direct bool, useTime bool) {
-
-	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
-
-	videoPackets := []PacketInfo{}
-	audioPackets := []PacketInfo{}
-
-	var sourceFile string
+// SimpleDiff compares the first video and audio frames. The returned Diff is
+// the absolute difference of their PTS.
+func (a *Analyzer) SimpleDiff(ctx context.Context, url string, time int, apart string, direct bool) (DiffInfo, error) {
 
+	sourceFile := url
 	if !direct {
-		sourceFile = recordTempFile(uri, time, false)
-	} else {
-		sourceFile = uri
-	}
-
-	readIntervals := "%+#" + strconv.Itoa(time)
-	if useTime {
-		readIntervals = "%+" + strconv.Itoa(time)
-	}
-
-	params := map[string]string{
-		"url":           sourceFile,
-		"readIntervals": readIntervals,
+		var err error
+		sourceFile, err = a.recordTempFile(ctx, url, time, true)
+		if err != nil {
+			return DiffInfo{}, err
+		}
+		defer a.options.Workspace.Release(sourceFile)
 	}
 
-	cmdVideoLine := fillTemplate(`ffprobe -v quiet -analyzeduration 5M -probesize 5M  -i "{%url}" -select_streams v 
-		 -show_frames -of csv=p=0 -read_intervals "{%readIntervals}" 2>/dev/null`, params)
-
-	cmdAudioLine := fillTemplate(`ffprobe -v quiet -analyzeduration 5M -probesize 5M  -i "{%url}" -select_streams a 
-	     -show_frames -of csv=p=0 -read_intervals "{%readIntervals}" 2>/dev/null`, params)
-
-	fmt.Println("Video command:")
-	fmt.Println(cmdVideoLine)
-
-	fmt.Println("Audio command:")
-	fmt.Println(cmdAudioLine)
-
-	cmdAudio := exec.Command("sh", "-c", cmdAudioLine)
-	outputAudio, erra := cmdAudio.CombinedOutput()
-
-	cmdVideo := exec.Command("sh", "-c", cmdVideoLine)
-	outputVideo, errv := cmdVideo.CombinedOutput()
+	aData, erra := a.probeFrames(ctx, ProbeRequest{URL: sourceFile, Streams: "a:0", ReadIntervals: "%+1"})
+	vData, errv := a.probeFrames(ctx, ProbeRequest{URL: sourceFile, Streams: "v:0", ReadIntervals: "%+1"})
 
 	if erra != nil {
-		logger.Error(fmt.Sprintf("Error audio command : %v", erra))
-		logger.Error(fmt.Sprintf("Audio packets: %s", string(outputAudio)))
+		fmt.Fprintf(a.out, "Error audio command : %v", erra)
+		return DiffInfo{}, erra
 	}
 
 	if errv != nil {
-		logger.Error(fmt.Sprintf("Error video command: %v", errv))
-		logger.Error(fmt.Sprintf("Video : %s", string(outputVideo)))
-	}
-
-	r, _ := regexp.Compile(`(?m)^(?:[\w\.]+,){4}([^,]+),(?:[\w\.]+,){5}([^,]+)`)
-
-	videoMatches := r.FindAllStringSubmatch(string(outputVideo), -1)
-	audioMatches := r.FindAllStringSubmatch(string(outputAudio), -1)
-	fmt.Printf("Found %d video packets and %d audio packets\n", len(videoMatches), len(audioMatches))
-	for i, match := range videoMatches {
-		ptsTime, err := strconv.ParseFloat(match[1], 64)
-		if err != nil {
-			fmt.Printf("Cannot parse pts_time: %v", err)
-			continue
-		}
-
-		dur, err := strconv.ParseFloat(match[2], 64)
-		if err != nil {
-			fmt.Printf("Cannot parse duration: %v", err)
-			continue
-		}
-
-		videoPackets = append(videoPackets, PacketInfo{
-			number:        i + 1,
-			pts_time:      ptsTime,
-			duration_time: dur,
-		})
+		fmt.Fprintf(a.out, "Error video command: %v", errv)
+		return DiffInfo{}, errv
 	}
 
-	for i, match := range audioMatches {
-		ptsTime, err := strconv.ParseFloat(match[1], 64)
-		if err != nil {
-			fmt.Printf("Cannot parse pts_time: %v", err)
-			continue
-		}
-
-		dur, err := strconv.ParseFloat(match[2], 64)
-		if err != nil {
-			fmt.Printf("Cannot parse duration: %v", err)
-			continue
-		}
-
-		audioPackets = append(audioPackets, PacketInfo{
-			number:        i + 1,
-			pts_time:      ptsTime,
-			duration_time: dur,
-		})
+	if len(vData.Frames) == 0 || len(aData.Frames) == 0 {
+		return DiffInfo{}, errors.New("no audio or video frames")
 	}
 
-	headerFmt := color.New(color.FgGreen, color.Underline).SprintfFunc()
-	columnFmt := color.New(color.FgYellow).SprintfFunc()
+	videoFirstPts := vData.Frames[0].PtsTime()
+	audioFirstPts := aData.Frames[0].PtsTime()
 
-	tbl := table.New("#", "Video PTS time", "Video duration", "Audio PTS time", "Audio duration", "diff")
-	tbl.WithHeaderFormatter(headerFmt).WithFirstColumnFormatter(columnFmt)
+	fmt.Fprintf(a.out, "First video packet: %.2f \n", videoFirstPts)
+	fmt.Fprintf(a.out, "First audio packet: %.2f \n", audioFirstPts)
 
-	fmt.Printf("Video packets: %d \t", len(videoPackets))
-	fmt.Printf("Audio packets: %d \n", len(videoPackets))
+	diffInfo := NewDiffInfo(apart, url, math.Abs(videoFirstPts-audioFirstPts))
+	diffInfo.VideoFrames = len(vData.Frames)
+	diffInfo.AudioFrames = len(aData.Frames)
 
-	fullPackets := min(len(videoPackets), len(audioPackets))
+	return diffInfo, nil
+}
 
-	diffInfo := NewDiffInfo(apart, uri, 0)
+func (a *Analyzer) CheckTrackDesync() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
 
-	for i := 0; i < fullPackets; i++ {
-		diff := math.Abs(videoPackets[i].pts_time - audioPackets[i].pts_time)
-		diffInfo.Diff += diff
-		tbl.AddRow(videoPackets[i].number, videoPackets[i].pts_time, videoPackets[i].duration_time,
-			audioPackets[i].pts_time, audioPackets[i].duration_time, diff)
+	for _, item := range a.apartDiffs {
+		if item.Diff > desyncThreshold {
+			fmt.Fprintln(a.out, "Desyncronization spotted in "+item.ApartName+" "+item.Source)
+			fmt.Fprintf(a.out, "Average desync: %.2f \n", item.Diff)
+		} else {
+			fmt.Fprintln(a.out, item.Source+" should be in sync ")
+		}
 	}
-
-	diffInfo.Diff /= float64(fullPackets)
-
-	a.apartDiffs = append(a.apartDiffs, diffInfo)
-
-	tbl.Print()
-
-	defer os.Remove(sourceFile)
-
 }
 
-func (a *Analyzer) SimpleDiff(url string, time int, apart string, direct bool) bool {
+// cliFlags are the flags shared by the one-shot run and the monitor command.
+type cliFlags struct {
+	file           *string
+	csvFile        *string
+	packets        *int
+	time           *int
+	method         *string
+	direct         *int
+	pairing        *string
+	probeMode      *string
+	maxJump        *float64
+	concurrency    *int
+	connectTimeout *int
+	timeout        *int
+	retries        *int
+	retryBackoff   *float64
+	capture        *string
+	demuxer        *string
+	workspace      *string
+	keep           *bool
+	quota          *int
+}
 
-	var params map[string]string
-	if !direct {
-		sourceFile := recordTempFile(url, time, true)
+func addCommonFlags(parser *argparse.Parser) *cliFlags {
+	flags := &cliFlags{}
+
+	flags.file = parser.String("f", "file", &argparse.Options{Required: false, Help: "File/stream to analyze"})
+	flags.csvFile = parser.String("c", "csv", &argparse.Options{Required: false, Help: "Annotated CSV file with name,uri,apart columns"})
+	flags.packets = parser.Int("p", "packets", &argparse.Options{Required: false, Help: "Number of packets  to analyze. Mutually exclusive with -t"})
+	flags.time = parser.Int("t", "time", &argparse.Options{Required: false, Help: "Time of the input to analyze.  Mutually exclusive with -p"})
+	flags.method = parser.String("m", "method", &argparse.Options{Required: false, Help: "Method to analyze: trackdiff, drift, trackdrift, firstpackets, startdiff, pcr, gaps, contentsync, testpattern", Default: MethodStartDiff})
+	// -s used to pick the stream for the drift method; drift now always compares audio against video,
+	// the flag is kept so existing invocations still parse.
+	_ = parser.String("s", "string", &argparse.Options{Required: false, Help: "Unused, kept for compatibility", Default: "a"})
+	flags.direct = parser.Int("d", "direct", &argparse.Options{Required: true, Help: "Analyze directly source, or analyze saved slice of the source. 1 is the same as --capture none", Default: 0})
+	flags.demuxer = parser.Selector("", "demuxer", Demuxers, &argparse.Options{Required: false, Help: "Read timestamps with the built-in MPEG-TS demuxer (native), with ffprobe, or native for .ts files and udp:// only (auto)", Default: DemuxAuto})
+	flags.capture = parser.Selector("", "capture", Captures, &argparse.Options{Required: false, Help: "Save the source by stream copy (copy), re-encoding (transcode), or probe it directly (none)", Default: CaptureCopy})
+	flags.pairing = parser.Selector("", "pairing", analysis.Pairings, &argparse.Options{Required: false, Help: "Match audio to video frames by nearest PTS, by the audio frame covering the video PTS, or by index", Default: string(analysis.PairNearest)})
+	flags.maxJump = parser.Float("", "max-jump", &argparse.Options{Required: false, Help: "Frame durations a timestamp may jump forward before the drift analysis is split into segments", Default: float64(defaultMaxJump)})
+	flags.concurrency = parser.Int("", "concurrency", &argparse.Options{Required: false, Help: "Number of cameras analyzed in parallel", Default: 1})
+	flags.probeMode = parser.Selector("", "probe-mode", []string{ProbeInterleaved, ProbeSeparate}, &argparse.Options{Required: false, Help: "Read audio and video in one ffprobe session (interleaved) or one session per stream (separate)", Default: ProbeInterleaved})
+	flags.connectTimeout = parser.Int("", "connect-timeout", &argparse.Options{Required: false, Help: "Seconds to wait for a network source to connect or send data, 0 for the ffmpeg default", Default: 10})
+	flags.timeout = parser.Int("", "timeout", &argparse.Options{Required: false, Help: "Seconds allowed for the whole analysis of one camera, 0 for no limit", Default: 0})
+	flags.retries = parser.Int("", "retries", &argparse.Options{Required: false, Help: "Times a recording or probe failing with a transient error (connection refused, 503, timeout) is retried", Default: 2})
+	flags.retryBackoff = parser.Float("", "retry-backoff", &argparse.Options{Required: false, Help: "Seconds to wait before the first retry, doubled for each next one", Default: 1.0})
+	flags.workspace = parser.String("", "workspace", &argparse.Options{Required: false, Help: "Directory the sources are recorded into, the system temp directory by default"})
+	flags.keep = parser.Flag("", "keep-recordings", &argparse.Options{Required: false, Help: "Keep the recordings, named after the camera and the time, instead of removing them"})
+	flags.quota = parser.Int("", "workspace-quota", &argparse.Options{Required: false, Help: "Megabytes the recordings may use in the workspace, 0 for no limit", Default: 2048})
+
+	return flags
+}
 
-		params = map[string]string{
-			"url":  sourceFile,
-			"time": strconv.Itoa(time),
-		}
-	} else {
-		params = map[string]string{
-			"url":  url,
-			"time": strconv.Itoa(time),
-		}
+func (f *cliFlags) runParams() (RunParams, error) {
+	if *f.time == 0 && *f.packets == 0 {
+		return RunParams{}, errors.New("specify either time or packets")
 	}
 
-	cmdVideoTemplate := `ffprobe -v quiet -show_entries frame=stream_index,pts_time -select_streams v:0 -read_intervals "%+1" -of json -i {%url}`
-	cmdAudioTemplate := `ffprobe -v quiet -show_entries frame=stream_index,pts_time -select_streams a:0 -read_intervals "%+1" -of json -i {%url}`
-
-	cmdVideoLine := fillTemplate(cmdVideoTemplate, params)
-	cmdAudioLine := fillTemplate(cmdAudioTemplate, params)
-
-	fmt.Println("Video command:")
-	fmt.Println(cmdVideoLine)
+	params := RunParams{
+		Count:  *f.packets,
+		Direct: *f.direct == 1 || *f.capture == CaptureNone,
+	}
 
-	fmt.Println("Audio command:")
-	fmt.Println(cmdAudioLine)
+	if *f.time != 0 {
+		params.UseTime = true
+		params.Count = *f.time
+	}
 
-	cmdAudio := exec.Command("sh", "-c", cmdAudioLine)
-	outputAudio, erra := cmdAudio.CombinedOutput()
+	return params, nil
+}
 
-	cmdVideo := exec.Command("sh", "-c", cmdVideoLine)
-	outputVideo, errv := cmdVideo.CombinedOutput()
+func (f *cliFlags) loadCameras() ([]*Camera, error) {
+	cameras := []*Camera{}
 
-	if erra != nil {
-		fmt.Printf("Error audio command : %v", erra)
-		fmt.Printf("Audio packets: %s", string(outputAudio))
+	if *f.csvFile == "" {
+		RegisterCredentials(*f.file)
+		return append(cameras, &Camera{Redact(*f.file), *f.file, ""}), nil
 	}
 
-	if errv != nil {
-		fmt.Printf("Error video command: %v", errv)
-		fmt.Printf("Video : %s", string(outputVideo))
+	fileHandle, err := os.Open(*f.csvFile)
+
+	if err != nil {
+		return nil, err
 	}
 
-	var vData MediaData
-	var aData MediaData
-	videoFirstPts := math.Inf(-1)
-	audioFirstPts := math.Inf(-1)
+	defer fileHandle.Close()
 
-	json.Unmarshal(outputVideo, &vData)
-	json.Unmarshal(outputAudio, &aData)
+	gocsv.SetCSVReader(func(in io.Reader) gocsv.CSVReader {
 
-	var err error
+		return gocsv.LazyCSVReader(in)
+	})
 
-	if len(vData.Frames) > 0 {
-		videoFirstPts, err = strconv.ParseFloat(vData.Frames[0].PtsTime, 64)
+	errHandler := func(err *csv.ParseError) bool {
+		fmt.Fprintln(os.Stderr, Redact(err.Error()))
+		return true
 	}
 
-	if err != nil {
-		panic(err)
+	if err := gocsv.UnmarshalFileWithErrorHandler(fileHandle, errHandler, &cameras); err != nil {
+		return nil, err
 	}
 
-	if len(vData.Frames) > 0 {
-		audioFirstPts, err = strconv.ParseFloat(aData.Frames[0].PtsTime, 64)
+	for _, camera := range cameras {
+		RegisterCredentials(camera.Uri)
 	}
 
-	if err != nil {
-		panic(err)
+	return cameras, nil
+}
+
+func (f *cliFlags) options(output io.Writer) Options {
+	return Options{
+		ProbeMode: *f.probeMode,
+		Pairing:   analysis.Pairing(*f.pairing),
+		MaxJump:   *f.maxJump,
+		Capture:   *f.capture,
+		Demuxer:   *f.demuxer,
+		Output:    output,
+		Timeout:   time.Duration(*f.timeout) * time.Second,
+		Retry: RetryPolicy{
+			Attempts:   *f.retries + 1,
+			Backoff:    time.Duration(*f.retryBackoff * float64(time.Second)),
+			MaxBackoff: 30 * time.Second,
+			Jitter:     0.2,
+		},
+		Workspace: NewWorkspace(*f.workspace, *f.keep, int64(*f.quota)<<20),
+
+		ConnectTimeout: time.Duration(*f.connectTimeout) * time.Second,
 	}
+}
 
-	fmt.Printf("First video packet: %.2f \n", videoFirstPts)
-	fmt.Printf("First audio packet: %.2f \n", audioFirstPts)
+func (f *cliFlags) newAnalyzer(output io.Writer) Analyzer {
+	options := f.options(output)
+	return NewAnalyzer(FFmpegRunner{Out: output, ConnectTimeout: options.ConnectTimeout}, options)
+}
 
-	return math.Abs(videoFirstPts-audioFirstPts) <= 1
+func main() {
 
-}
+	if len(os.Args) > 1 && os.Args[1] == "monitor" {
+		monitorMain(os.Args[1:])
+		return
+	}
 
-func (a *Analyzer) CheckTrackDesync() {
-	for _, item := range a.apartDiffs {
-		if item.Diff > 0.5 {
-			fmt.Println("Desyncronization spotted in " + item.ApartName + " " + item.CameraHash)
-			fmt.Printf("Average desync: %.2f \n", item.Diff)
-		} else {
-			fmt.Println(item.CameraHash + " should be in sync ")
-		}
+	if len(os.Args) > 1 && os.Args[1] == "generate" {
+		generateMain(os.Args[1:])
+		return
 	}
-}
 
-func main() {
+	if len(os.Args) > 1 && os.Args[1] == "selftest" {
+		selftestMain(os.Args[1:])
+		return
+	}
 
 	parser := argparse.NewParser("find_desync", "An attempt to programmatically detect audio/video desynchronization")
 
-	cameras := []*Camera{}
-
-	file := parser.String("f", "file", &argparse.Options{Required: false, Help: "File/stream to analyze"})
-	csvFile := parser.String("c", "csv", &argparse.Options{Required: false, Help: "File/stream to analyze"})
-	packets := parser.Int("p", "packets", &argparse.Options{Required: false, Help: "Number of packets  to analyze. Mutually exclusive with -t"})
-	time := parser.Int("t", "time", &argparse.Options{Required: false, Help: "Time of the input to analyze.  Mutually exclusive with -p"})
-	method := parser.String("m", "method", &argparse.Options{Required: false, Help: "Method to analyze: trackdiff, drift, firstpackets, startdiff", Default: "startdiff"})
-	stream := parser.String("s", "string", &argparse.Options{Required: true, Help: "Stream to analyze ( for `drift` method ),'a','v','0:v','0:a'", Default: "a"})
-	rawSubject := parser.Int("d", "direct", &argparse.Options{Required: true, Help: "Analyze directly source, or analyze saved slice of the source", Default: 0})
+	flags := addCommonFlags(parser)
+	output := parser.Selector("o", "output", []string{OutputText, OutputJSON}, &argparse.Options{Required: false, Help: "Result format: human readable text or a JSON report", Default: OutputText})
+	resultsCSV := parser.String("", "results-csv", &argparse.Options{Required: false, Help: "Write one result row per camera to this CSV file"})
+	junitFile := parser.String("", "junit", &argparse.Options{Required: false, Help: "Write a JUnit XML report, one test case per camera, to this file"})
 
 	err := parser.Parse(os.Args)
 
@@ -823,70 +911,75 @@ func main() {
 		return
 	}
 
-	if time == nil && packets == nil {
-		fmt.Errorf("specify either time or packets")
+	params, err := flags.runParams()
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, Redact(err.Error()))
 		return
 	}
 
-	if *csvFile != "" {
-		fileHandle, err := os.OpenFile(*file, os.O_RDWR, os.ModePerm)
+	cameras, err := flags.loadCameras()
 
-		if err != nil {
-			panic(err)
-		}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot read cameras: %s\n", Redact(err.Error()))
+		os.Exit(1)
+	}
 
-		gocsv.SetCSVReader(func(in io.Reader) gocsv.CSVReader {
+	// In JSON mode stdout carries only the report
+	humanOutput := io.Writer(os.Stdout)
+	if *output == OutputJSON {
+		humanOutput = io.Discard
+	}
 
-			return gocsv.LazyCSVReader(in)
-		})
+	analyzer := flags.newAnalyzer(humanOutput)
+	report := NewReport(*flags.method, params, analyzer.options)
 
-		errHandler := func(err *csv.ParseError) bool {
-			fmt.Println(err)
-			return true
-		}
+	// Ctrl-C stops the running ffmpeg processes; the cameras measured so
+	// far are still reported.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	defer analyzer.options.Workspace.Cleanup()
 
-		if err := gocsv.UnmarshalFileWithErrorHandler(fileHandle, errHandler, &cameras); err != nil {
-			panic(err)
+	analyzer.MeasureAll(ctx, *flags.method, cameras, params, *flags.concurrency, func(i int, m Measurement) {
+		camera := cameras[i]
+		report.Add(m)
+
+		if *output == OutputJSON {
+			return
 		}
-	} else {
-		cameras = append(cameras, &Camera{*file, *file, ""})
-	}
 
-	directMode := false
+		switch *flags.method {
+		case MethodTrackDiff:
+			analyzer.CheckTrackDesync()
+		case MethodDrift:
+			analyzer.CheckPTSDiffDrift()
+		case MethodFirstPackets:
+			if m.Err == nil && m.Diff.Diff <= firstPacketsThreshold {
+				color.Green("\nTracks in sync :" + camera.Apartment + " " + Redact(camera.Uri))
+			} else {
+				color.Red("\nTracks are desynced: " + camera.Apartment + " " + Redact(camera.Uri))
+			}
+		}
+	})
 
-	if *rawSubject == 1 {
-		directMode = true
+	if *output == OutputJSON {
+		if err := report.WriteJSON(os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot write report: %v\n", err)
+			os.Exit(1)
+		}
 	}
 
-	var count int = 0
-	useTime := false
-	count = *packets
-	if time != nil {
-		useTime = true
-		count = *time
+	if *resultsCSV != "" {
+		if err := writeReportFile(*resultsCSV, report.WriteCSV); err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot write results CSV: %v\n", err)
+			os.Exit(1)
+		}
 	}
 
-	analyzer := NewAnalyzer()
-	for _, camera := range cameras {
-		switch *method {
-		case "trackdiff":
-			analyzer.TracksDiff(camera.Uri, count, camera.Apartment, directMode, useTime)
-			analyzer.CheckTrackDesync()
-		case "drift":
-			analyzer.PTSDiffDrift(camera.Uri, count, camera.Apartment, directMode, useTime, *stream)
-			analyzer.CheckPTSDiffDrift()
-		case "firstpackets":
-			fmt.Println("Check in record")
-			if analyzer.SimpleDiff(camera.Uri, *packets, camera.Apartment, directMode) {
-				color.Green("\nTracks in sync :" + camera.Apartment + " " + camera.Uri)
-			} else {
-				color.Red("\nTracks are desynced: " + camera.Apartment + " " + camera.Uri)
-			}
-		case "startdiff":
-			fmt.Println("Comparison of the first packets")
-			analyzer.StartTimeDiff(camera.Uri, camera.Apartment)
-		case "trackdrift":
-			fmt.Println("Detect growing difference between auido and video streams")
+	if *junitFile != "" {
+		if err := writeReportFile(*junitFile, report.WriteJUnit); err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot write JUnit report: %v\n", err)
+			os.Exit(1)
 		}
 	}
 }
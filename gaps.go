@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+
+	"find_desync/analysis"
+	"find_desync/probe"
+
+	"github.com/fatih/color"
+	"github.com/rodaine/table"
+)
+
+// Gap verdicts: whether frames are missing and whether the audio/video
+// offset moved where they are.
+const (
+	GapsInSync = "in sync"
+	GapsLoss   = "packet loss"
+	GapsDesync = "desync at loss"
+)
+
+// gapWindow is the number of pairs on each side of a gap whose median
+// offsets are compared.
+const gapWindow = 5
+
+// StreamGaps sums up the timeline breaks of one stream. Missing is the
+// media lost in gaps and Overlapped the media covered twice, in seconds.
+type StreamGaps struct {
+	Frames        int     `json:"frames"`
+	FrameDuration float64 `json:"frame_duration"`
+	Gaps          int     `json:"gaps"`
+	MissingFrames int     `json:"missing_frames"`
+	Missing       float64 `json:"missing"`
+	Duplicates    int     `json:"duplicates"`
+	Overlaps      int     `json:"overlaps"`
+	Overlapped    float64 `json:"overlapped"`
+}
+
+// GapEventInfo is one timeline break. Frame is the number of the frame
+// after it and Pos its byte offset, -1 when unknown. OffsetJump is the
+// change of the audio minus video offset across the break when there are
+// pairs on both sides of it, and Correlated tells whether that change is
+// more than pairing noise.
+type GapEventInfo struct {
+	Stream     probe.MediaType  `json:"stream"`
+	Kind       analysis.GapKind `json:"kind"`
+	Frame      int              `json:"frame"`
+	Pos        int64            `json:"pos"`
+	Time       float64          `json:"time"`
+	Size       float64          `json:"size"`
+	OffsetJump *float64         `json:"offset_jump,omitempty"`
+	Correlated bool             `json:"correlated"`
+}
+
+// GapInfo holds a gap measurement. Diff is the median audio minus video
+// offset over the whole window.
+type GapInfo struct {
+	ApartName  string
+	CameraHash string
+	Source     string
+	Diff       float64
+	Video      StreamGaps
+	Audio      StreamGaps
+	Events     []GapEventInfo
+	Correlated int
+	Verdict    string
+}
+
+func NewGapInfo(apartName, uri string) GapInfo {
+	return GapInfo{
+		ApartName:  apartName,
+		CameraHash: CameraID(uri),
+		Source:     Redact(uri),
+	}
+}
+
+// FindGaps looks for missing, duplicated and overlapping frames in both
+// streams and checks whether the audio/video offset jumps where they are.
+func (a *Analyzer) FindGaps(ctx context.Context, uri string, time int, apart string, direct bool, useTime bool) (GapInfo, error) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+
+	var sourceFile string
+
+	if !direct {
+		var err error
+		sourceFile, err = a.recordTempFile(ctx, uri, time, false)
+		if err != nil {
+			return GapInfo{}, err
+		}
+		defer a.options.Workspace.Release(sourceFile)
+	} else {
+		sourceFile = uri
+	}
+
+	videoPackets, audioPackets, err := a.probeTracks(ctx, sourceFile, time, useTime)
+
+	if err != nil {
+		logger.Error(fmt.Sprintf("Error probe command: %v", err))
+		return GapInfo{}, err
+	}
+
+	fmt.Fprintf(a.out, "\n=== Stream: %s ===\n", Redact(uri))
+
+	gapInfo := NewGapInfo(apart, uri)
+
+	// A reset is not a gap: look for gaps between resets only
+	videoResets := resets(videoPackets)
+	audioResets := resets(audioPackets)
+
+	gapInfo.Video, gapInfo.Events = streamGaps(videoPackets, videoResets, gapInfo.Events)
+	gapInfo.Audio, gapInfo.Events = streamGaps(audioPackets, audioResets, gapInfo.Events)
+
+	// Offsets are only comparable within a segment without resets
+	fits := []segmentFit{}
+	all := []analysis.Sample{}
+	for _, segment := range a.splitSegments(videoPackets, audioPackets, videoResets, audioResets) {
+		fit, err := a.fitSegment(segment)
+
+		if err != nil {
+			logger.Error(fmt.Sprintf("Error pairing frames: %v", err))
+			return GapInfo{}, err
+		}
+
+		fits = append(fits, fit)
+		all = append(all, fit.samples...)
+	}
+
+	gapInfo.Diff = analysis.MedianOffset(all)
+
+	// Pairing moves the offset by up to half a frame of either stream
+	noise := math.Max(driftResolution, math.Max(gapInfo.Video.FrameDuration, gapInfo.Audio.FrameDuration)/2)
+
+	for i := range gapInfo.Events {
+		event := &gapInfo.Events[i]
+
+		fit, ok := segmentOf(fits, event.Stream, event.Frame)
+		if !ok {
+			continue
+		}
+
+		start, end := event.Time, event.Time+math.Max(event.Size, 0)
+		if jump, ok := analysis.OffsetJump(fit.samples, start, end, gapWindow); ok {
+			event.OffsetJump = floatPtr(jump)
+			event.Correlated = math.Abs(jump) > noise
+		}
+
+		if event.Correlated {
+			gapInfo.Correlated++
+		}
+	}
+
+	switch {
+	case gapInfo.Correlated > 0:
+		gapInfo.Verdict = GapsDesync
+	case len(gapInfo.Events) > 0:
+		gapInfo.Verdict = GapsLoss
+	default:
+		gapInfo.Verdict = GapsInSync
+	}
+
+	a.printGaps(gapInfo)
+
+	return gapInfo, nil
+}
+
+// resets returns the index of the first frame after each backwards step of
+// the stream timestamps.
+func resets(frames []probe.Frame) []int {
+	cuts := []int{}
+	for _, d := range analysis.FindDiscontinuities(decodeTimes(frames), math.Inf(1)) {
+		cuts = append(cuts, d.Index)
+	}
+	return cuts
+}
+
+// streamGaps finds the timeline breaks of frames between its resets and
+// appends them to events.
+func streamGaps(frames []probe.Frame, resets []int, events []GapEventInfo) (StreamGaps, []GapEventInfo) {
+	stats := StreamGaps{
+		Frames:        len(frames),
+		FrameDuration: analysis.FrameDuration(decodeTimes(frames)),
+	}
+
+	start := 0
+	for _, part := range splitAt(frames, resets) {
+		for _, gap := range analysis.FindGaps(timestamps(part), driftResolution) {
+			f := frames[start+gap.Index]
+
+			switch gap.Kind {
+			case analysis.Gap:
+				stats.Gaps++
+				stats.Missing += gap.Size
+				stats.MissingFrames += int(math.Round(gap.Frames))
+			case analysis.Duplicate:
+				stats.Duplicates++
+			case analysis.Overlap:
+				stats.Overlaps++
+				stats.Overlapped += gap.Size
+			}
+
+			events = append(events, GapEventInfo{
+				Stream: f.MediaType,
+				Kind:   gap.Kind,
+				Frame:  f.Number,
+				Pos:    f.Pos,
+				Time:   gap.Time,
+				Size:   gap.Size,
+			})
+		}
+		start += len(part)
+	}
+
+	return stats, events
+}
+
+// segmentOf returns the segment holding frame number of the stream.
+func segmentOf(fits []segmentFit, stream probe.MediaType, number int) (segmentFit, bool) {
+	for _, fit := range fits {
+		frames := fit.video
+		if stream == probe.Audio {
+			frames = fit.audio
+		}
+		if len(frames) > 0 && frames[0].Number <= number && number <= frames[len(frames)-1].Number {
+			return fit, true
+		}
+	}
+	return segmentFit{}, false
+}
+
+func (a *Analyzer) printGaps(g GapInfo) {
+	headerFmt := color.New(color.FgGreen, color.Underline).SprintfFunc()
+	columnFmt := color.New(color.FgYellow).SprintfFunc()
+
+	tbl := table.New("Stream", "Frames", "Gaps", "Missing frames", "Missing", "Duplicates", "Overlaps", "Overlapped")
+	tbl.WithHeaderFormatter(headerFmt).WithFirstColumnFormatter(columnFmt).WithWriter(a.out)
+
+	for _, row := range []struct {
+		name  string
+		stats StreamGaps
+	}{{"video", g.Video}, {"audio", g.Audio}} {
+		tbl.AddRow(row.name, row.stats.Frames, row.stats.Gaps, row.stats.MissingFrames,
+			fmt.Sprintf("%.3f", row.stats.Missing), row.stats.Duplicates, row.stats.Overlaps,
+			fmt.Sprintf("%.3f", row.stats.Overlapped))
+	}
+
+	tbl.Print()
+
+	if len(g.Events) > 0 {
+		fmt.Fprintln(a.out)
+
+		tbl = table.New("Stream", "Kind", "Frame", "Byte offset", "Time", "Size", "Offset jump")
+		tbl.WithHeaderFormatter(headerFmt).WithFirstColumnFormatter(columnFmt).WithWriter(a.out)
+
+		for _, e := range g.Events {
+			pos, jump := "-", "-"
+			if e.Pos >= 0 {
+				pos = fmt.Sprint(e.Pos)
+			}
+			if e.OffsetJump != nil {
+				jump = fmt.Sprintf("%+.3f", *e.OffsetJump)
+				if e.Correlated {
+					jump += " !"
+				}
+			}
+			tbl.AddRow(e.Stream, e.Kind, e.Frame, pos, fmt.Sprintf("%.3f", e.Time), fmt.Sprintf("%.3f", e.Size), jump)
+		}
+
+		tbl.Print()
+	}
+
+	fmt.Fprintf(a.out, "\nMedian offset:       %.3f seconds\n", g.Diff)
+
+	switch g.Verdict {
+	case GapsDesync:
+		a.red("\nDESYNC AT LOSS: the offset jumps at %d of %d timeline breaks", g.Correlated, len(g.Events))
+	case GapsLoss:
+		a.yellow("\nPACKET LOSS: %.3f seconds of video and %.3f seconds of audio missing, offset unaffected", g.Video.Missing, g.Audio.Missing)
+	default:
+		a.green("\nNo missing, duplicated or overlapping frames")
+	}
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/url"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"syscall"
+	"time"
+
+	"find_desync/mpegts"
+	"find_desync/synth"
+
+	"github.com/akamensky/argparse"
+)
+
+// Codecs of the generated streams. Native writes H.264 and LPCM without
+// any tool, the others re-encode it with ffmpeg, which adds the delays of
+// its encoders to the ground truth.
+const (
+	CodecNative = "native"
+	CodecH264   = "h264"
+	CodecMPEG2  = "mpeg2"
+)
+
+var Codecs = []string{CodecNative, CodecH264, CodecMPEG2}
+
+// codecSampleRates are the sample rates the audio encoders of the
+// re-encoding codecs accept: AAC for h264, MP2 for mpeg2.
+var codecSampleRates = map[string][]int{
+	CodecH264:  {7350, 8000, 11025, 12000, 16000, 22050, 24000, 32000, 44100, 48000, 64000, 88200, 96000},
+	CodecMPEG2: {16000, 22050, 24000, 32000, 44100, 48000},
+}
+
+// validSampleRate checks the audio of codec can be written at rate, so a
+// wrong rate fails before anything is generated rather than in ffmpeg.
+func validSampleRate(codec string, rate int) error {
+	if codec == CodecNative {
+		return synth.ValidLPCMRate(rate)
+	}
+
+	rates, ok := codecSampleRates[codec]
+	if !ok {
+		return fmt.Errorf("unknown codec %q", codec)
+	}
+	if !slices.Contains(rates, rate) {
+		return fmt.Errorf("%s audio cannot be encoded at %d Hz, use one of %v", codec, rate, rates)
+	}
+	return nil
+}
+
+// nativeSampleRate is the rate the native stream is written at when the
+// requested one is left to ffmpeg.
+const nativeSampleRate = 48000
+
+// udpPackets is the number of transport stream packets sent per datagram.
+const udpPackets = 7
+
+// GenerateOptions describe a synthetic test stream to write.
+type GenerateOptions struct {
+	Config synth.Config
+	Codec  string
+	// Output is a file name or a udp://host:port address.
+	Output string
+	// Truth is the file the ground truth is written to, none when empty.
+	Truth string
+	Out   io.Writer
+}
+
+// GenerateTruth is the content of the ground truth sidecar file.
+type GenerateTruth struct {
+	Codec  string `json:"codec"`
+	Output string `json:"output"`
+	synth.Truth
+}
+
+// Generate writes the flash and beep test pattern with the configured
+// faults to a file or, paced by its PCR, to a UDP address, then its ground
+// truth.
+func Generate(ctx context.Context, opts GenerateOptions) error {
+	if err := validSampleRate(opts.Codec, opts.Config.SampleRate); err != nil {
+		return err
+	}
+
+	config := opts.Config
+	if opts.Codec != CodecNative && synth.ValidLPCMRate(config.SampleRate) != nil {
+		config.SampleRate = nativeSampleRate
+	}
+
+	generator, err := synth.New(config)
+	if err != nil {
+		return err
+	}
+
+	truth := GenerateTruth{Codec: opts.Codec, Output: Redact(opts.Output), Truth: generator.Truth()}
+	truth.SampleRate = opts.Config.SampleRate
+
+	fmt.Fprintf(opts.Out, "Writing %.1f seconds of %d fps video and %d Hz audio as %s to %s\n",
+		config.Duration, config.FrameRate, opts.Config.SampleRate, opts.Codec, Redact(opts.Output))
+
+	// The ground truth comes first, a stream sent over UDP may never end
+	if opts.Truth != "" {
+		data, err := json.MarshalIndent(truth, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(opts.Truth, append(data, '\n'), 0o644); err != nil {
+			return err
+		}
+		fmt.Fprintf(opts.Out, "Ground truth written to %s\n", opts.Truth)
+	}
+
+	printTruth(opts.Out, truth)
+
+	if opts.Codec == CodecNative {
+		return writeNative(ctx, generator, opts.Output)
+	}
+	return reencode(ctx, generator, opts)
+}
+
+func printTruth(out io.Writer, truth GenerateTruth) {
+	fmt.Fprintf(out, "Expected offset:     %.3f seconds at the start, %.3f at the end\n", truth.OffsetStart, truth.OffsetEnd)
+	fmt.Fprintf(out, "Expected drift:      %.1f ppm\n", truth.DriftPPM)
+	fmt.Fprintf(out, "First audio:         %.3f seconds after the first video frame\n", truth.FirstAudio)
+	fmt.Fprintf(out, "Missing audio:       %.3f seconds in %d drops\n", truth.MissingAudio, len(truth.Drops))
+	for _, d := range truth.Discontinuities {
+		fmt.Fprintf(out, "Discontinuity:       %+.3f seconds at %.3f\n", d.Jump, d.Time)
+	}
+	fmt.Fprintf(out, "Events:              %d flashes with their beep\n", len(truth.Events))
+}
+
+// writeNative writes the stream to a file, or sends it in real time when
+// output is a udp:// address.
+func writeNative(ctx context.Context, generator *synth.Generator, output string) error {
+	if u, err := url.Parse(output); err == nil && u.Scheme == "udp" {
+		conn, err := net.Dial("udp", u.Host)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		sender := &datagramWriter{conn: conn}
+		return generator.Write(sender, sender.pacer(ctx))
+	}
+
+	file, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	buffered := bufio.NewWriter(file)
+	err = generator.Write(buffered, func(float64) error { return ctx.Err() })
+	if err != nil {
+		return err
+	}
+	if err := buffered.Flush(); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// reencode writes the native stream to a temporary file and has ffmpeg
+// encode it with the timestamps kept.
+func reencode(ctx context.Context, generator *synth.Generator, opts GenerateOptions) error {
+	temp, err := os.CreateTemp("", "find_desync_generate_*.ts")
+	if err != nil {
+		return err
+	}
+	temp.Close()
+	defer os.Remove(temp.Name())
+
+	if err := writeNative(ctx, generator, temp.Name()); err != nil {
+		return err
+	}
+
+	cmd := NewCommand("ffmpeg").Arg("-y").Option("v", "error")
+	if u, err := url.Parse(opts.Output); err == nil && u.Scheme == "udp" {
+		cmd.Arg("-re")
+	}
+	cmd.Arg("-copyts").Option("i", temp.Name()).Option("map", "0")
+
+	switch opts.Codec {
+	case CodecH264:
+		cmd.Option("c:v", "libx264").Option("pix_fmt", "yuv420p").Option("c:a", "aac")
+	case CodecMPEG2:
+		cmd.Option("c:v", "mpeg2video").Option("c:a", "mp2")
+	default:
+		return fmt.Errorf("unknown codec %q", opts.Codec)
+	}
+
+	cmd.Option("ar", strconv.Itoa(opts.Config.SampleRate)).
+		Option("f", "mpegts").
+		Arg(opts.Output)
+
+	fmt.Fprintln(opts.Out, cmd)
+
+	output, err := cmd.Cmd(ctx).CombinedOutput()
+	return toolError(ctx, "ffmpeg", output, err)
+}
+
+// datagramWriter sends transport stream packets over UDP, udpPackets per
+// datagram.
+type datagramWriter struct {
+	conn    net.Conn
+	pending []byte
+}
+
+func (w *datagramWriter) Write(p []byte) (int, error) {
+	w.pending = append(w.pending, p...)
+	if len(w.pending) >= udpPackets*mpegts.PacketSize {
+		return len(p), w.Flush()
+	}
+	return len(p), nil
+}
+
+func (w *datagramWriter) Flush() error {
+	if len(w.pending) == 0 {
+		return nil
+	}
+	_, err := w.conn.Write(w.pending)
+	w.pending = w.pending[:0]
+	return err
+}
+
+// pacer returns the pace function of synth.Generator.Write sending the
+// packets when their PCR is due, counted from the first one.
+func (w *datagramWriter) pacer(ctx context.Context) func(clock float64) error {
+	start := time.Now()
+	first := math.NaN()
+
+	return func(clock float64) error {
+		if math.IsNaN(first) {
+			first = clock
+		}
+
+		if err := w.Flush(); err != nil {
+			return err
+		}
+
+		timer := time.NewTimer(time.Until(start.Add(time.Duration((clock - first) * float64(time.Second)))))
+		defer timer.Stop()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+			return nil
+		}
+	}
+}
+
+func generateMain(args []string) {
+	parser := argparse.NewParser("find_desync generate", "Write a synthetic flash and beep test stream with known sync faults, and its ground truth")
+
+	output := parser.String("o", "output", &argparse.Options{Required: true, Help: "File to write, or udp://host:port to send the stream to in real time"})
+	truthFile := parser.String("", "truth", &argparse.Options{Required: false, Help: "Ground truth JSON file, <output>.truth.json by default for files"})
+	codec := parser.Selector("", "codec", Codecs, &argparse.Options{Required: false, Help: "H.264 and LPCM written natively (native), or re-encoded by ffmpeg to H.264 and AAC (h264) or MPEG-2 video and MP2 (mpeg2)", Default: CodecNative})
+	duration := parser.Float("", "duration", &argparse.Options{Required: false, Help: "Seconds to generate", Default: 60.0})
+	fps := parser.Int("", "fps", &argparse.Options{Required: false, Help: "Video frame rate", Default: 25})
+	sampleRate := parser.Int("", "sample-rate", &argparse.Options{Required: false, Help: "Audio sample rate, 48000, 96000 or 192000 for the native codec, 7350 to 96000 for h264, 16000 to 48000 for mpeg2", Default: 48000})
+	interval := parser.Float("", "interval", &argparse.Options{Required: false, Help: "Mean seconds between two flashes", Default: 1.0})
+	startPTS := parser.Float("", "start-pts", &argparse.Options{Required: false, Help: "PTS of the first video frame in seconds, above 95443 to cross the 33-bit rollover", Default: 10.0})
+	offset := parser.Float("", "offset", &argparse.Options{Required: false, Help: "Seconds the sound is stamped after the picture, negative for before", Default: 0.0})
+	driftPPM := parser.Float("", "drift-ppm", &argparse.Options{Required: false, Help: "Sound played that many ppm slower with regular timestamps, as after a tempo change: the offset grows by that many microseconds per second", Default: 0.0})
+	driftTimestamps := parser.Flag("", "drift-timestamps", &argparse.Options{Required: false, Help: "Put --drift-ppm in the timestamps instead of the sound: the audio PTS and the PCR run that many ppm fast against the video PTS"})
+	dropEvery := parser.Float("", "drop-every", &argparse.Options{Required: false, Help: "Seconds between two audio drops, 0 for none", Default: 0.0})
+	dropLength := parser.Float("", "drop-length", &argparse.Options{Required: false, Help: "Seconds of audio left out at each drop", Default: 0.0})
+	jumpAt := parser.Float("", "jump-at", &argparse.Options{Required: false, Help: "Seconds into the stream at which every timestamp jumps", Default: 0.0})
+	jumpSize := parser.Float("", "jump-size", &argparse.Options{Required: false, Help: "Seconds every timestamp jumps by, 0 for no jump", Default: 0.0})
+	audioStart := parser.Float("", "audio-start", &argparse.Options{Required: false, Help: "Seconds of audio left out at the start", Default: 0.0})
+
+	err := parser.Parse(args)
+
+	if err != nil {
+		fmt.Print(parser.Usage(err))
+		return
+	}
+
+	truth := *truthFile
+	if u, err := url.Parse(*output); truth == "" && (err != nil || u.Scheme != "udp") {
+		truth = *output + ".truth.json"
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	err = Generate(ctx, GenerateOptions{
+		Config: synth.Config{
+			Duration:   *duration,
+			FrameRate:  *fps,
+			SampleRate: *sampleRate,
+			Interval:   *interval,
+			Start:      *startPTS,
+			Faults: synth.Faults{
+				Offset:          *offset,
+				DriftPPM:        *driftPPM,
+				DriftTimestamps: *driftTimestamps,
+				DropEvery:       *dropEvery,
+				DropLength:      *dropLength,
+				JumpAt:          *jumpAt,
+				JumpSize:        *jumpSize,
+				AudioStart:      *audioStart,
+			},
+		},
+		Codec:  *codec,
+		Output: *output,
+		Truth:  truth,
+		Out:    os.Stdout,
+	})
+
+	if err != nil {
+		fmt.Printf("Cannot generate: %v\n", err)
+		os.Exit(1)
+	}
+}
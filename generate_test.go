@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"io"
+	"math"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"find_desync/mpegts"
+	"find_desync/probe"
+	"find_desync/synth"
+)
+
+func TestGenerateSampleRate(t *testing.T) {
+	tests := []struct {
+		codec string
+		rate  int
+		ok    bool
+	}{
+		{CodecNative, 48000, true},
+		{CodecNative, 44100, false},
+		{CodecH264, 8000, true},
+		{CodecH264, 44100, true},
+		{CodecH264, 192000, false},
+		{CodecMPEG2, 44100, true},
+		{CodecMPEG2, 8000, false},
+		{CodecMPEG2, 11025, false},
+	}
+
+	for _, tt := range tests {
+		err := Generate(context.Background(), GenerateOptions{
+			Config: synth.Config{Duration: 1, FrameRate: 25, SampleRate: tt.rate, Interval: 1, Start: 10},
+			Codec:  tt.codec,
+			Output: filepath.Join(t.TempDir(), "out.ts"),
+			Out:    io.Discard,
+		})
+
+		// Valid rates may fail later without ffmpeg, never on the rate
+		if rejected := err != nil && strings.Contains(err.Error(), strconv.Itoa(tt.rate)); rejected == tt.ok {
+			t.Errorf("%s at %d Hz: error %v", tt.codec, tt.rate, err)
+		}
+	}
+}
+
+func TestGenerateDriftTimestamps(t *testing.T) {
+	const ppm = 2000
+
+	file := filepath.Join(t.TempDir(), "drift.ts")
+	err := Generate(context.Background(), GenerateOptions{
+		Config: synth.Config{
+			Duration:   20,
+			FrameRate:  25,
+			SampleRate: 48000,
+			Interval:   1,
+			Start:      10,
+			Faults:     synth.Faults{DriftPPM: ppm, DriftTimestamps: true},
+		},
+		Codec:  CodecNative,
+		Output: file,
+		Out:    io.Discard,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := mpegts.NewDemuxer("", mpegts.Limit{})
+	if err := mpegts.Demux(context.Background(), file, d, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	result, err := d.Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The last audio frame, 19.98 s of audio in, is stamped ppm late; the
+	// video stays on time
+	audio, _ := result.Stream(probe.Audio)
+	var lastAudio, lastVideo int64
+	for _, frame := range result.Frames {
+		if frame.StreamIndex == audio.Index {
+			lastAudio = frame.Pts
+		} else {
+			lastVideo = frame.Pts
+		}
+	}
+	audioLate := mpegts.TimeBase.Seconds(lastAudio) - (10 + 19.98)
+	if want := 19.98 * ppm * 1e-6; math.Abs(audioLate-want) > 1e-4 {
+		t.Errorf("last audio frame %.4f seconds late, want %.4f", audioLate, want)
+	}
+	if got := mpegts.TimeBase.Seconds(lastVideo); math.Abs(got-(10+19.96)) > 1e-4 {
+		t.Errorf("last video frame at %.4f, want %.4f", got, 10+19.96)
+	}
+
+	// The PCR runs as fast as the audio clock
+	first, last := result.PCRs[0], result.PCRs[len(result.PCRs)-1]
+	elapsed := mpegts.TimeBase.Seconds(lastVideo) - 10
+	if rate := (last.Seconds() - first.Seconds()) / elapsed; math.Abs(rate-(1+ppm*1e-6)) > 1e-5 {
+		t.Errorf("PCR runs at %.6f of the video clock, want %.6f", rate, 1+ppm*1e-6)
+	}
+}
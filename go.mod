@@ -2,13 +2,15 @@ module find_desync
 
 go 1.25.1
 
-require github.com/gocarina/gocsv v0.0.0-20240520201108-78e41c74b4b1
+require (
+	github.com/akamensky/argparse v1.4.0
+	github.com/fatih/color v1.18.0
+	github.com/gocarina/gocsv v0.0.0-20240520201108-78e41c74b4b1
+	github.com/rodaine/table v1.3.0
+)
 
 require (
-	github.com/akamensky/argparse v1.4.0 // indirect
-	github.com/fatih/color v1.18.0 // indirect
 	github.com/mattn/go-colorable v0.1.13 // indirect
 	github.com/mattn/go-isatty v0.0.20 // indirect
-	github.com/rodaine/table v1.3.0 // indirect
 	golang.org/x/sys v0.25.0 // indirect
 )
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"time"
+
+	"find_desync/analysis"
+)
+
+const (
+	MethodTrackDiff    = "trackdiff"
+	MethodDrift        = "drift"
+	MethodFirstPackets = "firstpackets"
+	MethodStartDiff    = "startdiff"
+	MethodTrackDrift   = "trackdrift"
+	MethodPCR          = "pcr"
+	MethodGaps         = "gaps"
+	MethodContentSync  = "contentsync"
+	MethodTestPattern  = "testpattern"
+)
+
+// desyncThreshold is the offset, in seconds, above which a camera is
+// reported as desynchronized.
+const desyncThreshold = 0.5
+
+// startDiffThreshold and firstPacketsThreshold are the offsets the startdiff
+// and firstpackets methods tolerate.
+const (
+	startDiffThreshold    = 0.1
+	firstPacketsThreshold = 1.0
+)
+
+const (
+	VerdictInSync   = "in sync"
+	VerdictDesynced = "desynced"
+	VerdictError    = "error"
+	VerdictTimeout  = "timeout"
+)
+
+// RunParams are the per-run settings shared by every method.
+type RunParams struct {
+	// Count is the number of seconds, or packets when UseTime is false,
+	// to analyze.
+	Count   int
+	UseTime bool
+	Direct  bool
+}
+
+// Measurement is the outcome of running one method against one camera.
+// Diff is filled by the diff based methods, Drift by the drift method,
+// TrackDrift by the trackdrift method, Clock by the pcr method, Gaps by the
+// gaps method, Content by the contentsync method and Pattern by the
+// testpattern method.
+type Measurement struct {
+	Camera     *Camera
+	Method     string
+	Started    time.Time
+	Elapsed    time.Duration
+	Diff       DiffInfo
+	Drift      DriftInfo
+	TrackDrift TrackDriftInfo
+	Clock      ClockInfo
+	Gaps       GapInfo
+	Content    ContentInfo
+	Pattern    PatternInfo
+	Err        error
+	// Capture is how the source was saved, CaptureNone when it was
+	// probed directly.
+	Capture string
+	// Attempts is 1 plus the number of retried recordings and probes.
+	Attempts int
+}
+
+// Offset returns the audio/video offset in seconds the measurement
+// reports. For drift and trackdrift it is the offset reached at the end of
+// the window.
+func (m Measurement) Offset() float64 {
+	switch m.Method {
+	case MethodDrift:
+		return m.Drift.Diff + m.Drift.TotalDurDiff
+	case MethodTrackDrift:
+		return m.TrackDrift.Diff + m.TrackDrift.Change
+	case MethodPCR:
+		return m.Clock.Offset()
+	case MethodGaps:
+		return m.Gaps.Diff
+	case MethodContentSync:
+		return m.Content.Diff
+	case MethodTestPattern:
+		return m.Pattern.Diff
+	}
+	return m.Diff.Diff
+}
+
+// Verdict summarizes the measurement as "in sync", "desynced", "error" or
+// "timeout", or the verdict of the drift, trackdrift, pcr, gaps,
+// contentsync and testpattern methods.
+func (m Measurement) Verdict() string {
+	if errors.Is(m.Err, context.DeadlineExceeded) {
+		return VerdictTimeout
+	}
+	if m.Err != nil {
+		return VerdictError
+	}
+
+	threshold := desyncThreshold
+	switch m.Method {
+	case MethodDrift:
+		return string(m.Drift.Verdict)
+	case MethodTrackDrift:
+		return string(m.TrackDrift.Verdict)
+	case MethodPCR:
+		return m.Clock.Verdict
+	case MethodGaps:
+		return m.Gaps.Verdict
+	case MethodContentSync:
+		return m.Content.Verdict
+	case MethodTestPattern:
+		return m.Pattern.Verdict
+	case MethodStartDiff:
+		threshold = startDiffThreshold
+	case MethodFirstPackets:
+		threshold = firstPacketsThreshold
+	}
+
+	if math.Abs(m.Offset()) > threshold {
+		return VerdictDesynced
+	}
+	return VerdictInSync
+}
+
+// Desynced reports whether the verdict of the measurement is a desync: an
+// offset past the threshold of the method, a desync at packet loss, or a
+// fixed offset past the desync threshold.
+func (m Measurement) Desynced() bool {
+	switch m.Verdict() {
+	case VerdictDesynced, GapsDesync:
+		return true
+	case string(analysis.FixedOffset):
+		return math.Abs(m.Offset()) > desyncThreshold
+	}
+	return false
+}
+
+// Inconclusive reports whether the measurement could not tell whether the
+// streams are in sync.
+func (m Measurement) Inconclusive() bool {
+	return m.Err == nil && m.Verdict() == ContentInconclusive
+}
+
+// Drifting reports whether the measurement found the streams drifting
+// apart: a progressive drift of the drift or trackdrift methods, or any
+// clock drift of the pcr method.
+func (m Measurement) Drifting() bool {
+	if m.Err != nil {
+		return false
+	}
+
+	switch m.Method {
+	case MethodDrift, MethodTrackDrift:
+		return m.Verdict() == string(analysis.ProgressiveDrift)
+	case MethodPCR:
+		return m.Clock.Verdict != ClockInSync
+	}
+	return false
+}
+
+// Measure runs the given method against the camera. A panic inside the
+// method is turned into an error so one bad camera cannot stop a batch.
+// The method is stopped after Options.Timeout, if set.
+func (a *Analyzer) Measure(ctx context.Context, method string, camera *Camera, params RunParams) (m Measurement) {
+	m = Measurement{Camera: camera, Method: method, Started: time.Now(), Attempts: 1, Capture: a.options.Capture}
+	if params.Direct || method == MethodStartDiff || a.nativeDemux(camera.Uri) {
+		m.Capture = CaptureNone
+	}
+	direct := m.Capture == CaptureNone
+	ctx = withAttempts(withCamera(ctx, camera), &m.Attempts)
+
+	if a.options.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, a.options.Timeout)
+		defer cancel()
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			m.Err = fmt.Errorf("%s panicked: %v", method, r)
+		}
+		m.Elapsed = time.Since(m.Started)
+	}()
+
+	if err := ctx.Err(); err != nil {
+		m.Err = err
+		return m
+	}
+
+	switch method {
+	case MethodTrackDiff:
+		m.Diff, m.Err = a.TracksDiff(ctx, camera.Uri, params.Count, camera.Apartment, direct, params.UseTime)
+	case MethodDrift:
+		m.Drift, m.Err = a.PTSDiffDrift(ctx, camera.Uri, params.Count, camera.Apartment, direct, params.UseTime)
+	case MethodTrackDrift:
+		m.TrackDrift, m.Err = a.TracksDrift(ctx, camera.Uri, params.Count, camera.Apartment, direct, params.UseTime)
+	case MethodFirstPackets:
+		fmt.Fprintln(a.out, "Check in record")
+		m.Diff, m.Err = a.SimpleDiff(ctx, camera.Uri, params.Count, camera.Apartment, direct)
+	case MethodStartDiff:
+		fmt.Fprintln(a.out, "Comparison of the first packets")
+		m.Diff, m.Err = a.StartTimeDiff(ctx, camera.Uri, camera.Apartment)
+	case MethodPCR:
+		m.Clock, m.Err = a.PCRClock(ctx, camera.Uri, params.Count, camera.Apartment, params.UseTime)
+	case MethodGaps:
+		m.Gaps, m.Err = a.FindGaps(ctx, camera.Uri, params.Count, camera.Apartment, direct, params.UseTime)
+	case MethodContentSync:
+		m.Content, m.Err = a.ContentSync(ctx, camera.Uri, params.Count, camera.Apartment, direct, params.UseTime)
+	case MethodTestPattern:
+		m.Pattern, m.Err = a.TestPattern(ctx, camera.Uri, params.Count, camera.Apartment, direct, params.UseTime)
+	default:
+		m.Err = fmt.Errorf("unknown method %q", method)
+	}
+
+	return m
+}
+
+// fork returns an analyzer sharing the runner and options of a, with its
+// own output and results so it can run next to other forks. A runner that
+// prints its commands prints them to the output of the fork too.
+func (a *Analyzer) fork(out io.Writer) *Analyzer {
+	runner := a.runner
+	if r, ok := runner.(outputRunner); ok {
+		runner = r.WithOutput(out)
+	}
+
+	return &Analyzer{
+		runner:     runner,
+		options:    a.options,
+		out:        out,
+		apartDiffs: []DiffInfo{},
+	}
+}
+
+// merge appends the results accumulated by a fork.
+func (a *Analyzer) merge(other *Analyzer) {
+	other.mu.Lock()
+	defer other.mu.Unlock()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.apartDiffs = append(a.apartDiffs, other.apartDiffs...)
+	a.apartDrifts = append(a.apartDrifts, other.apartDrifts...)
+}
+
+// MeasureAll measures every camera with up to concurrency cameras in
+// flight. done is called once per camera in camera order, after the output
+// of that camera has been written and its results merged into a, so both
+// stay in a stable order whatever order the probes finish in. Cameras not
+// started yet when ctx is done are reported with ctx's error.
+func (a *Analyzer) MeasureAll(ctx context.Context, method string, cameras []*Camera, params RunParams, concurrency int, done func(i int, m Measurement)) {
+	if concurrency <= 1 {
+		for i, camera := range cameras {
+			done(i, a.Measure(ctx, method, camera, params))
+		}
+		return
+	}
+
+	type slot struct {
+		worker *Analyzer
+		output bytes.Buffer
+		result Measurement
+		ready  chan struct{}
+	}
+
+	slots := make([]*slot, len(cameras))
+	for i := range slots {
+		slots[i] = &slot{ready: make(chan struct{})}
+	}
+
+	jobs := make(chan int)
+
+	for w := 0; w < min(concurrency, len(cameras)); w++ {
+		go func() {
+			for i := range jobs {
+				s := slots[i]
+				s.worker = a.fork(&s.output)
+				s.result = s.worker.Measure(ctx, method, cameras[i], params)
+				close(s.ready)
+			}
+		}()
+	}
+
+	go func() {
+		for i := range cameras {
+			jobs <- i
+		}
+		close(jobs)
+	}()
+
+	for i, s := range slots {
+		<-s.ready
+		a.out.Write(s.output.Bytes())
+		a.merge(s.worker)
+		done(i, s.result)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"find_desync/analysis"
+)
+
+// TestForkRunnerOutput checks that the commands a fork runs are printed
+// with its own output, which MeasureAll writes out in camera order.
+func TestForkRunnerOutput(t *testing.T) {
+	analyzer := NewAnalyzer(FFmpegRunner{Out: os.Stdout}, Options{Output: io.Discard})
+
+	var output bytes.Buffer
+	fork := analyzer.fork(&output)
+
+	runner, ok := fork.runner.(FFmpegRunner)
+	if !ok {
+		t.Fatalf("fork runner is %T", fork.runner)
+	}
+	if runner.Out != &output {
+		t.Error("fork runner does not print to the fork output")
+	}
+	if analyzer.runner.(FFmpegRunner).Out != os.Stdout {
+		t.Error("fork changed the runner of the analyzer")
+	}
+}
+
+func TestMonitorClassify(t *testing.T) {
+	inSync := Measurement{Method: MethodTrackDiff, Diff: DiffInfo{Diff: 0.01}}
+	inconclusive := Measurement{Method: MethodContentSync, Content: ContentInfo{Diff: 3, Verdict: ContentInconclusive}}
+
+	tests := []struct {
+		name      string
+		threshold float64
+		state     SyncState
+		m         Measurement
+		want      SyncState
+	}{
+		{"drift", 0, StateUnknown, Measurement{Method: MethodDrift, Drift: DriftInfo{Verdict: analysis.ProgressiveDrift}}, StateDrifting},
+		{"trackdrift", 0, StateUnknown, Measurement{Method: MethodTrackDrift, TrackDrift: TrackDriftInfo{Verdict: analysis.ProgressiveDrift}}, StateDrifting},
+		{"trackdrift in sync", 0, StateUnknown, Measurement{Method: MethodTrackDrift, TrackDrift: TrackDriftInfo{Verdict: analysis.InSync}}, StateInSync},
+		{"pcr", 0, StateUnknown, Measurement{Method: MethodPCR, Clock: ClockInfo{Verdict: ClockEncoderDrift}}, StateDrifting},
+		{"pcr in sync", 0, StateUnknown, Measurement{Method: MethodPCR, Clock: ClockInfo{Verdict: ClockInSync}}, StateInSync},
+		{"trackdiff desynced", 0, StateInSync, Measurement{Method: MethodTrackDiff, Diff: DiffInfo{Diff: 0.7}}, StateDesynced},
+		{"trackdiff recovered", 0, StateDesynced, inSync, StateRecovered},
+		// startdiff desyncs from 0.1 s, not from the 0.5 s of trackdiff
+		{"startdiff desynced", 0, StateInSync, Measurement{Method: MethodStartDiff, Diff: DiffInfo{Diff: 0.2}}, StateDesynced},
+		{"gaps desync at loss", 0, StateInSync, Measurement{Method: MethodGaps, Gaps: GapInfo{Verdict: GapsDesync}}, StateDesynced},
+		{"gaps packet loss", 0, StateInSync, Measurement{Method: MethodGaps, Gaps: GapInfo{Verdict: GapsLoss}}, StateInSync},
+		{"drift past the threshold", 0, StateUnknown, Measurement{Method: MethodTrackDrift, TrackDrift: TrackDriftInfo{Diff: 1, Verdict: analysis.ProgressiveDrift}}, StateDrifting},
+		{"fixed offset", 0, StateInSync, Measurement{Method: MethodDrift, Drift: DriftInfo{Diff: 0.02, Verdict: analysis.FixedOffset}}, StateInSync},
+		{"fixed offset past the threshold", 0, StateInSync, Measurement{Method: MethodDrift, Drift: DriftInfo{Diff: 0.8, Verdict: analysis.FixedOffset}}, StateDesynced},
+		// The offset of an inconclusive measurement means nothing
+		{"inconclusive while in sync", 0, StateInSync, inconclusive, StateInSync},
+		{"inconclusive while desynced", 0, StateDesynced, inconclusive, StateDesynced},
+		{"inconclusive with a threshold", 0.5, StateInSync, inconclusive, StateInSync},
+		// An explicit threshold overrides the verdict both ways
+		{"threshold desynced", 0.05, StateInSync, Measurement{Method: MethodTrackDiff, Diff: DiffInfo{Diff: 0.1}}, StateDesynced},
+		{"threshold in sync", 1, StateInSync, Measurement{Method: MethodStartDiff, Diff: DiffInfo{Diff: 0.2}}, StateInSync},
+		{"threshold drift desynced first", 0.5, StateUnknown, Measurement{Method: MethodTrackDrift, TrackDrift: TrackDriftInfo{Diff: 1, Verdict: analysis.ProgressiveDrift}}, StateDesynced},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			monitor := NewMonitor(nil, nil, MonitorConfig{Threshold: tt.threshold})
+			status := &CameraStatus{State: tt.state, History: []Measurement{tt.m}}
+			if got := monitor.classify(status); got != tt.want {
+				t.Errorf("classify = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMonitorHistoryDriftsSkipsInconclusive(t *testing.T) {
+	start := time.Now()
+	status := &CameraStatus{State: StateInSync}
+
+	// In sync at first, then inconclusive with contentsync offsets growing
+	for i := range 10 {
+		m := Measurement{Method: MethodContentSync, Started: start.Add(time.Duration(i) * time.Minute)}
+		if i < 3 {
+			m.Content = ContentInfo{Diff: 0.01, Verdict: VerdictInSync}
+		} else {
+			m.Content = ContentInfo{Diff: float64(i) * 0.3, Verdict: ContentInconclusive}
+		}
+		status.History = append(status.History, m)
+	}
+
+	monitor := NewMonitor(nil, nil, MonitorConfig{})
+	if monitor.historyDrifts(status) {
+		t.Error("inconclusive offsets make the history drift")
+	}
+}
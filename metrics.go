@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type metricsKey struct {
+	name      string
+	apartment string
+	method    string
+}
+
+type cameraMetrics struct {
+	startTimeDiff   *float64
+	ptsDiff         *float64
+	offset          *float64
+	driftPPM        *float64
+	discontinuities *float64
+	videoMissing    *float64
+	audioMissing    *float64
+	gapJumps        *float64
+	contentPeak     *float64
+	patternStdDev   *float64
+	pcrJitter       *float64
+	videoPCRPPM     *float64
+	audioPCRPPM     *float64
+	framesSeen      bool
+	videoFrames     int
+	audioFrames     int
+	probeDuration   float64
+	probeFailures   int
+	lastSuccessTime float64
+}
+
+// Metrics collects the latest measurement of every camera and serves them
+// in the Prometheus text exposition format.
+type Metrics struct {
+	mu      sync.Mutex
+	cameras map[metricsKey]*cameraMetrics
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{cameras: map[metricsKey]*cameraMetrics{}}
+}
+
+// Observe records the DiffInfo or DriftInfo carried by a measurement.
+func (m *Metrics) Observe(result Measurement) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := metricsKey{name: result.Camera.Name, apartment: result.Camera.Apartment, method: result.Method}
+	cm, ok := m.cameras[key]
+	if !ok {
+		cm = &cameraMetrics{}
+		m.cameras[key] = cm
+	}
+
+	cm.probeDuration = result.Elapsed.Seconds()
+
+	if result.Err != nil {
+		cm.probeFailures++
+		return
+	}
+
+	cm.lastSuccessTime = float64(result.Started.Unix())
+
+	switch result.Method {
+	case MethodStartDiff:
+		cm.startTimeDiff = floatPtr(result.Diff.Diff)
+	case MethodDrift:
+		cm.offset = floatPtr(result.Offset())
+		cm.driftPPM = floatPtr(result.Drift.Estimate.PPM())
+		cm.discontinuities = floatPtr(float64(len(result.Drift.Discontinuities)))
+		cm.framesSeen = true
+		cm.videoFrames = result.Drift.VideoFrames
+		cm.audioFrames = result.Drift.AudioFrames
+	case MethodTrackDrift:
+		cm.offset = floatPtr(result.Offset())
+		cm.driftPPM = floatPtr(result.TrackDrift.Trend.PPM())
+		cm.discontinuities = floatPtr(float64(len(result.TrackDrift.Discontinuities)))
+		cm.framesSeen = true
+		cm.videoFrames = result.TrackDrift.VideoFrames
+		cm.audioFrames = result.TrackDrift.AudioFrames
+	case MethodPCR:
+		cm.offset = floatPtr(result.Offset())
+		cm.pcrJitter = nil
+		if !result.Clock.JitterCBR {
+			cm.pcrJitter = floatPtr(result.Clock.Jitter)
+		}
+		cm.videoPCRPPM = floatPtr(result.Clock.Video.PPM())
+		cm.audioPCRPPM = floatPtr(result.Clock.Audio.PPM())
+		cm.framesSeen = true
+		cm.videoFrames = result.Clock.VideoFrames
+		cm.audioFrames = result.Clock.AudioFrames
+	case MethodGaps:
+		cm.offset = floatPtr(result.Offset())
+		cm.videoMissing = floatPtr(result.Gaps.Video.Missing)
+		cm.audioMissing = floatPtr(result.Gaps.Audio.Missing)
+		cm.gapJumps = floatPtr(float64(result.Gaps.Correlated))
+		cm.framesSeen = true
+		cm.videoFrames = result.Gaps.Video.Frames
+		cm.audioFrames = result.Gaps.Audio.Frames
+	case MethodContentSync:
+		cm.offset = floatPtr(result.Offset())
+		cm.contentPeak = floatPtr(result.Content.Peak)
+	case MethodTestPattern:
+		cm.offset = floatPtr(result.Offset())
+		cm.patternStdDev = floatPtr(result.Pattern.StdDev)
+	default:
+		cm.ptsDiff = floatPtr(result.Diff.Diff)
+		cm.framesSeen = true
+		cm.videoFrames = result.Diff.VideoFrames
+		cm.audioFrames = result.Diff.AudioFrames
+	}
+}
+
+func floatPtr(v float64) *float64 {
+	return &v
+}
+
+type metricFamily struct {
+	name   string
+	help   string
+	kind   string
+	stream string
+	value  func(cm *cameraMetrics) (float64, bool)
+}
+
+var metricFamilies = []metricFamily{
+	{"find_desync_start_time_diff_seconds", "Video minus audio stream start time.", "gauge", "", func(cm *cameraMetrics) (float64, bool) { return optional(cm.startTimeDiff) }},
+	{"find_desync_pts_diff_seconds", "Average absolute PTS difference of paired audio and video frames.", "gauge", "", func(cm *cameraMetrics) (float64, bool) { return optional(cm.ptsDiff) }},
+	{"find_desync_offset_seconds", "Audio minus video offset of the last measurement, reached at the end of the window for drift and trackdrift.", "gauge", "", func(cm *cameraMetrics) (float64, bool) { return optional(cm.offset) }},
+	{"find_desync_drift_ppm", "Audio against video drift rate in parts per million.", "gauge", "", func(cm *cameraMetrics) (float64, bool) { return optional(cm.driftPPM) }},
+	{"find_desync_discontinuities", "Timestamp jumps found in the last drift or trackdrift measurement.", "gauge", "", func(cm *cameraMetrics) (float64, bool) { return optional(cm.discontinuities) }},
+	{"find_desync_missing_seconds", "Media missing in timestamp gaps in the last gaps measurement.", "gauge", "video", func(cm *cameraMetrics) (float64, bool) { return optional(cm.videoMissing) }},
+	{"find_desync_missing_seconds", "", "", "audio", func(cm *cameraMetrics) (float64, bool) { return optional(cm.audioMissing) }},
+	{"find_desync_gap_offset_jumps", "Timestamp gaps the audio/video offset jumped at in the last gaps measurement.", "gauge", "", func(cm *cameraMetrics) (float64, bool) { return optional(cm.gapJumps) }},
+	{"find_desync_content_correlation", "Correlation of sound onsets and picture changes at the measured offset.", "gauge", "", func(cm *cameraMetrics) (float64, bool) { return optional(cm.contentPeak) }},
+	{"find_desync_pattern_stddev_seconds", "Spread of the flash to beep offsets of the test pattern.", "gauge", "", func(cm *cameraMetrics) (float64, bool) { return optional(cm.patternStdDev) }},
+	{"find_desync_pcr_jitter_seconds", "Spread of the PCR around its arrival time, network sources only.", "gauge", "", func(cm *cameraMetrics) (float64, bool) { return optional(cm.pcrJitter) }},
+	{"find_desync_pts_pcr_drift_ppm", "Rate at which the PTS of a stream leaves the PCR, in parts per million.", "gauge", "video", func(cm *cameraMetrics) (float64, bool) { return optional(cm.videoPCRPPM) }},
+	{"find_desync_pts_pcr_drift_ppm", "", "", "audio", func(cm *cameraMetrics) (float64, bool) { return optional(cm.audioPCRPPM) }},
+	{"find_desync_frames", "Frames analyzed in the last measurement.", "gauge", "video", func(cm *cameraMetrics) (float64, bool) { return float64(cm.videoFrames), cm.framesSeen }},
+	{"find_desync_frames", "", "", "audio", func(cm *cameraMetrics) (float64, bool) { return float64(cm.audioFrames), cm.framesSeen }},
+	{"find_desync_probe_duration_seconds", "Wall time of the last measurement.", "gauge", "", func(cm *cameraMetrics) (float64, bool) { return cm.probeDuration, true }},
+	{"find_desync_probe_failures_total", "Measurements that ended with an error.", "counter", "", func(cm *cameraMetrics) (float64, bool) { return float64(cm.probeFailures), true }},
+	{"find_desync_last_success_timestamp_seconds", "Unix time of the last successful measurement.", "gauge", "", func(cm *cameraMetrics) (float64, bool) { return cm.lastSuccessTime, cm.lastSuccessTime > 0 }},
+}
+
+func optional(v *float64) (float64, bool) {
+	if v == nil {
+		return 0, false
+	}
+	return *v, true
+}
+
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	keys := make([]metricsKey, 0, len(m.cameras))
+	for key := range m.cameras {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].name != keys[j].name {
+			return keys[i].name < keys[j].name
+		}
+		if keys[i].apartment != keys[j].apartment {
+			return keys[i].apartment < keys[j].apartment
+		}
+		return keys[i].method < keys[j].method
+	})
+
+	var b strings.Builder
+	for _, family := range metricFamilies {
+		if family.help != "" {
+			fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", family.name, family.help, family.name, family.kind)
+		}
+
+		for _, key := range keys {
+			value, ok := family.value(m.cameras[key])
+			if !ok {
+				continue
+			}
+
+			labels := fmt.Sprintf(`name="%s",apartment="%s",method="%s"`,
+				escapeLabel(key.name), escapeLabel(key.apartment), escapeLabel(key.method))
+			if family.stream != "" {
+				labels += fmt.Sprintf(`,stream="%s"`, family.stream)
+			}
+
+			fmt.Fprintf(&b, "%s{%s} %g\n", family.name, labels, value)
+		}
+	}
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w)
+}
+
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
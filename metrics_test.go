@@ -0,0 +1,28 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMetricsOffset(t *testing.T) {
+	camera := &Camera{Name: "hall", Apartment: "a1"}
+	m := NewMetrics()
+	m.Observe(Measurement{Camera: camera, Method: MethodDrift, Drift: DriftInfo{Diff: 0.02, TotalDurDiff: 0.6}})
+	m.Observe(Measurement{Camera: camera, Method: MethodTrackDrift, TrackDrift: TrackDriftInfo{Diff: 0.01, Change: -0.3}})
+
+	var b strings.Builder
+	if _, err := m.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+
+	// The offset reached at the end of the window, as the verdict sees it
+	for _, want := range []string{
+		`find_desync_offset_seconds{name="hall",apartment="a1",method="drift"} 0.62`,
+		`find_desync_offset_seconds{name="hall",apartment="a1",method="trackdrift"} -0.29`,
+	} {
+		if !strings.Contains(b.String(), want+"\n") {
+			t.Errorf("missing %s in\n%s", want, b.String())
+		}
+	}
+}
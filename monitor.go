@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"find_desync/analysis"
+
+	"github.com/akamensky/argparse"
+	"github.com/fatih/color"
+)
+
+type SyncState string
+
+const (
+	StateUnknown   SyncState = "unknown"
+	StateInSync    SyncState = "in-sync"
+	StateDrifting  SyncState = "drifting"
+	StateDesynced  SyncState = "desynced"
+	StateRecovered SyncState = "recovered"
+)
+
+type MonitorConfig struct {
+	Method   string
+	Params   RunParams
+	Interval time.Duration
+	// History is the number of measurements kept per camera.
+	History int
+	// Threshold, when set, is the offset in seconds above which a camera
+	// is desynced, in place of the verdict of the method.
+	Threshold float64
+	// Metrics, when set, receives every measurement.
+	Metrics *Metrics
+	// Concurrency is the number of cameras measured in parallel.
+	Concurrency int
+}
+
+// CameraStatus is the rolling state of one monitored camera.
+type CameraStatus struct {
+	Camera   *Camera
+	State    SyncState
+	Since    time.Time
+	History  []Measurement
+	Failures int
+}
+
+// Monitor measures a fleet of cameras periodically and reports state
+// transitions instead of individual results.
+type Monitor struct {
+	analyzer *Analyzer
+	config   MonitorConfig
+	cameras  []*CameraStatus
+	logger   *slog.Logger
+}
+
+func NewMonitor(analyzer *Analyzer, cameras []*Camera, config MonitorConfig) *Monitor {
+	if config.History < 1 {
+		config.History = 1
+	}
+
+	if config.Interval <= 0 {
+		config.Interval = 5 * time.Minute
+	}
+
+	m := &Monitor{
+		analyzer: analyzer,
+		config:   config,
+		logger:   slog.New(slog.NewTextHandler(os.Stderr, nil)),
+	}
+
+	for _, camera := range cameras {
+		m.cameras = append(m.cameras, &CameraStatus{Camera: camera, State: StateUnknown})
+	}
+
+	return m
+}
+
+// Run measures every camera once per interval until ctx is done. A round
+// in progress is interrupted.
+func (m *Monitor) Run(ctx context.Context) {
+	ticker := time.NewTicker(m.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		m.Round(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Round measures every camera once. Measurements interrupted because ctx
+// is done are dropped rather than counted as failures.
+func (m *Monitor) Round(ctx context.Context) {
+	// The analyzer accumulates results for batch reports, which would grow
+	// without bound here; the monitor keeps its own history instead.
+	m.analyzer.Reset()
+
+	cameras := make([]*Camera, len(m.cameras))
+	for i, status := range m.cameras {
+		cameras[i] = status.Camera
+	}
+
+	m.analyzer.MeasureAll(ctx, m.config.Method, cameras, m.config.Params, m.config.Concurrency, func(i int, result Measurement) {
+		if ctx.Err() != nil {
+			return
+		}
+		m.update(m.cameras[i], result)
+	})
+}
+
+func (m *Monitor) update(status *CameraStatus, result Measurement) {
+	if m.config.Metrics != nil {
+		m.config.Metrics.Observe(result)
+	}
+
+	status.History = append(status.History, result)
+	if len(status.History) > m.config.History {
+		status.History = status.History[len(status.History)-m.config.History:]
+	}
+
+	if result.Err != nil {
+		status.Failures++
+		m.logger.Warn("measurement failed", "camera", status.Camera.Name, "failures", status.Failures, "attempts", result.Attempts, "error", Redact(result.Err.Error()))
+		return
+	}
+
+	status.Failures = 0
+
+	next := m.classify(status)
+	if next != status.State {
+		m.transition(status, next, result)
+	}
+}
+
+// classify derives the state of the camera from the verdict of its last
+// measurement. An inconclusive one leaves the state as it was.
+func (m *Monitor) classify(status *CameraStatus) SyncState {
+	last := status.History[len(status.History)-1]
+
+	if last.Inconclusive() {
+		return status.State
+	}
+
+	if m.desynced(last) {
+		return StateDesynced
+	}
+
+	if last.Drifting() || m.historyDrifts(status) {
+		return StateDrifting
+	}
+
+	if status.State == StateDesynced || status.State == StateDrifting {
+		return StateRecovered
+	}
+
+	return StateInSync
+}
+
+// desynced reports whether a measurement puts the camera out of sync: its
+// offset past the threshold when one is given, its verdict otherwise.
+func (m *Monitor) desynced(result Measurement) bool {
+	if m.config.Threshold > 0 {
+		return math.Abs(result.Offset()) > m.config.Threshold
+	}
+	return result.Desynced()
+}
+
+// historyDrifts fits the offsets of the successful, conclusive
+// measurements in the history against wall time, to catch drift slower
+// than a single window.
+func (m *Monitor) historyDrifts(status *CameraStatus) bool {
+	samples := []analysis.Sample{}
+	for _, item := range status.History {
+		if item.Err != nil || item.Inconclusive() {
+			continue
+		}
+		samples = append(samples, analysis.Sample{
+			Time:   item.Started.Sub(status.History[0].Started).Seconds(),
+			Offset: item.Offset(),
+		})
+	}
+
+	estimate, err := analysis.EstimateDrift(samples)
+	if err != nil {
+		return false
+	}
+
+	return estimate.Classify(driftResolution) == analysis.ProgressiveDrift
+}
+
+func (m *Monitor) transition(status *CameraStatus, next SyncState, result Measurement) {
+	line := fmt.Sprintf("[%s] %s (%s): %s -> %s, offset %.3f seconds",
+		result.Started.Format(time.RFC3339), status.Camera.Name, status.Camera.Apartment,
+		status.State, next, result.Offset())
+
+	switch next {
+	case StateDesynced:
+		color.Red(line)
+	case StateDrifting:
+		color.Yellow(line)
+	default:
+		color.Green(line)
+	}
+
+	status.State = next
+	status.Since = result.Started
+}
+
+func monitorMain(args []string) {
+	parser := argparse.NewParser("find_desync monitor", "Periodically analyze every camera and report sync state transitions")
+
+	flags := addCommonFlags(parser)
+	interval := parser.Int("i", "interval", &argparse.Options{Required: false, Help: "Seconds between two measurements of the same camera", Default: 300})
+	history := parser.Int("", "history", &argparse.Options{Required: false, Help: "Number of measurements kept per camera", Default: 60})
+	threshold := parser.Float("", "threshold", &argparse.Options{Required: false, Help: "Offset in seconds above which a camera is desynced, in place of the verdict of the method; 0 keeps the verdict", Default: 0.0})
+	metricsAddr := parser.String("", "metrics-addr", &argparse.Options{Required: false, Help: "Serve Prometheus metrics on this address, e.g. :9100"})
+
+	err := parser.Parse(args)
+
+	if err != nil {
+		fmt.Print(parser.Usage(err))
+		return
+	}
+
+	params, err := flags.runParams()
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, Redact(err.Error()))
+		return
+	}
+
+	cameras, err := flags.loadCameras()
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot read cameras: %s\n", Redact(err.Error()))
+		os.Exit(1)
+	}
+
+	var metrics *Metrics
+
+	if *metricsAddr != "" {
+		metrics = NewMetrics()
+
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics)
+
+		go func() {
+			if err := http.ListenAndServe(*metricsAddr, mux); err != nil {
+				slog.Error(fmt.Sprintf("Metrics server stopped: %v", err))
+			}
+		}()
+	}
+
+	analyzer := flags.newAnalyzer(os.Stdout)
+	monitor := NewMonitor(&analyzer, cameras, MonitorConfig{
+		Method:    *flags.method,
+		Params:    params,
+		Interval:  time.Duration(*interval) * time.Second,
+		History:   *history,
+		Threshold: *threshold,
+		Metrics:   metrics,
+
+		Concurrency: *flags.concurrency,
+	})
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	defer analyzer.options.Workspace.Cleanup()
+
+	monitor.Run(ctx)
+}
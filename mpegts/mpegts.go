@@ -0,0 +1,573 @@
+// Package mpegts demultiplexes MPEG transport streams far enough to read
+// the PES timestamps and the program clock reference, without ffprobe.
+// Frames are reported in the probe packet model so every analysis method
+// can use them; the PCR, which ffprobe's frame output hides, comes along.
+package mpegts
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"find_desync/probe"
+)
+
+const (
+	PacketSize = 188
+	syncByte   = 0x47
+
+	// ClockRate is the frequency of PTS and DTS, PCRRate the one of the
+	// program clock reference.
+	ClockRate = 90000
+	PCRRate   = 27000000
+
+	// TimestampBits is the width of PTS, DTS and the PCR base.
+	TimestampBits = 33
+)
+
+// TimeBase is the time base of every PTS and DTS in a transport stream.
+var TimeBase = probe.Rational{Num: 1, Den: ClockRate}
+
+var (
+	ErrSync      = errors.New("lost transport stream sync")
+	ErrNoProgram = errors.New("no program found in transport stream")
+)
+
+// PCR is one program clock reference sample.
+type PCR struct {
+	// Pos is the byte offset of the packet carrying the PCR.
+	Pos int64
+	// Value is the PCR in 27 MHz ticks.
+	Value int64
+	// Received is when the packet was read from the network, zero for
+	// files.
+	Received time.Time
+}
+
+func (p PCR) Seconds() float64 {
+	return float64(p.Value) / PCRRate
+}
+
+// Result holds the frames of the selected streams and every PCR of the
+// program.
+type Result struct {
+	probe.Result
+	PCRs []PCR
+	// PCRPid is the PID that carries the PCR.
+	PCRPid int
+}
+
+// Limit says when to stop reading.
+type Limit struct {
+	// Frames stops after that many frames of the selected streams.
+	Frames int
+	// Duration stops once every selected stream covers that many seconds.
+	Duration float64
+}
+
+type stream struct {
+	pid        int
+	streamType byte
+	info       probe.Stream
+	selected   bool
+	frames     int
+	first      int64
+	covered    bool
+
+	// pending is the PES being received, emitted when the next one starts
+	pending *pes
+}
+
+type pes struct {
+	frame   probe.Frame
+	payload []byte
+	// damaged is set when packets of the PES went missing
+	damaged bool
+}
+
+// Demuxer turns transport stream packets into frames. It follows the first
+// program of the PAT.
+type Demuxer struct {
+	streams string
+	limit   Limit
+
+	pmtPid int
+	pcrPid int
+	pids   map[int]*stream
+	// continuity is the last continuity counter seen on each PID, sections
+	// the PSI section being received on it
+	continuity map[int]byte
+	sections   map[int][]byte
+	order      []*stream
+	pos        int64
+	matched    int
+	done       bool
+
+	result Result
+}
+
+// NewDemuxer returns a demuxer keeping the streams matching the ffprobe
+// style specifier ("", "v", "a", "v:0", "a:1", ...) until limit is reached.
+func NewDemuxer(streams string, limit Limit) *Demuxer {
+	return &Demuxer{
+		streams: streams,
+		limit:   limit,
+		pmtPid:  -1,
+		pcrPid:  -1,
+		pids:    map[int]*stream{},
+
+		continuity: map[int]byte{},
+		sections:   map[int][]byte{},
+	}
+}
+
+// Done reports whether the limit has been reached.
+func (d *Demuxer) Done() bool {
+	return d.done
+}
+
+// Feed processes one transport stream packet received at the given time,
+// zero for files.
+func (d *Demuxer) Feed(packet []byte, received time.Time) error {
+	if len(packet) != PacketSize || packet[0] != syncByte {
+		return ErrSync
+	}
+
+	pos := d.pos
+	d.pos += PacketSize
+
+	// transport_error_indicator: the packet is known to be damaged
+	if packet[1]&0x80 != 0 {
+		return nil
+	}
+
+	start := packet[1]&0x40 != 0
+	pid := int(packet[1]&0x1f)<<8 | int(packet[2])
+	control := packet[3] >> 4 & 0x3
+	payload := packet[4:]
+	var field []byte
+
+	if control&0x2 != 0 {
+		length := int(packet[4])
+		if length > PacketSize-5 {
+			return nil
+		}
+
+		field = packet[5 : 5+length]
+		payload = packet[5+length:]
+	}
+
+	if control&0x1 == 0 {
+		payload = nil
+	} else {
+		// The counter only moves on packets with a payload, and jumps
+		// freely where the discontinuity indicator is set
+		counter := packet[3] & 0xf
+		last, seen := d.continuity[pid]
+		d.continuity[pid] = counter
+
+		switch {
+		case !seen || len(field) > 0 && field[0]&0x80 != 0:
+		case counter == last:
+			// A packet may be sent twice, the copy is dropped
+			return nil
+		case counter != (last+1)&0xf:
+			d.lost(pid)
+		}
+	}
+
+	randomAccess := false
+	if len(field) > 0 {
+		randomAccess = field[0]&0x40 != 0
+		if field[0]&0x10 != 0 && len(field) >= 7 && pid == d.pcrPid {
+			d.result.PCRs = append(d.result.PCRs, PCR{Pos: pos, Value: parsePCR(field[1:7]), Received: received})
+		}
+	}
+
+	switch {
+	case pid == 0:
+		d.psi(pid, start, payload, d.parsePAT)
+	case pid == d.pmtPid:
+		d.psi(pid, start, payload, d.parsePMT)
+	default:
+		if s, ok := d.pids[pid]; ok && s.selected {
+			d.parsePES(s, pos, start, randomAccess, payload)
+		}
+	}
+
+	return nil
+}
+
+func parsePCR(b []byte) int64 {
+	base := int64(b[0])<<25 | int64(b[1])<<17 | int64(b[2])<<9 | int64(b[3])<<1 | int64(b[4])>>7
+	extension := int64(b[4]&0x1)<<8 | int64(b[5])
+	return base*300 + extension
+}
+
+// lost drops what was being received on pid when packets went missing.
+func (d *Demuxer) lost(pid int) {
+	delete(d.sections, pid)
+	if s, ok := d.pids[pid]; ok && s.pending != nil {
+		s.pending.damaged = true
+	}
+}
+
+// psi gathers the PSI section received on pid across packets and hands it
+// to parse once complete. In a packet starting a section, the bytes before
+// the pointer field target end the previous one.
+func (d *Demuxer) psi(pid int, start bool, payload []byte, parse func([]byte)) {
+	if len(payload) == 0 {
+		return
+	}
+
+	if start {
+		pointer := int(payload[0])
+		if 1+pointer > len(payload) {
+			delete(d.sections, pid)
+			return
+		}
+
+		if buf, ok := d.sections[pid]; ok {
+			d.sections[pid] = append(buf, payload[1:1+pointer]...)
+			d.completeSection(pid, parse)
+		}
+		d.sections[pid] = append([]byte{}, payload[1+pointer:]...)
+	} else if buf, ok := d.sections[pid]; ok {
+		d.sections[pid] = append(buf, payload...)
+	}
+
+	d.completeSection(pid, parse)
+}
+
+// completeSection parses the section received on pid if it is complete.
+func (d *Demuxer) completeSection(pid int, parse func([]byte)) {
+	buf, ok := d.sections[pid]
+	if !ok || len(buf) < 3 {
+		return
+	}
+
+	length := 3 + (int(buf[1]&0x0f)<<8 | int(buf[2]))
+	if length > len(buf) {
+		return
+	}
+
+	delete(d.sections, pid)
+	parse(buf[:length])
+}
+
+// section returns the body of a PSI section, between its header and its
+// CRC, if it has the given table id.
+func section(data []byte, tableID byte) []byte {
+	if len(data) < 3 || data[0] != tableID {
+		return nil
+	}
+
+	length := int(data[1]&0x0f)<<8 | int(data[2])
+	if length < 9 || 3+length > len(data) {
+		return nil
+	}
+
+	return data[8 : 3+length-4]
+}
+
+func (d *Demuxer) parsePAT(psi []byte) {
+	if d.pmtPid >= 0 {
+		return
+	}
+
+	entries := section(psi, 0x00)
+	for i := 0; i+4 <= len(entries); i += 4 {
+		program := int(entries[i])<<8 | int(entries[i+1])
+		// program 0 points to the network information table
+		if program != 0 {
+			d.pmtPid = int(entries[i+2]&0x1f)<<8 | int(entries[i+3])
+			return
+		}
+	}
+}
+
+func (d *Demuxer) parsePMT(psi []byte) {
+	if len(d.order) > 0 {
+		return
+	}
+
+	data := section(psi, 0x02)
+	if len(data) < 4 {
+		return
+	}
+
+	d.pcrPid = int(data[0]&0x1f)<<8 | int(data[1])
+	d.result.PCRPid = d.pcrPid
+
+	infoLength := int(data[2]&0x0f)<<8 | int(data[3])
+	if 4+infoLength > len(data) {
+		return
+	}
+
+	hdmv := registered(data[4:4+infoLength], "HDMV")
+	counts := map[probe.MediaType]int{}
+
+	for i := 4 + infoLength; i+5 <= len(data); {
+		streamType := data[i]
+		pid := int(data[i+1]&0x1f)<<8 | int(data[i+2])
+		esLength := int(data[i+3]&0x0f)<<8 | int(data[i+4])
+		descriptors := data[i+5 : min(i+5+esLength, len(data))]
+		i += 5 + esLength
+
+		mediaType := mediaTypeOf(streamType, descriptors, hdmv || registered(descriptors, "HDMV"))
+		if mediaType == "" {
+			continue
+		}
+
+		s := &stream{
+			pid:        pid,
+			streamType: streamType,
+			info: probe.Stream{
+				Index:     len(d.order),
+				CodecType: mediaType,
+				TimeBase:  TimeBase,
+			},
+		}
+		s.selected = d.selects(mediaType, counts[mediaType])
+		counts[mediaType]++
+
+		d.pids[pid] = s
+		d.order = append(d.order, s)
+	}
+}
+
+// selects matches a stream against the ffprobe style specifier.
+func (d *Demuxer) selects(mediaType probe.MediaType, nth int) bool {
+	if d.streams == "" {
+		return true
+	}
+
+	kind, index, hasIndex := strings.Cut(d.streams, ":")
+	if kind != string(mediaType)[:1] {
+		return false
+	}
+	if !hasIndex {
+		return true
+	}
+
+	n, err := strconv.Atoi(index)
+	return err == nil && n == nth
+}
+
+// registered reports whether descriptors hold a registration descriptor
+// with the given format identifier.
+func registered(descriptors []byte, format string) bool {
+	for i := 0; i+2 <= len(descriptors); i += 2 + int(descriptors[i+1]) {
+		end := i + 2 + int(descriptors[i+1])
+		if descriptors[i] == 0x05 && end <= len(descriptors) && end-i >= 6 && string(descriptors[i+2:i+6]) == format {
+			return true
+		}
+	}
+	return false
+}
+
+// mediaTypeOf tells the media type of a stream. hdmv is set for Blu-ray
+// programs, where 0x80 is LPCM audio.
+func mediaTypeOf(streamType byte, descriptors []byte, hdmv bool) probe.MediaType {
+	switch streamType {
+	case 0x80:
+		if hdmv {
+			return probe.Audio
+		}
+	case 0x01, 0x02, 0x10, 0x1b, 0x24, 0x42, 0xea:
+		return probe.Video
+	case 0x03, 0x04, 0x0f, 0x11, 0x81, 0x87:
+		return probe.Audio
+	case 0x06:
+		// Private data, audio when tagged AC-3, E-AC-3, DTS or AAC
+		for i := 0; i+2 <= len(descriptors); i += 2 + int(descriptors[i+1]) {
+			switch descriptors[i] {
+			case 0x6a, 0x7a, 0x7b, 0x7c:
+				return probe.Audio
+			}
+		}
+	}
+	return ""
+}
+
+func (d *Demuxer) parsePES(s *stream, pos int64, start bool, randomAccess bool, payload []byte) {
+	if d.done {
+		return
+	}
+
+	if !start {
+		if s.pending != nil && s.streamType == 0x0f {
+			s.pending.payload = append(s.pending.payload, payload...)
+		}
+		return
+	}
+
+	d.emit(s)
+
+	// packet_start_code_prefix, stream_id, PES_packet_length and the
+	// optional header up to PES_header_data_length
+	if len(payload) < 9 || payload[0] != 0 || payload[1] != 0 || payload[2] != 1 {
+		return
+	}
+
+	flags := payload[7] >> 6
+	headerLength := int(payload[8])
+	if flags&0x2 == 0 || len(payload) < 9+headerLength || headerLength < 5 {
+		return
+	}
+
+	frame := probe.Frame{
+		Pos:         pos,
+		StreamIndex: s.info.Index,
+		MediaType:   s.info.CodecType,
+		KeyFrame:    randomAccess || s.info.CodecType == probe.Audio,
+		Pts:         parseTimestamp(payload[9:14]),
+		HasPts:      true,
+		HasPktDts:   true,
+		TimeBase:    TimeBase,
+	}
+
+	frame.PktDts = frame.Pts
+	if flags == 0x3 && headerLength >= 10 {
+		frame.PktDts = parseTimestamp(payload[14:19])
+	}
+	frame.BestEffortTimestamp = frame.Pts
+
+	s.pending = &pes{frame: frame}
+	if s.streamType == 0x0f || s.streamType == 0x80 {
+		s.pending.payload = append([]byte{}, payload[9+headerLength:]...)
+	}
+}
+
+func parseTimestamp(b []byte) int64 {
+	return int64(b[0]>>1&0x7)<<30 | int64(b[1])<<22 | int64(b[2]>>1)<<15 | int64(b[3])<<7 | int64(b[4]>>1)
+}
+
+// emit appends the pending PES of s as a frame and checks the limit.
+func (d *Demuxer) emit(s *stream) {
+	p := s.pending
+	s.pending = nil
+	if p == nil || d.done {
+		return
+	}
+
+	frame := p.frame
+	if s.streamType == 0x0f && !p.damaged {
+		if samples, rate := adtsSamples(p.payload); rate > 0 {
+			frame.NbSamples = samples
+			frame.Duration = int64(samples) * ClockRate / int64(rate)
+		}
+	}
+	if s.streamType == 0x80 && !p.damaged {
+		if samples, rate := lpcmSamples(p.payload); rate > 0 {
+			frame.NbSamples = samples
+			frame.Duration = int64(samples) * ClockRate / int64(rate)
+		}
+	}
+
+	if s.frames == 0 {
+		s.first = frame.Pts
+		s.info.StartTime = TimeBase.Seconds(frame.Pts)
+	}
+	s.frames++
+	frame.Number = s.frames
+	frame.Arrival = len(d.result.Frames)
+	d.result.Frames = append(d.result.Frames, frame)
+	d.matched++
+
+	if d.limit.Frames > 0 && d.matched >= d.limit.Frames {
+		d.done = true
+	}
+
+	if d.limit.Duration > 0 {
+		elapsed := TimeBase.Seconds((frame.Pts - s.first) & (1<<TimestampBits - 1))
+		s.covered = elapsed >= d.limit.Duration
+		// A selected stream silent for twice the window is not coming
+		d.done = d.done || d.allCovered() || elapsed >= 2*d.limit.Duration
+	}
+}
+
+func (d *Demuxer) allCovered() bool {
+	for _, s := range d.order {
+		if s.selected && !s.covered {
+			return false
+		}
+	}
+	return true
+}
+
+var adtsRates = []int{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+// adtsSamples counts the audio samples of the ADTS frames in an AAC PES.
+func adtsSamples(data []byte) (samples int, rate int) {
+	for len(data) >= 7 && data[0] == 0xff && data[1]&0xf0 == 0xf0 {
+		index := int(data[2] >> 2 & 0xf)
+		length := int(data[3]&0x3)<<11 | int(data[4])<<3 | int(data[5])>>5
+		if index >= len(adtsRates) || length < 7 {
+			break
+		}
+
+		rate = adtsRates[index]
+		samples += 1024 * (int(data[6]&0x3) + 1)
+
+		if length > len(data) {
+			break
+		}
+		data = data[length:]
+	}
+	return samples, rate
+}
+
+var lpcmRates = map[int]int{1: 48000, 4: 96000, 5: 192000}
+
+// lpcmChannels is the number of channels stored for each channel
+// assignment, odd counts are padded to an even one.
+var lpcmChannels = []int{0, 2, 0, 2, 4, 4, 4, 4, 6, 8, 8, 8}
+
+// lpcmSamples counts the samples of a Blu-ray LPCM PES from its 4-byte
+// header: payload size, channel assignment, sample rate and depth.
+func lpcmSamples(data []byte) (samples int, rate int) {
+	if len(data) < 4 {
+		return 0, 0
+	}
+
+	size := int(data[0])<<8 | int(data[1])
+	assignment := int(data[2] >> 4)
+	depth := []int{0, 2, 3, 3}[data[3]>>6]
+
+	if assignment >= len(lpcmChannels) || lpcmChannels[assignment] == 0 || depth == 0 {
+		return 0, 0
+	}
+
+	return size / (lpcmChannels[assignment] * depth), lpcmRates[int(data[2]&0xf)]
+}
+
+// Result flushes the frames still being received and returns what was
+// demultiplexed, with the timestamps and PCR unwrapped past their 33-bit
+// rollover.
+func (d *Demuxer) Result() (*Result, error) {
+	if len(d.order) == 0 {
+		return nil, ErrNoProgram
+	}
+
+	for _, s := range d.order {
+		d.emit(s)
+	}
+
+	d.result.Streams = nil
+	for _, s := range d.order {
+		if s.selected {
+			d.result.Streams = append(d.result.Streams, s.info)
+		}
+	}
+
+	d.result.Unwrap(TimestampBits, ClockRate)
+
+	pcr := probe.NewUnwrapper(1 << TimestampBits * (PCRRate / ClockRate))
+	for i := range d.result.PCRs {
+		d.result.PCRs[i].Value = pcr.Unwrap(d.result.PCRs[i].Value)
+	}
+
+	return &d.result, nil
+}
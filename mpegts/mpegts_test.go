@@ -0,0 +1,398 @@
+package mpegts
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+const (
+	// payloadSize is what follows the header of a packet.
+	payloadSize = PacketSize - 4
+
+	testPMT   = 0x1000
+	testVideo = 0x0100
+	testAudio = 0x0101
+)
+
+// packet builds a transport stream packet. The adaptation field, given
+// without its length byte, is padded with stuffing up to the payload; one
+// is added when the payload does not fill the packet.
+func packet(pid int, start bool, counter byte, field []byte, payload []byte) []byte {
+	p := []byte{syncByte, byte(pid>>8) & 0x1f, byte(pid), counter & 0xf}
+	if start {
+		p[1] |= 0x40
+	}
+	if len(payload) > 0 {
+		p[3] |= 0x10
+	}
+
+	if field != nil || len(payload) < payloadSize {
+		p[3] |= 0x20
+		length := payloadSize - 1 - len(payload)
+		if field == nil && length > 0 {
+			field = []byte{0}
+		}
+		p = append(p, byte(length))
+		p = append(p, field...)
+		for len(p) < 5+length {
+			p = append(p, 0xff)
+		}
+	}
+
+	return append(p, payload...)
+}
+
+// psiSection returns a version 0 section of program 1 around body. The
+// demuxer does not check the CRC, left zero.
+func psiSection(tableID byte, body []byte) []byte {
+	length := 5 + len(body) + 4
+	s := append([]byte{tableID, 0xb0 | byte(length>>8), byte(length), 0x00, 0x01, 0xc1, 0x00, 0x00}, body...)
+	return append(s, 0, 0, 0, 0)
+}
+
+func patSection() []byte {
+	return psiSection(0x00, []byte{0x00, 0x01, 0xe0 | testPMT>>8, testPMT & 0xff})
+}
+
+// pmtSection lists an H.264 video stream carrying the PCR, with the given
+// descriptors, and an AAC audio stream.
+func pmtSection(videoDescriptors []byte) []byte {
+	body := []byte{0xe0 | testVideo>>8, testVideo & 0xff, 0xf0, 0x00}
+	body = append(body, 0x1b, 0xe0|testVideo>>8, testVideo&0xff, 0xf0|byte(len(videoDescriptors)>>8), byte(len(videoDescriptors)))
+	body = append(body, videoDescriptors...)
+	body = append(body, 0x0f, 0xe0|testAudio>>8, testAudio&0xff, 0xf0, 0x00)
+	return psiSection(0x02, body)
+}
+
+// program returns the PAT and PMT, each in one packet.
+func program() [][]byte {
+	return [][]byte{
+		packet(0, true, 0, nil, append([]byte{0}, patSection()...)),
+		packet(testPMT, true, 0, nil, append([]byte{0}, pmtSection(nil)...)),
+	}
+}
+
+// adts returns n ADTS frames of 1024 samples at 48 kHz, 100 bytes each.
+func adts(n int) []byte {
+	const length = 100
+	frame := make([]byte, length)
+	copy(frame, []byte{0xff, 0xf1, 0x4c, 0x80 | length>>11, length >> 3 & 0xff, length&7<<5 | 0x1f, 0xfc})
+	return bytes.Repeat(frame, n)
+}
+
+// pesStart returns the header of a PES of unbounded length with only a PTS.
+func pesStart(streamID byte, pts int64) []byte {
+	return []byte{0x00, 0x00, 0x01, streamID, 0x00, 0x00, 0x80, 0x80, 0x05,
+		0x21 | byte(pts>>29)&0x0e, byte(pts >> 22), byte(pts>>14) | 0x01, byte(pts >> 7), byte(pts<<1) | 0x01}
+}
+
+// audioPES returns the packets of an audio PES at pts, continuity counters
+// counting from counter.
+func audioPES(pts int64, counter byte, data []byte) [][]byte {
+	payload := append(pesStart(0xc0, pts), data...)
+
+	packets := [][]byte{}
+	for start := true; len(payload) > 0; start = false {
+		size := min(len(payload), payloadSize)
+		packets = append(packets, packet(testAudio, start, counter, nil, payload[:size]))
+		payload = payload[size:]
+		counter++
+	}
+	return packets
+}
+
+// demux feeds packets to a demuxer selecting every stream.
+func demux(t *testing.T, packets [][]byte) (*Result, error) {
+	t.Helper()
+
+	d := NewDemuxer("", Limit{})
+	for i, p := range packets {
+		if err := d.Feed(p, time.Time{}); err != nil {
+			t.Fatalf("packet %d: %v", i, err)
+		}
+	}
+	return d.Result()
+}
+
+func concat(groups ...[][]byte) [][]byte {
+	packets := [][]byte{}
+	for _, g := range groups {
+		packets = append(packets, g...)
+	}
+	return packets
+}
+
+func TestParsePCR(t *testing.T) {
+	// base 0x123456789, extension 0x12a
+	got := parsePCR([]byte{0x91, 0xa2, 0xb3, 0xc4, 0xff, 0x2a})
+	if want := int64(0x123456789*300 + 0x12a); got != want {
+		t.Errorf("PCR %d, want %d", got, want)
+	}
+}
+
+func TestFeedPCR(t *testing.T) {
+	pcr := []byte{0x10, 0x91, 0xa2, 0xb3, 0xc4, 0xff, 0x2a}
+	// A PCR on another PID than the one the PMT names is not the clock
+	stray := append([]byte{}, pcr...)
+
+	result, err := demux(t, concat(program(), [][]byte{
+		packet(testVideo, false, 0, pcr, nil),
+		packet(testAudio, false, 0, stray, nil),
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.PCRPid != testVideo {
+		t.Errorf("PCR PID %#x, want %#x", result.PCRPid, testVideo)
+	}
+	if len(result.PCRs) != 1 {
+		t.Fatalf("%d PCRs, want 1", len(result.PCRs))
+	}
+	if got := result.PCRs[0]; got.Value != 0x123456789*300+0x12a || got.Pos != 2*PacketSize {
+		t.Errorf("PCR %d at %d", got.Value, got.Pos)
+	}
+}
+
+func TestFeedPTSAndDTS(t *testing.T) {
+	// PTS 903003 and DTS 900000, PES_header_data_length 10
+	header := []byte{0x00, 0x00, 0x01, 0xe0, 0x00, 0x00, 0x84, 0xc0, 0x0a,
+		0x31, 0x00, 0x37, 0x8e, 0xb7,
+		0x11, 0x00, 0x37, 0x77, 0x41}
+	randomAccess := []byte{0x40}
+
+	result, err := demux(t, concat(program(), [][]byte{
+		packet(testVideo, true, 0, randomAccess, append(header, 0, 0, 0, 1, 0x65)),
+		packet(testVideo, true, 1, nil, pesStart(0xe0, 906006)),
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(result.Frames) != 2 {
+		t.Fatalf("%d frames, want 2", len(result.Frames))
+	}
+
+	first, second := result.Frames[0], result.Frames[1]
+	if first.Pts != 903003 || first.PktDts != 900000 || !first.KeyFrame || first.Pos != 2*PacketSize {
+		t.Errorf("first frame PTS %d, DTS %d, key %v at %d", first.Pts, first.PktDts, first.KeyFrame, first.Pos)
+	}
+	// Without a DTS the decoding time is the presentation time
+	if second.Pts != 906006 || second.PktDts != 906006 || second.KeyFrame {
+		t.Errorf("second frame PTS %d, DTS %d, key %v", second.Pts, second.PktDts, second.KeyFrame)
+	}
+}
+
+func TestFeedSplitSections(t *testing.T) {
+	// A descriptor long enough to push the PMT over one packet
+	descriptors := append([]byte{0x99, 200}, make([]byte, 200)...)
+	pmt := append([]byte{0}, pmtSection(descriptors)...)
+	pat := patSection()
+
+	tests := []struct {
+		name    string
+		packets [][]byte
+		wantErr error
+	}{
+		{
+			name: "PMT over two packets",
+			packets: [][]byte{
+				packet(0, true, 0, nil, append([]byte{0}, pat...)),
+				packet(testPMT, true, 0, nil, pmt[:payloadSize]),
+				packet(testPMT, false, 1, nil, pmt[payloadSize:]),
+			},
+		},
+		{
+			// The pointer field skips the end of the section started in
+			// the previous packet
+			name: "PAT ended before the pointer",
+			packets: [][]byte{
+				packet(0, true, 0, nil, append([]byte{0}, pat[:5]...)),
+				packet(0, true, 1, nil, append(append([]byte{byte(len(pat) - 5)}, pat[5:]...), pat...)),
+				packet(testPMT, true, 0, nil, pmt[:payloadSize]),
+				packet(testPMT, false, 1, nil, pmt[payloadSize:]),
+			},
+		},
+		{
+			name: "PMT continuation lost",
+			packets: [][]byte{
+				packet(0, true, 0, nil, append([]byte{0}, pat...)),
+				packet(testPMT, true, 0, nil, pmt[:payloadSize]),
+				packet(testPMT, false, 2, nil, pmt[payloadSize:]),
+			},
+			wantErr: ErrNoProgram,
+		},
+		{
+			name: "PMT never completed",
+			packets: [][]byte{
+				packet(0, true, 0, nil, append([]byte{0}, pat...)),
+				packet(testPMT, true, 0, nil, pmt[:payloadSize]),
+			},
+			wantErr: ErrNoProgram,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := demux(t, tt.packets)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("error %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(result.Streams) != 2 || result.Streams[0].CodecType != "video" || result.Streams[1].CodecType != "audio" {
+				t.Errorf("streams %+v", result.Streams)
+			}
+			if result.PCRPid != testVideo {
+				t.Errorf("PCR PID %#x, want %#x", result.PCRPid, testVideo)
+			}
+		})
+	}
+}
+
+func TestSection(t *testing.T) {
+	pat := patSection()
+
+	tests := []struct {
+		name    string
+		data    []byte
+		tableID byte
+		want    int
+	}{
+		{"PAT", pat, 0x00, 4},
+		{"stuffing after the section", append(append([]byte{}, pat...), 0xff, 0xff), 0x00, 4},
+		{"other table", pat, 0x02, -1},
+		{"truncated", pat[:len(pat)-1], 0x00, -1},
+		{"too short to hold a header", []byte{0x00, 0xb0}, 0x00, -1},
+		{"length below the header", []byte{0x00, 0xb0, 0x08, 0, 1, 0xc1, 0, 0, 0, 0, 0}, 0x00, -1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := section(tt.data, tt.tableID)
+			if tt.want < 0 {
+				if body != nil {
+					t.Errorf("body % x, want none", body)
+				}
+				return
+			}
+			if len(body) != tt.want {
+				t.Errorf("body % x, want %d bytes", body, tt.want)
+			}
+		})
+	}
+}
+
+func TestFeedContinuity(t *testing.T) {
+	const pts = 900000
+	pes := audioPES(pts, 0, adts(2))
+	next := audioPES(pts+3840, 2, adts(1))
+
+	tests := []struct {
+		name     string
+		packets  [][]byte
+		duration int64
+	}{
+		{"complete", concat(pes, next), 3840},
+		// The counter goes from 15 to 0 within the first PES
+		{"counter wrapping", concat(audioPES(pts, 15, adts(2)), audioPES(pts+3840, 1, adts(1))), 3840},
+		// 2048 samples, not twice as many
+		{"duplicate packet", concat(pes, pes[1:], next), 3840},
+		{"packet lost", concat(pes[:1], next), 0},
+		{
+			name: "discontinuity indicator",
+			packets: concat(pes[:1], [][]byte{
+				packet(testAudio, false, 9, []byte{0x80}, pes[1][PacketSize-payloadSize+1+int(pes[1][4]):]),
+			}, audioPES(pts+3840, 10, adts(1))),
+			duration: 3840,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := demux(t, concat(program(), tt.packets))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(result.Frames) != 2 {
+				t.Fatalf("%d frames, want 2", len(result.Frames))
+			}
+			if got := result.Frames[0]; got.Pts != pts || got.Duration != tt.duration {
+				t.Errorf("frame at %d lasting %d, want %d lasting %d", got.Pts, got.Duration, pts, tt.duration)
+			}
+			if got := result.Frames[1]; got.Duration != 1920 {
+				t.Errorf("next frame lasting %d, want 1920", got.Duration)
+			}
+		})
+	}
+}
+
+func TestFeedErrors(t *testing.T) {
+	good := program()[0]
+
+	bad := append([]byte{}, good...)
+	bad[0] = 0x00
+
+	if err := NewDemuxer("", Limit{}).Feed(good[:PacketSize-1], time.Time{}); !errors.Is(err, ErrSync) {
+		t.Errorf("short packet: error %v, want %v", err, ErrSync)
+	}
+	if err := NewDemuxer("", Limit{}).Feed(bad, time.Time{}); !errors.Is(err, ErrSync) {
+		t.Errorf("no sync byte: error %v, want %v", err, ErrSync)
+	}
+
+	// transport_error_indicator set on the PAT
+	damaged := append([]byte{}, good...)
+	damaged[1] |= 0x80
+	if _, err := demux(t, concat([][]byte{damaged}, program()[1:])); !errors.Is(err, ErrNoProgram) {
+		t.Errorf("damaged PAT: error %v, want %v", err, ErrNoProgram)
+	}
+}
+
+func TestDemuxReaderResync(t *testing.T) {
+	var input bytes.Buffer
+
+	// Garbage holding a lone sync byte, then the tables
+	input.Write([]byte{0x00, syncByte, 0x12, 0x34})
+	for _, p := range program() {
+		input.Write(p)
+	}
+
+	for i := range 5 {
+		pes := audioPES(900000+int64(i)*1920, byte(i), adts(1))[0]
+		if i == 2 {
+			// A packet cut short: its frame is lost, the next one is read
+			pes = pes[:100]
+		}
+		input.Write(pes)
+	}
+
+	d := NewDemuxer("a", Limit{})
+	if err := demuxReader(context.Background(), bufio.NewReader(&input), d); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := d.Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []int64{900000, 900000 + 1920, 900000 + 3*1920, 900000 + 4*1920}
+	if len(result.Frames) != len(want) {
+		t.Fatalf("%d frames, want %d", len(result.Frames), len(want))
+	}
+	for i, frame := range result.Frames {
+		if frame.Pts != want[i] {
+			t.Errorf("frame %d at %d, want %d", i, frame.Pts, want[i])
+		}
+	}
+}
@@ -0,0 +1,275 @@
+package mpegts
+
+import (
+	"io"
+)
+
+const (
+	patPid = 0x0000
+	pmtPid = 0x1000
+	// firstPid is the PID of the first elementary stream, the next ones
+	// follow.
+	firstPid = 0x0100
+
+	packetPayload = PacketSize - 4
+)
+
+// MuxStream describes an elementary stream of the program.
+type MuxStream struct {
+	StreamType byte
+	// StreamID is the PES stream_id, 0xe0 for video, 0xc0 for MPEG audio,
+	// 0xbd for private streams.
+	StreamID    byte
+	Descriptors []byte
+
+	pid        int
+	continuity byte
+}
+
+// MuxFrame is one access unit to write. PCR, when HasPCR is set, goes in
+// the first packet, which must then belong to the PCR stream, the first
+// one. Discontinuity flags a jump of the timestamps or of the PCR.
+type MuxFrame struct {
+	Stream        int
+	PTS           int64
+	DTS           int64
+	HasDTS        bool
+	PCR           int64
+	HasPCR        bool
+	RandomAccess  bool
+	Discontinuity bool
+	Data          []byte
+}
+
+// Muxer writes a single program transport stream. The PAT and PMT open
+// the stream and are repeated before every random access frame of the
+// first stream, so a reader can join there. The first stream carries the
+// PCR.
+type Muxer struct {
+	w       io.Writer
+	streams []*MuxStream
+	// ProgramDescriptors go in the program info loop of the PMT.
+	ProgramDescriptors []byte
+
+	patContinuity byte
+	pmtContinuity byte
+	started       bool
+	packet        [PacketSize]byte
+}
+
+func NewMuxer(w io.Writer) *Muxer {
+	return &Muxer{w: w}
+}
+
+// AddStream adds an elementary stream and returns its index for
+// MuxFrame.Stream. Streams must all be added before the first frame.
+func (m *Muxer) AddStream(s MuxStream) int {
+	s.pid = firstPid + len(m.streams)
+	m.streams = append(m.streams, &s)
+	return len(m.streams) - 1
+}
+
+// WriteFrame writes a frame as one PES packet, preceded by the PAT and
+// PMT when it is the first frame or a random access frame of the first
+// stream.
+func (m *Muxer) WriteFrame(f MuxFrame) error {
+	if !m.started || f.Stream == 0 && f.RandomAccess {
+		m.started = true
+		if err := m.writeTables(); err != nil {
+			return err
+		}
+	}
+
+	s := m.streams[f.Stream]
+	data := append(pesHeader(s.StreamID, f), f.Data...)
+
+	for first := true; first || len(data) > 0; first = false {
+		var field []byte
+		if first {
+			field = adaptationField(f)
+		}
+
+		size := len(data)
+		switch {
+		case field != nil:
+			size = min(size, packetPayload-1-len(field))
+		case size == packetPayload-1:
+			// An adaptation field of just its length byte pads one byte
+			field = []byte{}
+		case size < packetPayload:
+			// An adaptation field carries the stuffing
+			field = []byte{0}
+		default:
+			size = packetPayload
+		}
+
+		if err := m.writePacket(s.pid, &s.continuity, first, field, data[:size]); err != nil {
+			return err
+		}
+		data = data[size:]
+	}
+
+	return nil
+}
+
+// WritePCR writes a packet carrying only a PCR on the first stream, to keep
+// the PCR interval short between frames.
+func (m *Muxer) WritePCR(pcr int64, discontinuity bool) error {
+	s := m.streams[0]
+	return m.writePacket(s.pid, &s.continuity, false, adaptationField(MuxFrame{PCR: pcr, HasPCR: true, Discontinuity: discontinuity}), nil)
+}
+
+// writePacket writes one packet with the given adaptation field, without
+// its length byte, padded with stuffing bytes to fill the packet. A nil
+// field leaves the adaptation field out, the payload must then fill the
+// packet.
+func (m *Muxer) writePacket(pid int, continuity *byte, start bool, field []byte, payload []byte) error {
+	p := m.packet[:]
+	p[0] = syncByte
+	p[1] = byte(pid >> 8 & 0x1f)
+	if start {
+		p[1] |= 0x40
+	}
+	p[2] = byte(pid)
+
+	control := byte(0)
+	if len(payload) > 0 {
+		control |= 0x1
+	}
+	if field != nil {
+		control |= 0x2
+	}
+	p[3] = control<<4 | *continuity&0xf
+	// The counter only counts packets with a payload
+	if len(payload) > 0 {
+		*continuity++
+	}
+
+	i := 4
+	if field != nil {
+		length := packetPayload - 1 - len(payload)
+		p[4] = byte(length)
+		i += 1 + copy(p[5:], field)
+		for ; i < 5+length; i++ {
+			p[i] = 0xff
+		}
+	}
+	copy(p[i:], payload)
+
+	_, err := m.w.Write(p)
+	return err
+}
+
+// adaptationField returns the flags and PCR of the first packet of f, nil
+// when it needs none.
+func adaptationField(f MuxFrame) []byte {
+	flags := byte(0)
+	if f.Discontinuity {
+		flags |= 0x80
+	}
+	if f.RandomAccess {
+		flags |= 0x40
+	}
+	if f.HasPCR {
+		flags |= 0x10
+	}
+	if flags == 0 {
+		return nil
+	}
+
+	field := []byte{flags}
+	if f.HasPCR {
+		base := f.PCR / 300 & (1<<TimestampBits - 1)
+		extension := f.PCR % 300
+		field = append(field, byte(base>>25), byte(base>>17), byte(base>>9), byte(base>>1),
+			byte(base&1)<<7|0x7e|byte(extension>>8), byte(extension))
+	}
+	return field
+}
+
+func pesHeader(streamID byte, f MuxFrame) []byte {
+	flags := byte(0x80)
+	length := 5
+	if f.HasDTS {
+		flags = 0xc0
+		length = 10
+	}
+
+	header := []byte{0, 0, 1, streamID, 0, 0, 0x84, flags, byte(length)}
+	if f.HasDTS {
+		header = append(header, timestamp(0x3, f.PTS)...)
+		header = append(header, timestamp(0x1, f.DTS)...)
+	} else {
+		header = append(header, timestamp(0x2, f.PTS)...)
+	}
+
+	// Video PES may leave the length unset, other streams must fit
+	if size := len(header) - 6 + len(f.Data); size <= 0xffff {
+		header[4], header[5] = byte(size>>8), byte(size)
+	}
+	return header
+}
+
+// timestamp encodes a PTS or DTS with its 4-bit prefix, wrapped to 33 bits.
+func timestamp(prefix byte, ts int64) []byte {
+	ts &= 1<<TimestampBits - 1
+	return []byte{
+		prefix<<4 | byte(ts>>29&0xe) | 1,
+		byte(ts >> 22),
+		byte(ts>>14&0xfe) | 1,
+		byte(ts >> 7),
+		byte(ts<<1) | 1,
+	}
+}
+
+func (m *Muxer) writeTables() error {
+	pat := []byte{0x00, 0x01, 0xe0 | pmtPid>>8, pmtPid & 0xff}
+	if err := m.writeSection(patPid, &m.patContinuity, 0x00, pat); err != nil {
+		return err
+	}
+
+	pcrPid := firstPid
+	pmt := []byte{0xe0 | byte(pcrPid>>8), byte(pcrPid), 0xf0 | byte(len(m.ProgramDescriptors)>>8), byte(len(m.ProgramDescriptors))}
+	pmt = append(pmt, m.ProgramDescriptors...)
+	for _, s := range m.streams {
+		pmt = append(pmt, s.StreamType, 0xe0|byte(s.pid>>8), byte(s.pid), 0xf0|byte(len(s.Descriptors)>>8), byte(len(s.Descriptors)))
+		pmt = append(pmt, s.Descriptors...)
+	}
+	return m.writeSection(pmtPid, &m.pmtContinuity, 0x02, pmt)
+}
+
+// writeSection writes a PSI section of the first program, version 0, in a
+// single packet.
+func (m *Muxer) writeSection(pid int, continuity *byte, tableID byte, data []byte) error {
+	length := 5 + len(data) + 4
+	section := []byte{tableID, 0xb0 | byte(length>>8), byte(length), 0x00, 0x01, 0xc1, 0x00, 0x00}
+	section = append(section, data...)
+
+	crc := crc32(section)
+	section = append(section, byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc))
+
+	payload := make([]byte, packetPayload)
+	copy(payload[1:], section)
+	for i := 1 + len(section); i < len(payload); i++ {
+		payload[i] = 0xff
+	}
+
+	return m.writePacket(pid, continuity, true, nil, payload)
+}
+
+// crc32 is the MPEG-2 CRC of PSI sections: polynomial 0x04c11db7, not
+// reflected, starting at all ones.
+func crc32(data []byte) uint32 {
+	crc := uint32(0xffffffff)
+	for _, b := range data {
+		crc ^= uint32(b) << 24
+		for range 8 {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
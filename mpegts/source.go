@@ -0,0 +1,156 @@
+package mpegts
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"find_desync/credentials"
+)
+
+// IsTransportStream reports whether url names a source this package reads:
+// a udp:// URL or a .ts, .m2ts or .mts file.
+func IsTransportStream(url string) bool {
+	if strings.HasPrefix(strings.ToLower(url), "udp://") {
+		return true
+	}
+
+	switch strings.ToLower(filepath.Ext(url)) {
+	case ".ts", ".m2ts", ".mts":
+		return !strings.Contains(url, "://")
+	}
+	return false
+}
+
+// Demux feeds d from the file or udp:// URL until d is done, the input
+// ends or ctx is done. On UDP, idle bounds the wait for the next datagram;
+// zero waits as long as ctx allows.
+func Demux(ctx context.Context, url string, d *Demuxer, idle time.Duration) error {
+	if strings.HasPrefix(strings.ToLower(url), "udp://") {
+		return demuxUDP(ctx, url, d, idle)
+	}
+
+	file, err := os.Open(url)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return demuxReader(ctx, bufio.NewReaderSize(file, 64*PacketSize), d)
+}
+
+func demuxReader(ctx context.Context, r *bufio.Reader, d *Demuxer) error {
+	packet := make([]byte, PacketSize)
+
+	for n := 0; !d.Done(); n++ {
+		// Checking every packet would cost more than the parsing
+		if n%1024 == 0 && ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if err := resync(r); err != nil {
+			return eof(err)
+		}
+
+		if _, err := io.ReadFull(r, packet); err != nil {
+			return eof(err)
+		}
+
+		if err := d.Feed(packet, time.Time{}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// resync skips bytes until the next one is a sync byte followed by another
+// one a packet further, or by the end of the input. A single sync byte may
+// be payload, or start a truncated packet.
+func resync(r *bufio.Reader) error {
+	for {
+		b, err := r.Peek(PacketSize + 1)
+		if len(b) == 0 {
+			return err
+		}
+		if b[0] == syncByte && (len(b) <= PacketSize || b[PacketSize] == syncByte) {
+			return nil
+		}
+		r.Discard(1)
+	}
+}
+
+func eof(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil
+	}
+	return err
+}
+
+// udpAddress turns udp://[@]host:port[?options] into host:port.
+func udpAddress(url string) string {
+	address := url[len("udp://"):]
+	address, _, _ = strings.Cut(address, "?")
+	return strings.TrimPrefix(address, "@")
+}
+
+func demuxUDP(ctx context.Context, url string, d *Demuxer, idle time.Duration) error {
+	address, err := net.ResolveUDPAddr("udp", udpAddress(url))
+	if err != nil {
+		return err
+	}
+
+	var conn *net.UDPConn
+	if address.IP != nil && address.IP.IsMulticast() {
+		conn, err = net.ListenMulticastUDP("udp", nil, address)
+	} else {
+		conn, err = net.ListenUDP("udp", address)
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	datagram := make([]byte, 65536)
+
+	for !d.Done() {
+		if idle > 0 {
+			conn.SetReadDeadline(time.Now().Add(idle))
+		}
+
+		n, _, err := conn.ReadFrom(datagram)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("read %s: %w", credentials.Mask(url), err)
+		}
+
+		received := time.Now()
+		data := datagram[:n]
+
+		// Skip the RTP header of TS over RTP
+		if n%PacketSize == 12 && data[0]&0xc0 == 0x80 {
+			data = data[12:]
+		}
+
+		for len(data) >= PacketSize && !d.Done() {
+			if err := d.Feed(data[:PacketSize], received); err != nil {
+				return err
+			}
+			data = data[PacketSize:]
+		}
+	}
+
+	return nil
+}
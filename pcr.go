@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+
+	"find_desync/analysis"
+	"find_desync/mpegts"
+	"find_desync/probe"
+
+	"github.com/fatih/color"
+	"github.com/rodaine/table"
+)
+
+// Clock verdicts of the pcr method: which clock the audio/video offset comes
+// from.
+const (
+	ClockInSync       = "in sync"
+	ClockEncoderDrift = "encoder clock drift"
+	ClockPCRDrift     = "pcr drift"
+	ClockVideoDrift   = "video stream drift"
+	ClockAudioDrift   = "audio stream drift"
+)
+
+// ClockInfo holds a PCR measurement of an MPEG-TS source. Video and Audio
+// fit the PTS of each stream minus the PCR at the packet carrying it: the
+// intercept is the decoder buffer delay and the slope how fast the stream
+// leaves the program clock. Arrival fits the PCR against the local clock and
+// is only set for network sources. Jitter is the spread of the PCR around
+// the arrival time, or around the byte position when JitterCBR is set:
+// files have no arrival time and only a constant bit rate makes the
+// position a clock.
+type ClockInfo struct {
+	ApartName    string
+	CameraHash   string
+	Source       string
+	PCRPid       int
+	PCRs         int
+	MeanInterval float64
+	MaxInterval  float64
+	Jitter       float64
+	JitterCBR    bool
+	Arrival      *analysis.DriftEstimate
+	Video        analysis.DriftEstimate
+	Audio        analysis.DriftEstimate
+	VideoFrames  int
+	AudioFrames  int
+	Verdict      string
+}
+
+func NewClockInfo(apartName, uri string) ClockInfo {
+	return ClockInfo{
+		ApartName:  apartName,
+		CameraHash: CameraID(uri),
+		Source:     Redact(uri),
+	}
+}
+
+// Offset is the audio minus video offset implied by the buffer delays.
+func (c ClockInfo) Offset() float64 {
+	return c.Audio.Intercept - c.Video.Intercept
+}
+
+// maxPCRInterval is the longest PCR gap ISO/IEC 13818-1 allows.
+const maxPCRInterval = 0.1
+
+var ErrNotTransportStream = errors.New("the pcr method needs an MPEG-TS source (.ts file or udp://)")
+
+// PCRClock reads the PCR and the PES timestamps of a transport stream and
+// tells apart an encoder clock drifting against real time, a PCR the
+// elementary streams do not follow, and a single stream stamped off clock.
+func (a *Analyzer) PCRClock(ctx context.Context, uri string, count int, apart string, useTime bool) (ClockInfo, error) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+
+	if !a.nativeDemux(uri) {
+		return ClockInfo{}, ErrNotTransportStream
+	}
+
+	result, err := a.demuxTS(ctx, ProbeRequest{URL: uri, ReadIntervals: readIntervals(count, useTime, 2)})
+	if err != nil {
+		logger.Error(fmt.Sprintf("Error demuxing: %v", err))
+		return ClockInfo{}, err
+	}
+
+	clockInfo := NewClockInfo(apart, uri)
+	clockInfo.PCRPid = result.PCRPid
+	clockInfo.PCRs = len(result.PCRs)
+
+	samples := clockSamples(result.PCRs)
+	if len(samples) < 3 {
+		return ClockInfo{}, fmt.Errorf("only %d PCR samples on pid %d: %w", len(samples), result.PCRPid, analysis.ErrNotEnoughSamples)
+	}
+
+	clockInfo.MeanInterval, clockInfo.MaxInterval = analysis.ClockIntervals(samples)
+
+	if clockInfo.Jitter, clockInfo.JitterCBR, err = analysis.ClockJitter(samples); err != nil {
+		return ClockInfo{}, err
+	}
+
+	if !result.PCRs[0].Received.IsZero() {
+		if arrival, err := analysis.ArrivalDrift(samples); err == nil {
+			clockInfo.Arrival = &arrival
+		}
+	}
+
+	video := result.Select(probe.Video)
+	audio := result.Select(probe.Audio)
+	clockInfo.VideoFrames = len(video)
+	clockInfo.AudioFrames = len(audio)
+
+	if clockInfo.Video, err = analysis.TimestampsAgainstClock(samples, positions(video), ptsTimes(video)); err != nil {
+		return ClockInfo{}, fmt.Errorf("video against PCR: %w", err)
+	}
+
+	if clockInfo.Audio, err = analysis.TimestampsAgainstClock(samples, positions(audio), ptsTimes(audio)); err != nil {
+		return ClockInfo{}, fmt.Errorf("audio against PCR: %w", err)
+	}
+
+	clockInfo.Verdict = classifyClock(clockInfo)
+
+	a.printClock(clockInfo)
+
+	return clockInfo, nil
+}
+
+func clockSamples(pcrs []mpegts.PCR) []analysis.ClockSample {
+	samples := make([]analysis.ClockSample, len(pcrs))
+	if len(pcrs) == 0 {
+		return samples
+	}
+
+	start := pcrs[0].Received
+	for i, pcr := range pcrs {
+		arrival := math.NaN()
+		if !pcr.Received.IsZero() {
+			arrival = pcr.Received.Sub(start).Seconds()
+		}
+		samples[i] = analysis.ClockSample{Pos: float64(pcr.Pos), Clock: pcr.Seconds(), Arrival: arrival}
+	}
+	return samples
+}
+
+func positions(frames []probe.Frame) []float64 {
+	result := make([]float64, len(frames))
+	for i, f := range frames {
+		result[i] = float64(f.Pos)
+	}
+	return result
+}
+
+func ptsTimes(frames []probe.Frame) []float64 {
+	result := make([]float64, len(frames))
+	for i, f := range frames {
+		result[i] = f.PtsTime()
+	}
+	return result
+}
+
+// classifyClock blames the encoder clock when the PCR drifts against the
+// arrival time, the PCR when both streams leave it at the same rate, and a
+// single stream when only that one does. The jitter plays no part: measured
+// against the byte position it only holds on a constant bit rate.
+func classifyClock(c ClockInfo) string {
+	if c.Arrival != nil && c.Arrival.Classify(driftResolution) == analysis.ProgressiveDrift {
+		return ClockEncoderDrift
+	}
+
+	videoDrifts := c.Video.Classify(driftResolution) == analysis.ProgressiveDrift
+	audioDrifts := c.Audio.Classify(driftResolution) == analysis.ProgressiveDrift
+
+	switch {
+	case videoDrifts && audioDrifts:
+		// Both streams leaving the PCR the same way means the PCR is off,
+		// otherwise blame the stream leaving it faster
+		if c.Video.SlopeLow <= c.Audio.SlopeHigh && c.Audio.SlopeLow <= c.Video.SlopeHigh {
+			return ClockPCRDrift
+		}
+		if math.Abs(c.Video.Slope) > math.Abs(c.Audio.Slope) {
+			return ClockVideoDrift
+		}
+		return ClockAudioDrift
+	case videoDrifts:
+		return ClockVideoDrift
+	case audioDrifts:
+		return ClockAudioDrift
+	}
+	return ClockInSync
+}
+
+func (a *Analyzer) printClock(c ClockInfo) {
+	fmt.Fprintf(a.out, "\n=== PCR: %s ===\n", c.Source)
+	fmt.Fprintf(a.out, "PCR pid:             %d, %d samples\n", c.PCRPid, c.PCRs)
+	fmt.Fprintf(a.out, "PCR interval:        %.1f ms mean, %.1f ms max\n", c.MeanInterval*1000, c.MaxInterval*1000)
+	if c.MaxInterval > maxPCRInterval {
+		a.yellow("PCR interval above %.0f ms", maxPCRInterval*1000)
+	}
+	if c.JitterCBR {
+		fmt.Fprintf(a.out, "PCR jitter:          %.3f ms (CBR-assumed)\n", c.Jitter*1000)
+	} else {
+		fmt.Fprintf(a.out, "PCR jitter:          %.3f ms\n", c.Jitter*1000)
+	}
+	if c.Arrival != nil {
+		fmt.Fprintf(a.out, "PCR against arrival: %.1f ppm (95%% CI %.1f .. %.1f)\n",
+			c.Arrival.PPM(), c.Arrival.SlopeLow*1e6, c.Arrival.SlopeHigh*1e6)
+	}
+
+	headerFmt := color.New(color.FgGreen, color.Underline).SprintfFunc()
+	columnFmt := color.New(color.FgYellow).SprintfFunc()
+
+	tbl := table.New("Stream", "Frames", "PTS - PCR", "Drift ppm", "95% CI", "Jitter ms")
+	tbl.WithHeaderFormatter(headerFmt).WithFirstColumnFormatter(columnFmt).WithWriter(a.out)
+
+	for _, row := range []struct {
+		name     string
+		frames   int
+		estimate analysis.DriftEstimate
+	}{{"video", c.VideoFrames, c.Video}, {"audio", c.AudioFrames, c.Audio}} {
+		tbl.AddRow(
+			row.name,
+			row.frames,
+			fmt.Sprintf("%.3f", row.estimate.Intercept),
+			fmt.Sprintf("%.1f", row.estimate.PPM()),
+			fmt.Sprintf("%.1f .. %.1f", row.estimate.SlopeLow*1e6, row.estimate.SlopeHigh*1e6),
+			fmt.Sprintf("%.3f", row.estimate.Residual*1000),
+		)
+	}
+
+	tbl.Print()
+
+	fmt.Fprintf(a.out, "Audio minus video:   %.3f seconds\n", c.Offset())
+
+	switch c.Verdict {
+	case ClockInSync:
+		a.green("\nBoth streams follow the PCR")
+	case ClockEncoderDrift:
+		a.red("\nENCODER CLOCK DRIFT: the PCR runs %.1f ppm off real time", c.Arrival.PPM())
+	case ClockPCRDrift:
+		a.red("\nPCR DRIFT: both streams leave the PCR at the same rate")
+	case ClockVideoDrift:
+		a.red("\nVIDEO STREAM DRIFT: video PTS leave the PCR at %.1f ppm", c.Video.PPM())
+	case ClockAudioDrift:
+		a.red("\nAUDIO STREAM DRIFT: audio PTS leave the PCR at %.1f ppm", c.Audio.PPM())
+	}
+}
@@ -0,0 +1,312 @@
+// Package probe runs ffprobe with JSON output and decodes the frames of the
+// probed source into a typed model shared by every analysis method.
+package probe
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// ShowEntries lists exactly the ffprobe fields the analyzers rely on. It is
+// passed to ffprobe as `-show_entries` together with `-of json`.
+const ShowEntries = "frame=media_type,stream_index,key_frame,pts,pkt_dts,duration,best_effort_timestamp,nb_samples,pkt_pos" +
+	":stream=index,codec_type,time_base,start_time"
+
+type MediaType string
+
+const (
+	Video MediaType = "video"
+	Audio MediaType = "audio"
+)
+
+// Rational is a time base such as 1/90000.
+type Rational struct {
+	Num int64
+	Den int64
+}
+
+func ParseRational(s string) (Rational, error) {
+	num, den, ok := strings.Cut(s, "/")
+	if !ok {
+		return Rational{}, fmt.Errorf("invalid time base %q", s)
+	}
+
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil {
+		return Rational{}, fmt.Errorf("invalid time base %q: %w", s, err)
+	}
+
+	d, err := strconv.ParseInt(den, 10, 64)
+	if err != nil || d == 0 {
+		return Rational{}, fmt.Errorf("invalid time base %q", s)
+	}
+
+	return Rational{Num: n, Den: d}, nil
+}
+
+// Seconds converts a timestamp expressed in this time base to seconds.
+func (r Rational) Seconds(ts int64) float64 {
+	if r.Den == 0 {
+		return 0
+	}
+	return float64(ts) * float64(r.Num) / float64(r.Den)
+}
+
+func (r Rational) String() string {
+	return fmt.Sprintf("%d/%d", r.Num, r.Den)
+}
+
+type Stream struct {
+	Index     int
+	CodecType MediaType
+	TimeBase  Rational
+	StartTime float64
+}
+
+// Frame is a single decoded frame. Timestamps are kept in stream time base
+// units; use PtsTime and DurationTime for values in seconds.
+type Frame struct {
+	// Number is the 1-based position of the frame within its stream.
+	Number int
+	// Arrival is the 0-based position of the frame in the probe output
+	// across all streams, i.e. the order in which ffprobe delivered it.
+	Arrival int
+	// Pos is the byte offset of the frame's first packet in the source,
+	// -1 when unknown.
+	Pos                 int64
+	StreamIndex         int
+	MediaType           MediaType
+	KeyFrame            bool
+	Pts                 int64
+	HasPts              bool
+	PktDts              int64
+	HasPktDts           bool
+	BestEffortTimestamp int64
+	Duration            int64
+	NbSamples           int
+	TimeBase            Rational
+}
+
+// PtsTime returns the presentation time in seconds, falling back to the
+// best effort timestamp when the frame carries no pts.
+func (f Frame) PtsTime() float64 {
+	if f.HasPts {
+		return f.TimeBase.Seconds(f.Pts)
+	}
+	return f.TimeBase.Seconds(f.BestEffortTimestamp)
+}
+
+func (f Frame) DurationTime() float64 {
+	return f.TimeBase.Seconds(f.Duration)
+}
+
+type Result struct {
+	Streams []Stream
+	Frames  []Frame
+}
+
+// Select returns the frames of the given media type in their original order.
+func (r *Result) Select(mediaType MediaType) []Frame {
+	frames := []Frame{}
+	for _, f := range r.Frames {
+		if f.MediaType == mediaType {
+			frames = append(frames, f)
+		}
+	}
+	return frames
+}
+
+// Unwrap undoes the rollover of timestamps counted by a bits wide counter at
+// rate Hz, such as the 33-bit 90 kHz PTS and DTS of MPEG-TS, so they keep
+// increasing across it. It returns the number of PTS rollovers corrected.
+func (r *Result) Unwrap(bits uint, rate int64) int {
+	type counters struct{ pts, dts, bestEffort Unwrapper }
+
+	streams := map[int]*counters{}
+	wraps := 0
+
+	for i := range r.Frames {
+		f := &r.Frames[i]
+
+		c, ok := streams[f.StreamIndex]
+		if !ok {
+			// The period in stream time base units
+			period := int64(math.Round(float64(int64(1)<<bits) * float64(f.TimeBase.Den) / float64(rate*f.TimeBase.Num)))
+			c = &counters{NewUnwrapper(period), NewUnwrapper(period), NewUnwrapper(period)}
+			streams[f.StreamIndex] = c
+		}
+
+		if f.HasPts {
+			before := c.pts.Wraps
+			f.Pts = c.pts.Unwrap(f.Pts)
+			wraps += c.pts.Wraps - before
+		}
+		if f.HasPktDts {
+			f.PktDts = c.dts.Unwrap(f.PktDts)
+		}
+		f.BestEffortTimestamp = c.bestEffort.Unwrap(f.BestEffortTimestamp)
+	}
+
+	return wraps
+}
+
+// Unwrapper extends a counter that rolls over every Period units. A jump
+// of more than half a period is taken as a rollover: backwards it is one,
+// forwards it is a late value from before the last one.
+type Unwrapper struct {
+	Period int64
+	// Wraps is the number of rollovers seen so far.
+	Wraps  int
+	offset int64
+	last   int64
+	seen   bool
+}
+
+func NewUnwrapper(period int64) Unwrapper {
+	return Unwrapper{Period: period}
+}
+
+// Unwrap returns ts extended past the rollovers seen so far.
+func (u *Unwrapper) Unwrap(ts int64) int64 {
+	if u.Period <= 0 {
+		return ts
+	}
+
+	if u.seen {
+		switch delta := ts - u.last; {
+		case delta < -u.Period/2:
+			u.offset += u.Period
+			u.Wraps++
+		case delta > u.Period/2:
+			// A value from before the rollover, keep the offset
+			return ts + u.offset - u.Period
+		}
+	}
+
+	u.last, u.seen = ts, true
+	return ts + u.offset
+}
+
+// Stream returns the first stream of the given media type.
+func (r *Result) Stream(mediaType MediaType) (Stream, bool) {
+	for _, s := range r.Streams {
+		if s.CodecType == mediaType {
+			return s, true
+		}
+	}
+	return Stream{}, false
+}
+
+type rawStream struct {
+	Index     int    `json:"index"`
+	CodecType string `json:"codec_type"`
+	TimeBase  string `json:"time_base"`
+	StartTime string `json:"start_time"`
+}
+
+type rawFrame struct {
+	MediaType           string `json:"media_type"`
+	StreamIndex         int    `json:"stream_index"`
+	KeyFrame            int    `json:"key_frame"`
+	Pts                 *int64 `json:"pts"`
+	PktDts              *int64 `json:"pkt_dts"`
+	Duration            *int64 `json:"duration"`
+	BestEffortTimestamp *int64 `json:"best_effort_timestamp"`
+	NbSamples           int    `json:"nb_samples"`
+	PktPos              string `json:"pkt_pos"`
+}
+
+type rawOutput struct {
+	Frames  []rawFrame  `json:"frames"`
+	Streams []rawStream `json:"streams"`
+}
+
+// Decode parses ffprobe JSON output produced with ShowEntries.
+func Decode(data []byte) (*Result, error) {
+	var raw rawOutput
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("decode ffprobe output: %w", err)
+	}
+
+	result := &Result{}
+	timeBases := map[int]Rational{}
+
+	for _, rs := range raw.Streams {
+		tb, err := ParseRational(rs.TimeBase)
+		if err != nil {
+			return nil, fmt.Errorf("stream %d: %w", rs.Index, err)
+		}
+
+		stream := Stream{
+			Index:     rs.Index,
+			CodecType: MediaType(rs.CodecType),
+			TimeBase:  tb,
+		}
+
+		if rs.StartTime != "" && rs.StartTime != "N/A" {
+			stream.StartTime, err = strconv.ParseFloat(rs.StartTime, 64)
+			if err != nil {
+				return nil, fmt.Errorf("stream %d: invalid start time %q", rs.Index, rs.StartTime)
+			}
+		}
+
+		timeBases[rs.Index] = tb
+		result.Streams = append(result.Streams, stream)
+	}
+
+	numbers := map[int]int{}
+
+	for _, rf := range raw.Frames {
+		tb, ok := timeBases[rf.StreamIndex]
+		if !ok {
+			return nil, fmt.Errorf("frame references unknown stream %d", rf.StreamIndex)
+		}
+
+		numbers[rf.StreamIndex]++
+
+		frame := Frame{
+			Number:      numbers[rf.StreamIndex],
+			Arrival:     len(result.Frames),
+			Pos:         -1,
+			StreamIndex: rf.StreamIndex,
+			MediaType:   MediaType(rf.MediaType),
+			KeyFrame:    rf.KeyFrame == 1,
+			NbSamples:   rf.NbSamples,
+			TimeBase:    tb,
+		}
+
+		if rf.Pts != nil {
+			frame.Pts = *rf.Pts
+			frame.HasPts = true
+		}
+		if rf.PktDts != nil {
+			frame.PktDts = *rf.PktDts
+			frame.HasPktDts = true
+		}
+		if rf.Duration != nil {
+			frame.Duration = *rf.Duration
+		}
+		if rf.BestEffortTimestamp != nil {
+			frame.BestEffortTimestamp = *rf.BestEffortTimestamp
+		}
+
+		if rf.PktPos != "" && rf.PktPos != "N/A" {
+			pos, err := strconv.ParseInt(rf.PktPos, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("frame %d of stream %d: invalid pkt_pos %q", frame.Number, rf.StreamIndex, rf.PktPos)
+			}
+			frame.Pos = pos
+		}
+
+		if !frame.HasPts && rf.BestEffortTimestamp == nil {
+			continue
+		}
+
+		result.Frames = append(result.Frames, frame)
+	}
+
+	return result, nil
+}
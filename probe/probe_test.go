@@ -0,0 +1,55 @@
+package probe
+
+import "testing"
+
+const fixture = `{
+	"frames": [
+		{"media_type": "video", "stream_index": 0, "key_frame": 1, "pts": 900000, "pkt_dts": 896400, "duration": 3600, "best_effort_timestamp": 900000, "pkt_pos": "564"},
+		{"media_type": "audio", "stream_index": 1, "key_frame": 1, "pts": 900900, "pkt_dts": 900900, "duration": 1920, "best_effort_timestamp": 900900, "nb_samples": 1024, "pkt_pos": "30268"},
+		{"media_type": "video", "stream_index": 0, "key_frame": 0, "best_effort_timestamp": 903600, "duration": 3600, "pkt_pos": "N/A"},
+		{"media_type": "audio", "stream_index": 1, "key_frame": 1, "duration": 1920, "nb_samples": 1024, "pkt_pos": "31208"}
+	],
+	"streams": [
+		{"index": 0, "codec_type": "video", "time_base": "1/90000", "start_time": "10.000000"},
+		{"index": 1, "codec_type": "audio", "time_base": "1/90000", "start_time": "10.010000"}
+	]
+}`
+
+func TestDecode(t *testing.T) {
+	result, err := Decode([]byte(fixture))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(result.Streams) != 2 || result.Streams[1].StartTime != 10.01 {
+		t.Errorf("streams %+v", result.Streams)
+	}
+
+	// The last audio frame has neither pts nor best effort timestamp
+	want := []Frame{
+		{Number: 1, Arrival: 0, Pos: 564, StreamIndex: 0, MediaType: Video, KeyFrame: true, Pts: 900000, HasPts: true, PktDts: 896400, HasPktDts: true, BestEffortTimestamp: 900000, Duration: 3600, TimeBase: Rational{1, 90000}},
+		{Number: 1, Arrival: 1, Pos: 30268, StreamIndex: 1, MediaType: Audio, KeyFrame: true, Pts: 900900, HasPts: true, PktDts: 900900, HasPktDts: true, BestEffortTimestamp: 900900, Duration: 1920, NbSamples: 1024, TimeBase: Rational{1, 90000}},
+		{Number: 2, Arrival: 2, Pos: -1, StreamIndex: 0, MediaType: Video, BestEffortTimestamp: 903600, Duration: 3600, TimeBase: Rational{1, 90000}},
+	}
+	if len(result.Frames) != len(want) {
+		t.Fatalf("%d frames, want %d", len(result.Frames), len(want))
+	}
+	for i, frame := range result.Frames {
+		if frame != want[i] {
+			t.Errorf("frame %d: %+v, want %+v", i, frame, want[i])
+		}
+	}
+
+	if got := result.Frames[2].PtsTime(); got != 10.04 {
+		t.Errorf("frame without pts at %v, want 10.04", got)
+	}
+}
+
+func TestDecodeInvalidPos(t *testing.T) {
+	data := `{"frames": [{"media_type": "video", "stream_index": 0, "pts": 0, "pkt_pos": "x"}],
+		"streams": [{"index": 0, "codec_type": "video", "time_base": "1/90000"}]}`
+
+	if _, err := Decode([]byte(data)); err == nil {
+		t.Error("invalid pkt_pos decoded")
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/url"
+	"path/filepath"
+	"strings"
+
+	"find_desync/credentials"
+)
+
+// Redact masks the credentials of every URI found in s, so command lines,
+// tool messages and reports can be shown outside the ops team.
+func Redact(s string) string {
+	return credentials.Mask(s)
+}
+
+// RegisterCredentials has Redact mask the password of a camera URI
+// wherever it shows up.
+func RegisterCredentials(uri string) {
+	credentials.Register(uri)
+}
+
+var defaultPorts = map[string]string{
+	"rtsp":  "554",
+	"rtsps": "322",
+	"http":  "80",
+	"https": "443",
+	"rtmp":  "1935",
+}
+
+// normalizeURI returns the form of uri that identifies the camera: without
+// credentials, with lower case scheme and host and without the default port,
+// so rotating a password or writing the same URI differently keeps the id.
+func normalizeURI(uri string) string {
+	uri = strings.TrimSpace(uri)
+
+	parsed, err := url.Parse(uri)
+	if err != nil || parsed.Scheme == "" || parsed.Host == "" {
+		if !strings.Contains(uri, "://") {
+			return filepath.Clean(uri)
+		}
+		return Redact(uri)
+	}
+
+	parsed.User = nil
+	parsed.Scheme = strings.ToLower(parsed.Scheme)
+	host, port := strings.ToLower(parsed.Hostname()), parsed.Port()
+	if port != "" && port != defaultPorts[parsed.Scheme] {
+		host += ":" + port
+	}
+	parsed.Host = host
+	parsed.Fragment = ""
+
+	return parsed.String()
+}
+
+// CameraID returns a stable identifier of the camera behind uri: the first
+// 16 hex digits of the SHA-256 of the normalized URI.
+func CameraID(uri string) string {
+	sum := sha256.Sum256([]byte(normalizeURI(uri)))
+	return hex.EncodeToString(sum[:8])
+}
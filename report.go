@@ -0,0 +1,454 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"time"
+
+	"find_desync/analysis"
+
+	"github.com/gocarina/gocsv"
+)
+
+const (
+	OutputText = "text"
+	OutputJSON = "json"
+)
+
+// Report is the machine readable document emitted by --output json.
+type Report struct {
+	Generated  time.Time        `json:"generated"`
+	Method     string           `json:"method"`
+	Parameters ReportParameters `json:"parameters"`
+	Cameras    []CameraReport   `json:"cameras"`
+}
+
+type ReportParameters struct {
+	Count     int    `json:"count"`
+	UseTime   bool   `json:"use_time"`
+	Direct    bool   `json:"direct"`
+	Capture   string `json:"capture"`
+	ProbeMode string `json:"probe_mode"`
+	Pairing   string `json:"pairing"`
+}
+
+type CameraReport struct {
+	Name      string     `json:"name"`
+	URI       string     `json:"uri"`
+	CameraID  string     `json:"camera_id"`
+	Apartment string     `json:"apartment"`
+	Method    string     `json:"method"`
+	Capture   string     `json:"capture"`
+	Started   string     `json:"started"`
+	Elapsed   float64    `json:"elapsed_seconds"`
+	Attempts  int        `json:"attempts"`
+	Verdict   string     `json:"verdict"`
+	Error     string     `json:"error,omitempty"`
+	Summary   *Summary   `json:"summary,omitempty"`
+	Frames    []FrameRow `json:"frames,omitempty"`
+}
+
+// Summary holds the figures printed in the ANALYSIS section. Fields that a
+// method does not compute are left out.
+type Summary struct {
+	Offset      float64            `json:"offset"`
+	AvgDiff     *float64           `json:"avg_diff,omitempty"`
+	FirstDiff   *float64           `json:"first_diff,omitempty"`
+	LastDiff    *float64           `json:"last_diff,omitempty"`
+	Drift       *DriftSummary      `json:"drift,omitempty"`
+	TrackDrift  *TrackDriftSummary `json:"track_drift,omitempty"`
+	Clock       *ClockSummary      `json:"clock,omitempty"`
+	Gaps        *GapSummary        `json:"gaps,omitempty"`
+	Content     *ContentSummary    `json:"content,omitempty"`
+	Pattern     *PatternSummary    `json:"pattern,omitempty"`
+	VideoFrames int                `json:"video_frames"`
+	AudioFrames int                `json:"audio_frames"`
+}
+
+type DriftSummary struct {
+	FixedOffset float64 `json:"fixed_offset"`
+	TotalDrift  float64 `json:"total_drift"`
+	PPM         float64 `json:"ppm"`
+	PPMLow      float64 `json:"ppm_low"`
+	PPMHigh     float64 `json:"ppm_high"`
+	MsPerHour   float64 `json:"ms_per_hour"`
+	R2          float64 `json:"r2"`
+	Jitter      float64 `json:"jitter"`
+	// Discontinuities and Segments are only set when a stream jumped, the
+	// other figures then cover the longest segment.
+	Discontinuities []DiscontinuityInfo `json:"discontinuities,omitempty"`
+	Segments        []SegmentInfo       `json:"segments,omitempty"`
+}
+
+// TrackDriftSummary is the result of the trackdrift method: the offset of
+// every window and how it moved.
+type TrackDriftSummary struct {
+	Window      float64      `json:"window"`
+	StartOffset float64      `json:"start_offset"`
+	Change      float64      `json:"change"`
+	MaxStep     float64      `json:"max_step"`
+	PPM         float64      `json:"ppm"`
+	PPMLow      float64      `json:"ppm_low"`
+	PPMHigh     float64      `json:"ppm_high"`
+	MsPerHour   float64      `json:"ms_per_hour"`
+	R2          float64      `json:"r2"`
+	Windows     []WindowInfo `json:"windows"`
+	// Discontinuities is only set when a stream jumped, the other figures
+	// then cover the longest segment.
+	Discontinuities []DiscontinuityInfo `json:"discontinuities,omitempty"`
+}
+
+// ClockSummary is the result of the pcr method. Delays are the PTS minus
+// the PCR of each stream, drifts how fast they change.
+type ClockSummary struct {
+	PCRPid       int      `json:"pcr_pid"`
+	PCRs         int      `json:"pcrs"`
+	MeanInterval float64  `json:"mean_interval"`
+	MaxInterval  float64  `json:"max_interval"`
+	Jitter       float64  `json:"jitter"`
+	JitterCBR    bool     `json:"jitter_cbr_assumed,omitempty"`
+	ArrivalPPM   *float64 `json:"arrival_ppm,omitempty"`
+	VideoDelay   float64  `json:"video_delay"`
+	VideoPPM     float64  `json:"video_ppm"`
+	AudioDelay   float64  `json:"audio_delay"`
+	AudioPPM     float64  `json:"audio_ppm"`
+}
+
+// GapSummary is the result of the gaps method.
+type GapSummary struct {
+	Video      StreamGaps     `json:"video"`
+	Audio      StreamGaps     `json:"audio"`
+	Correlated int            `json:"correlated"`
+	Events     []GapEventInfo `json:"events,omitempty"`
+}
+
+// ContentSummary is the result of the contentsync method, whose offset is
+// how late the sound comes after the picture.
+type ContentSummary struct {
+	Peak       float64 `json:"peak"`
+	Prominence float64 `json:"prominence"`
+	Confident  bool    `json:"confident"`
+	Duration   float64 `json:"duration"`
+}
+
+// PatternSummary is the result of the testpattern method. Offsets are how
+// late the beeps come after the flashes.
+type PatternSummary struct {
+	Flashes  int            `json:"flashes"`
+	Beeps    int            `json:"beeps"`
+	StdDev   float64        `json:"stddev"`
+	TrendPPM *float64       `json:"trend_ppm,omitempty"`
+	Events   []PatternEvent `json:"events"`
+}
+
+func NewReport(method string, params RunParams, options Options) *Report {
+	capture := options.Capture
+	if params.Direct {
+		capture = CaptureNone
+	}
+
+	return &Report{
+		Generated: time.Now(),
+		Method:    method,
+		Parameters: ReportParameters{
+			Count:     params.Count,
+			UseTime:   params.UseTime,
+			Direct:    params.Direct,
+			Capture:   capture,
+			ProbeMode: options.ProbeMode,
+			Pairing:   string(options.Pairing),
+		},
+		Cameras: []CameraReport{},
+	}
+}
+
+// Add appends the result of one camera to the report.
+func (r *Report) Add(m Measurement) {
+	item := CameraReport{
+		Name:      m.Camera.Name,
+		URI:       Redact(m.Camera.Uri),
+		CameraID:  CameraID(m.Camera.Uri),
+		Apartment: m.Camera.Apartment,
+		Method:    m.Method,
+		Capture:   m.Capture,
+		Started:   m.Started.Format(time.RFC3339),
+		Elapsed:   m.Elapsed.Seconds(),
+		Attempts:  m.Attempts,
+		Verdict:   m.Verdict(),
+	}
+
+	if m.Err != nil {
+		item.Error = Redact(m.Err.Error())
+		r.Cameras = append(r.Cameras, item)
+		return
+	}
+
+	summary := &Summary{Offset: m.Offset()}
+
+	if m.Method == MethodDrift {
+		estimate := m.Drift.Estimate
+		summary.VideoFrames = m.Drift.VideoFrames
+		summary.AudioFrames = m.Drift.AudioFrames
+		summary.Drift = &DriftSummary{
+			FixedOffset: m.Drift.Diff,
+			TotalDrift:  m.Drift.TotalDurDiff,
+			PPM:         estimate.PPM(),
+			PPMLow:      estimate.SlopeLow * 1e6,
+			PPMHigh:     estimate.SlopeHigh * 1e6,
+			MsPerHour:   estimate.MsPerHour(),
+			R2:          estimate.R2,
+			Jitter:      estimate.Residual,
+		}
+		if len(m.Drift.Discontinuities) > 0 {
+			summary.Drift.Discontinuities = m.Drift.Discontinuities
+			summary.Drift.Segments = m.Drift.Segments
+		}
+		item.Frames = m.Drift.Rows
+	} else if m.Method == MethodTrackDrift {
+		info := m.TrackDrift
+		summary.VideoFrames = info.VideoFrames
+		summary.AudioFrames = info.AudioFrames
+		summary.TrackDrift = &TrackDriftSummary{
+			Window:          info.Window,
+			StartOffset:     info.Diff,
+			Change:          info.Change,
+			MaxStep:         info.MaxStep,
+			PPM:             info.Trend.PPM(),
+			PPMLow:          info.Trend.SlopeLow * 1e6,
+			PPMHigh:         info.Trend.SlopeHigh * 1e6,
+			MsPerHour:       info.Trend.MsPerHour(),
+			R2:              info.Trend.R2,
+			Windows:         info.Windows,
+			Discontinuities: info.Discontinuities,
+		}
+	} else if m.Method == MethodPCR {
+		clock := m.Clock
+		summary.VideoFrames = clock.VideoFrames
+		summary.AudioFrames = clock.AudioFrames
+		summary.Clock = &ClockSummary{
+			PCRPid:       clock.PCRPid,
+			PCRs:         clock.PCRs,
+			MeanInterval: clock.MeanInterval,
+			MaxInterval:  clock.MaxInterval,
+			Jitter:       clock.Jitter,
+			JitterCBR:    clock.JitterCBR,
+			VideoDelay:   clock.Video.Intercept,
+			VideoPPM:     clock.Video.PPM(),
+			AudioDelay:   clock.Audio.Intercept,
+			AudioPPM:     clock.Audio.PPM(),
+		}
+		if clock.Arrival != nil {
+			summary.Clock.ArrivalPPM = floatPtr(clock.Arrival.PPM())
+		}
+	} else if m.Method == MethodContentSync {
+		summary.Content = &ContentSummary{
+			Peak:       m.Content.Peak,
+			Prominence: m.Content.Prominence,
+			Confident:  m.Content.Confident,
+			Duration:   m.Content.Duration,
+		}
+	} else if m.Method == MethodTestPattern {
+		summary.Pattern = &PatternSummary{
+			Flashes: m.Pattern.Flashes,
+			Beeps:   m.Pattern.Beeps,
+			StdDev:  m.Pattern.StdDev,
+			Events:  m.Pattern.Events,
+		}
+		if m.Pattern.HasTrend {
+			summary.Pattern.TrendPPM = floatPtr(m.Pattern.Trend.PPM())
+		}
+	} else if m.Method == MethodGaps {
+		summary.VideoFrames = m.Gaps.Video.Frames
+		summary.AudioFrames = m.Gaps.Audio.Frames
+		summary.Gaps = &GapSummary{
+			Video:      m.Gaps.Video,
+			Audio:      m.Gaps.Audio,
+			Correlated: m.Gaps.Correlated,
+			Events:     m.Gaps.Events,
+		}
+	} else {
+		summary.VideoFrames = m.Diff.VideoFrames
+		summary.AudioFrames = m.Diff.AudioFrames
+		item.Frames = m.Diff.Rows
+	}
+
+	if len(item.Frames) > 0 {
+		var total float64
+		for _, row := range item.Frames {
+			total += row.Diff
+		}
+		summary.AvgDiff = floatPtr(total / float64(len(item.Frames)))
+		summary.FirstDiff = floatPtr(item.Frames[0].Diff)
+		summary.LastDiff = floatPtr(item.Frames[len(item.Frames)-1].Diff)
+	}
+
+	item.Summary = summary
+	r.Cameras = append(r.Cameras, item)
+}
+
+func (r *Report) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(r)
+}
+
+// ResultRow is one line of the results CSV.
+type ResultRow struct {
+	Name        string `csv:"name"`
+	CameraID    string `csv:"camera_id"`
+	Apartment   string `csv:"apart"`
+	Method      string `csv:"method"`
+	Capture     string `csv:"capture"`
+	Verdict     string `csv:"verdict"`
+	Diff        string `csv:"diff"`
+	DriftPPM    string `csv:"drift_ppm"`
+	VideoFrames int    `csv:"video_frames"`
+	AudioFrames int    `csv:"audio_frames"`
+	Attempts    int    `csv:"attempts"`
+	Error       string `csv:"error"`
+}
+
+// WriteCSV writes one row per camera.
+func (r *Report) WriteCSV(w io.Writer) error {
+	rows := []*ResultRow{}
+
+	for _, item := range r.Cameras {
+		row := &ResultRow{
+			Name:      item.Name,
+			CameraID:  item.CameraID,
+			Apartment: item.Apartment,
+			Method:    item.Method,
+			Capture:   item.Capture,
+			Verdict:   item.Verdict,
+			Attempts:  item.Attempts,
+			Error:     item.Error,
+		}
+
+		if item.Summary != nil {
+			row.Diff = strconv.FormatFloat(item.Summary.Offset, 'f', 6, 64)
+			row.VideoFrames = item.Summary.VideoFrames
+			row.AudioFrames = item.Summary.AudioFrames
+			if item.Summary.Drift != nil {
+				row.DriftPPM = strconv.FormatFloat(item.Summary.Drift.PPM, 'f', 1, 64)
+			}
+			if item.Summary.TrackDrift != nil {
+				row.DriftPPM = strconv.FormatFloat(item.Summary.TrackDrift.PPM, 'f', 1, 64)
+			}
+		}
+
+		rows = append(rows, row)
+	}
+
+	return gocsv.Marshal(rows, w)
+}
+
+type junitSuite struct {
+	XMLName  xml.Name    `xml:"testsuite"`
+	Name     string      `xml:"name,attr"`
+	Tests    int         `xml:"tests,attr"`
+	Failures int         `xml:"failures,attr"`
+	Errors   int         `xml:"errors,attr"`
+	Skipped  int         `xml:"skipped,attr"`
+	Time     float64     `xml:"time,attr"`
+	Cases    []junitCase `xml:"testcase"`
+}
+
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      float64       `xml:"time,attr"`
+	Failure   *junitMessage `xml:"failure,omitempty"`
+	Error     *junitMessage `xml:"error,omitempty"`
+	Skipped   *junitMessage `xml:"skipped,omitempty"`
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr"`
+	Body    string `xml:",chardata"`
+}
+
+// failing reports whether the verdict of a camera is a desync or a drift.
+// Packet loss alone is not, and a fixed offset only when it is past the
+// desync threshold.
+func (item CameraReport) failing() bool {
+	switch item.Verdict {
+	case VerdictDesynced, GapsDesync,
+		string(analysis.ProgressiveDrift),
+		ClockEncoderDrift, ClockPCRDrift, ClockVideoDrift, ClockAudioDrift:
+		return true
+	case string(analysis.FixedOffset):
+		return item.Summary != nil && math.Abs(item.Summary.Offset) > desyncThreshold
+	}
+	return false
+}
+
+// WriteJUnit writes a JUnit XML test suite where every camera is a test
+// case. It fails on a desync or a drift, and is skipped when the method
+// could not tell.
+func (r *Report) WriteJUnit(w io.Writer) error {
+	suite := junitSuite{Name: "find_desync " + r.Method}
+
+	for _, item := range r.Cameras {
+		tc := junitCase{
+			Name:      item.Name,
+			ClassName: item.Apartment,
+			Time:      item.Elapsed,
+		}
+
+		switch {
+		case item.Error != "":
+			suite.Errors++
+			tc.Error = &junitMessage{Message: item.Error, Body: item.URI}
+		case item.Verdict == ContentInconclusive:
+			suite.Skipped++
+			tc.Skipped = &junitMessage{Message: item.Verdict, Body: item.URI}
+		case item.failing():
+			suite.Failures++
+			offset := 0.0
+			if item.Summary != nil {
+				offset = item.Summary.Offset
+			}
+			tc.Failure = &junitMessage{
+				Message: fmt.Sprintf("%s: offset %.3f seconds", item.Verdict, offset),
+				Body:    item.URI,
+			}
+		}
+
+		suite.Tests++
+		suite.Time += item.Elapsed
+		suite.Cases = append(suite.Cases, tc)
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(suite); err != nil {
+		return err
+	}
+
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// writeReportFile writes the report to path with the given writer method.
+func writeReportFile(path string, write func(io.Writer) error) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	if err := write(file); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
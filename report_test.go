@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/xml"
+	"testing"
+
+	"find_desync/analysis"
+)
+
+// outcome names how a JUnit test case ended.
+func outcome(tc junitCase) string {
+	switch {
+	case tc.Failure != nil:
+		return "failure"
+	case tc.Error != nil:
+		return "error"
+	case tc.Skipped != nil:
+		return "skipped"
+	}
+	return "passed"
+}
+
+func TestWriteJUnit(t *testing.T) {
+	cameras := []struct {
+		report CameraReport
+		want   string
+	}{
+		{CameraReport{Verdict: VerdictInSync, Summary: &Summary{Offset: 0.01}}, "passed"},
+		{CameraReport{Verdict: VerdictDesynced, Summary: &Summary{Offset: 0.7}}, "failure"},
+		{CameraReport{Verdict: string(analysis.ProgressiveDrift), Summary: &Summary{Offset: 0.03}}, "failure"},
+		// A fixed offset fails like a desync, past the same threshold
+		{CameraReport{Verdict: string(analysis.FixedOffset), Summary: &Summary{Offset: 0.02}}, "passed"},
+		{CameraReport{Verdict: string(analysis.FixedOffset), Summary: &Summary{Offset: -0.8}}, "failure"},
+		{CameraReport{Verdict: string(analysis.FixedOffset)}, "passed"},
+		{CameraReport{Verdict: ClockPCRDrift, Summary: &Summary{}}, "failure"},
+		{CameraReport{Verdict: GapsLoss, Summary: &Summary{}}, "passed"},
+		{CameraReport{Verdict: GapsDesync, Summary: &Summary{}}, "failure"},
+		{CameraReport{Verdict: ContentInconclusive, Summary: &Summary{}}, "skipped"},
+		{CameraReport{Verdict: ClockAudioDrift, Summary: &Summary{}}, "failure"},
+		{CameraReport{Verdict: VerdictError, Error: "connection refused"}, "error"},
+	}
+
+	report := Report{Method: MethodDrift}
+	for i, c := range cameras {
+		c.report.Name = string(rune('a' + i))
+		report.Cameras = append(report.Cameras, c.report)
+	}
+
+	var out bytes.Buffer
+	if err := report.WriteJUnit(&out); err != nil {
+		t.Fatal(err)
+	}
+
+	var suite junitSuite
+	if err := xml.Unmarshal(out.Bytes(), &suite); err != nil {
+		t.Fatal(err)
+	}
+
+	if suite.Tests != 12 || suite.Failures != 6 || suite.Errors != 1 || suite.Skipped != 1 {
+		t.Errorf("%d tests, %d failures, %d errors, %d skipped", suite.Tests, suite.Failures, suite.Errors, suite.Skipped)
+	}
+
+	for i, tc := range suite.Cases {
+		if got := outcome(tc); got != cameras[i].want {
+			t.Errorf("camera %d, %q: %s, want %s", i, cameras[i].report.Verdict, got, cameras[i].want)
+		}
+	}
+}
+
+func TestWriteCSV(t *testing.T) {
+	report := Report{Cameras: []CameraReport{
+		{Name: "drift", Method: MethodDrift, Capture: CaptureCopy, Verdict: string(analysis.ProgressiveDrift), Attempts: 1, Summary: &Summary{Offset: 0.0123456789, Drift: &DriftSummary{PPM: 12.34}}},
+		{Name: "trackdrift", Method: MethodTrackDrift, Capture: CaptureCopy, Verdict: string(analysis.ProgressiveDrift), Attempts: 1, Summary: &Summary{Offset: -0.05, TrackDrift: &TrackDriftSummary{PPM: -56.78}}},
+		{Name: "trackdiff", Method: MethodTrackDiff, Capture: CaptureNone, Verdict: VerdictInSync, Attempts: 1, Summary: &Summary{VideoFrames: 50, AudioFrames: 100}},
+		{Name: "down", CameraID: "c0ffee", Method: MethodTrackDiff, Capture: CaptureCopy, Verdict: VerdictError, Attempts: 3, Error: "connection refused"},
+	}}
+
+	var out bytes.Buffer
+	if err := report.WriteCSV(&out); err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := csv.NewReader(&out).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := [][]string{
+		{"name", "camera_id", "apart", "method", "capture", "verdict", "diff", "drift_ppm", "video_frames", "audio_frames", "attempts", "error"},
+		{"drift", "", "", "drift", "copy", "progressive drift", "0.012346", "12.3", "0", "0", "1", ""},
+		{"trackdrift", "", "", "trackdrift", "copy", "progressive drift", "-0.050000", "-56.8", "0", "0", "1", ""},
+		{"trackdiff", "", "", "trackdiff", "none", "in sync", "0.000000", "", "50", "100", "1", ""},
+		{"down", "c0ffee", "", "trackdiff", "copy", "error", "", "", "0", "0", "3", "connection refused"},
+	}
+
+	if len(records) != len(want) {
+		t.Fatalf("%d rows, want %d", len(records), len(want))
+	}
+	for i := range want {
+		if len(records[i]) != len(want[i]) {
+			t.Fatalf("row %d has %d columns, want %d", i, len(records[i]), len(want[i]))
+		}
+		for j := range want[i] {
+			if records[i][j] != want[i][j] {
+				t.Errorf("row %d column %s: %q, want %q", i, want[0][j], records[i][j], want[i][j])
+			}
+		}
+	}
+}
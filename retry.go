@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// RetryPolicy says how often a failed recording or probe is tried again.
+// The n-th retry waits Backoff * 2^(n-1), at most MaxBackoff, spread by
+// ±Jitter (a fraction of the delay) so cameras behind the same recorder
+// do not reconnect in lockstep.
+type RetryPolicy struct {
+	// Attempts is the total number of tries, 1 or less disables retries.
+	Attempts   int
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	Jitter     float64
+}
+
+// Delay returns the wait before the given retry, counted from 1.
+func (p RetryPolicy) Delay(retry int) time.Duration {
+	delay := p.Backoff << (retry - 1)
+	if p.MaxBackoff > 0 && (delay > p.MaxBackoff || delay <= 0) {
+		delay = p.MaxBackoff
+	}
+
+	if p.Jitter > 0 {
+		delay += time.Duration((rand.Float64()*2 - 1) * p.Jitter * float64(delay))
+	}
+
+	return max(delay, 0)
+}
+
+// ToolError is a failed ffmpeg or ffprobe run. Message is the last line the
+// tool printed, which carries the reason ("Connection refused", "404 Not
+// Found", ...).
+type ToolError struct {
+	Tool    string
+	Message string
+	Err     error
+}
+
+func (e *ToolError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("%s: %v", e.Tool, e.Err)
+	}
+	return fmt.Sprintf("%s: %v: %s", e.Tool, e.Err, e.Message)
+}
+
+func (e *ToolError) Unwrap() error {
+	return e.Err
+}
+
+// toolError wraps a failed run of tool with the last line of its output.
+// Errors caused by ctx are returned as is.
+func toolError(ctx context.Context, tool string, output []byte, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if ctxErr := contextError(ctx, err); ctxErr != err {
+		return ctxErr
+	}
+
+	var exitErr *exec.ExitError
+	if len(output) == 0 && errors.As(err, &exitErr) {
+		output = exitErr.Stderr
+	}
+
+	// ffmpeg prefixes its errors with the input URI
+	return &ToolError{Tool: tool, Message: Redact(lastLine(output)), Err: err}
+}
+
+func lastLine(output []byte) string {
+	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
+
+// Messages of ffmpeg failures that will not go away by trying again, and of
+// those that usually do. Anything else is treated as permanent.
+var (
+	permanentMessages = []string{
+		"401", "403", "404", "Unauthorized", "Forbidden", "Not Found",
+		"No such file or directory", "Invalid data found", "Protocol not found",
+	}
+	retriableMessages = []string{
+		"Connection refused", "Connection reset", "timed out", "503",
+		"Service Unavailable", "Network is unreachable", "No route to host",
+		"End of file", "Broken pipe", "Resource temporarily unavailable",
+	}
+)
+
+// Retriable reports whether err is a transient failure worth another try.
+func Retriable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var toolErr *ToolError
+	if !errors.As(err, &toolErr) {
+		return false
+	}
+
+	for _, message := range permanentMessages {
+		if strings.Contains(toolErr.Message, message) {
+			return false
+		}
+	}
+
+	for _, message := range retriableMessages {
+		if strings.Contains(toolErr.Message, message) {
+			return true
+		}
+	}
+
+	return false
+}
+
+type attemptsKey struct{}
+
+// withAttempts returns a context in which retry adds every retry to
+// *attempts.
+func withAttempts(ctx context.Context, attempts *int) context.Context {
+	return context.WithValue(ctx, attemptsKey{}, attempts)
+}
+
+// retry runs step until it succeeds, fails permanently, the policy is
+// exhausted or ctx is done. Every retry is added to the attempts counter
+// of ctx, see withAttempts.
+func (a *Analyzer) retry(ctx context.Context, what string, step func() error) error {
+	attempts, _ := ctx.Value(attemptsKey{}).(*int)
+
+	for n := 1; ; n++ {
+		if attempts != nil && n > 1 {
+			*attempts++
+		}
+
+		err := step()
+		if err == nil || n >= a.options.Retry.Attempts || !Retriable(err) {
+			return err
+		}
+
+		delay := a.options.Retry.Delay(n)
+		a.yellow("%s failed (attempt %d of %d): %v, retrying in %s", what, n, a.options.Retry.Attempts, err, delay.Round(time.Millisecond))
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("%w after %v", ctx.Err(), err)
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"find_desync/probe"
+)
+
+// ProbeRequest describes a single ffprobe run over a source.
+type ProbeRequest struct {
+	URL string
+	// Streams is the ffprobe -select_streams specifier, e.g. "v" or "a:0".
+	// An empty value probes every stream in a single session.
+	Streams       string
+	ReadIntervals string
+}
+
+// RecordRequest describes a capture of a source into a local file.
+type RecordRequest struct {
+	URL      string
+	Filename string
+	Length   int
+	// Capture is CaptureCopy or CaptureTranscode.
+	Capture string
+	// Align restarts both streams at 0 when transcoding.
+	Align bool
+	// MaxSize stops the recording at that many bytes, 0 for no limit.
+	MaxSize int64
+}
+
+// DecodeRequest describes decoding a source into raw media: mono signed
+// 16-bit little endian PCM at SampleRate into AudioFile and Width x Height
+// 8-bit gray frames at FrameRate into VideoFile. Both are padded back to
+// the start of the source, so a sample or frame position is a time on the
+// timeline the streams share.
+type DecodeRequest struct {
+	URL        string
+	Length     int
+	AudioFile  string
+	VideoFile  string
+	SampleRate int
+	FrameRate  int
+	Width      int
+	Height     int
+}
+
+// Runner executes the external tools the Analyzer depends on and returns
+// their raw output, so the analysis itself can run against canned outputs.
+// Every call stops when ctx is done and then returns an error wrapping
+// ctx.Err().
+type Runner interface {
+	// Probe returns ffprobe JSON output for probe.ShowEntries.
+	Probe(ctx context.Context, req ProbeRequest) ([]byte, error)
+	// Record captures the source into req.Filename.
+	Record(ctx context.Context, req RecordRequest) error
+	// StartTimes returns the ffprobe stream summary containing start times.
+	StartTimes(ctx context.Context, url string) ([]byte, error)
+	// Decode writes the decoded audio and video of the source into
+	// req.AudioFile and req.VideoFile in one session.
+	Decode(ctx context.Context, req DecodeRequest) error
+}
+
+// outputRunner is a Runner that prints what it runs and can be given
+// another writer to print to.
+type outputRunner interface {
+	Runner
+	WithOutput(out io.Writer) Runner
+}
+
+// FFmpegRunner runs the real ffprobe and ffmpeg binaries found in $PATH.
+// The command lines are echoed to Out, or os.Stdout when it is nil.
+type FFmpegRunner struct {
+	Out io.Writer
+	// ConnectTimeout bounds connecting to and waiting for data from a
+	// network source. Zero leaves the ffmpeg defaults.
+	ConnectTimeout time.Duration
+}
+
+// contextError prefers the context error over the "signal: killed" error
+// of a process stopped because ctx was done.
+func contextError(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() != nil && !errors.Is(err, ctx.Err()) {
+		return fmt.Errorf("%w: %v", ctx.Err(), err)
+	}
+	return err
+}
+
+// input appends the source with its input options: TCP transport for RTSP
+// and the I/O timeout for network sources.
+func (r FFmpegRunner) input(cmd *Command, url string) *Command {
+	if strings.Contains(url, "rtsp") {
+		cmd.Option("rtsp_transport", "tcp")
+	}
+
+	if r.ConnectTimeout > 0 && strings.Contains(url, "://") {
+		micros := strconv.FormatInt(r.ConnectTimeout.Microseconds(), 10)
+		if strings.Contains(url, "rtsp") {
+			cmd.Option("timeout", micros)
+		} else {
+			cmd.Option("rw_timeout", micros)
+		}
+	}
+
+	return cmd.Option("i", url)
+}
+
+// WithOutput returns a copy of the runner echoing its commands to out.
+func (r FFmpegRunner) WithOutput(out io.Writer) Runner {
+	r.Out = out
+	return r
+}
+
+func (r FFmpegRunner) out() io.Writer {
+	if r.Out == nil {
+		return os.Stdout
+	}
+	return r.Out
+}
+
+func (r FFmpegRunner) Probe(ctx context.Context, req ProbeRequest) ([]byte, error) {
+	cmd := NewCommand("ffprobe").
+		Option("v", "error").
+		Option("analyzeduration", "5M").
+		Option("probesize", "5M")
+	r.input(cmd, req.URL).
+		OptionIf("select_streams", req.Streams).
+		Option("show_entries", probe.ShowEntries).
+		Option("of", "json").
+		Option("read_intervals", req.ReadIntervals)
+
+	fmt.Fprintln(r.out(), "Probe command:")
+	fmt.Fprintln(r.out(), cmd)
+
+	// stderr only carries errors, it ends up in the ToolError
+	output, err := cmd.Cmd(ctx).Output()
+	return output, toolError(ctx, "ffprobe", nil, err)
+}
+
+func (r FFmpegRunner) Record(ctx context.Context, req RecordRequest) error {
+	// The workspace has created the file already
+	cmd := r.input(NewCommand("ffmpeg").Arg("-y"), req.URL)
+
+	if req.Capture == CaptureTranscode {
+		videoFilter := "null"
+		audioFilter := "asetnsamples=320"
+
+		if req.Align {
+			audioFilter = audioFilter + ",asetpts=PTS-STARTPTS"
+			videoFilter = "setpts=PTS-STARTPTS"
+		}
+
+		cmd.Option("c:v", "libx264").
+			Option("c:a", "pcm_mulaw").
+			Option("vf", videoFilter).
+			Option("af", audioFilter)
+	} else {
+		// The packets are stored as received, timestamps included
+		cmd.Option("c", "copy")
+	}
+
+	cmd.Option("t", strconv.Itoa(req.Length))
+	if req.MaxSize > 0 {
+		cmd.Option("fs", strconv.FormatInt(req.MaxSize, 10))
+	}
+	cmd.Arg(req.Filename)
+
+	fmt.Fprintln(r.out(), cmd)
+
+	output, err := cmd.Cmd(ctx).CombinedOutput()
+	return toolError(ctx, "ffmpeg", output, err)
+}
+
+func (r FFmpegRunner) StartTimes(ctx context.Context, url string) ([]byte, error) {
+	cmd := NewCommand("ffprobe").
+		Option("analyzeduration", "10M").
+		Option("probesize", "10M")
+	r.input(cmd, url)
+
+	fmt.Fprintln(r.out(), "Command:")
+	fmt.Fprintln(r.out(), cmd)
+
+	// The stream summary is printed on stderr
+	output, err := cmd.Cmd(ctx).CombinedOutput()
+	return output, toolError(ctx, "ffprobe", output, err)
+}
+
+func (r FFmpegRunner) Decode(ctx context.Context, req DecodeRequest) error {
+	length := strconv.Itoa(req.Length)
+
+	cmd := r.input(NewCommand("ffmpeg").Arg("-y").Option("v", "error"), req.URL)
+
+	// Both outputs start at the start of the input: silence and copies of
+	// the first frame fill the time before a stream begins
+	cmd.Option("map", "0:a:0").
+		Option("af", fmt.Sprintf("aresample=%d:async=1:first_pts=0", req.SampleRate)).
+		Option("ac", "1").
+		Option("t", length).
+		Option("f", "s16le").
+		Arg(req.AudioFile)
+
+	cmd.Option("map", "0:v:0").
+		Option("vf", fmt.Sprintf("fps=%d:start_time=0,scale=%d:%d,format=gray", req.FrameRate, req.Width, req.Height)).
+		Option("t", length).
+		Option("f", "rawvideo").
+		Arg(req.VideoFile)
+
+	fmt.Fprintln(r.out(), cmd)
+
+	output, err := cmd.Cmd(ctx).CombinedOutput()
+	return toolError(ctx, "ffmpeg", output, err)
+}
+
+// FakeRunner replays canned tool outputs instead of running ffmpeg. Probe
+// outputs are looked up by the requested stream specifier, with "" holding
+// the interleaved output of all streams. Decode writes Audio and Video to
+// the requested files.
+type FakeRunner struct {
+	Probes    map[string][]byte
+	Starts    []byte
+	Audio     []byte
+	Video     []byte
+	RecordErr error
+	// Delay makes every call wait, like a source that is slow to answer.
+	Delay time.Duration
+
+	mu sync.Mutex
+	// Recorded, Probed and Decoded keep the requests seen, in call order.
+	Recorded []RecordRequest
+	Probed   []ProbeRequest
+	Decoded  []DecodeRequest
+}
+
+// wait sleeps for Delay unless ctx is done first.
+func (f *FakeRunner) wait(ctx context.Context) error {
+	if f.Delay == 0 {
+		return ctx.Err()
+	}
+
+	timer := time.NewTimer(f.Delay)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func (f *FakeRunner) Probe(ctx context.Context, req ProbeRequest) ([]byte, error) {
+	if err := f.wait(ctx); err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.Probed = append(f.Probed, req)
+
+	output, ok := f.Probes[req.Streams]
+	if !ok {
+		return nil, fmt.Errorf("no canned probe output for streams %q", req.Streams)
+	}
+	return output, nil
+}
+
+func (f *FakeRunner) Record(ctx context.Context, req RecordRequest) error {
+	if err := f.wait(ctx); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.Recorded = append(f.Recorded, req)
+	return f.RecordErr
+}
+
+func (f *FakeRunner) StartTimes(ctx context.Context, url string) ([]byte, error) {
+	if err := f.wait(ctx); err != nil {
+		return nil, err
+	}
+
+	if f.Starts == nil {
+		return nil, fmt.Errorf("no canned start time output")
+	}
+	return f.Starts, nil
+}
+
+func (f *FakeRunner) Decode(ctx context.Context, req DecodeRequest) error {
+	if err := f.wait(ctx); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	f.Decoded = append(f.Decoded, req)
+	f.mu.Unlock()
+
+	if f.Audio == nil || f.Video == nil {
+		return fmt.Errorf("no canned decoded media")
+	}
+
+	if err := os.WriteFile(req.AudioFile, f.Audio, 0o644); err != nil {
+		return err
+	}
+	return os.WriteFile(req.VideoFile, f.Video, 0o644)
+}
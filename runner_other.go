@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "os/exec"
+
+// killProcessGroup keeps the default behaviour of exec.CommandContext,
+// which kills only the direct child, where process groups are unavailable.
+func killProcessGroup(cmd *exec.Cmd) {}
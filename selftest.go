@@ -0,0 +1,379 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	"find_desync/analysis"
+	"find_desync/synth"
+
+	"github.com/akamensky/argparse"
+	"github.com/fatih/color"
+	"github.com/rodaine/table"
+)
+
+// The self-test generates selftestDuration seconds of every scenario and
+// analyzes the first selftestWindow of them.
+const (
+	selftestDuration = 30
+	selftestWindow   = 20
+)
+
+// SelftestScenario is a fault injected into a generated test stream.
+// Desync tells whether it moves the sound against the picture; the others
+// must be found in sync.
+type SelftestScenario struct {
+	Name        string
+	Description string
+	Faults      synth.Faults
+	Desync      bool
+}
+
+var selftestScenarios = []SelftestScenario{
+	{Name: "sync", Description: "no fault"},
+	{Name: "pts_offset", Description: "picture stamped 5 s late, as setts=pts=PTS+5/TB on the video", Faults: synth.Faults{Offset: -5}, Desync: true},
+	{Name: "drift", Description: "sound played 5% fast, as atempo=1.05", Faults: synth.Faults{DriftPPM: -47619}, Desync: true},
+	{Name: "audio_dropout", Description: "1 s of audio lost every 10 s, the rest in sync", Faults: synth.Faults{DropEvery: 10, DropLength: 1}},
+	// Over the window the offset stays within half an audio frame, as far
+	// as pairing by PTS can follow it
+	{Name: "timestamp_drift", Description: "audio timestamps and PCR 300 ppm fast", Faults: synth.Faults{DriftPPM: 300, DriftTimestamps: true}, Desync: true},
+}
+
+var selftestMethods = []string{MethodStartDiff, MethodFirstPackets, MethodTrackDiff, MethodDrift, MethodTrackDrift, MethodContentSync}
+
+// selftestTools are the external tools a method needs on a generated
+// transport stream, the others read it with the built-in demuxer.
+var selftestTools = map[string]string{
+	MethodStartDiff:   "ffprobe",
+	MethodContentSync: "ffmpeg",
+}
+
+// SelftestExpectation is what a method finds in a scenario: its verdict
+// and its value, the offset it reports or the drift in ppm for the drift
+// and trackdrift methods, within Tolerance. A zero Tolerance leaves the value unchecked,
+// for methods whose value means nothing once they are fooled.
+type SelftestExpectation struct {
+	Verdict   string
+	Value     float64
+	Tolerance float64
+}
+
+// selftestExpectations is the golden behaviour of every method against
+// every scenario, misses included: the timestamp methods pair frames by
+// PTS, so only the start methods see an offset between the streams, and
+// nothing but the content sees a drift the timestamps do not show.
+var selftestExpectations = map[string]map[string]SelftestExpectation{
+	"sync": {
+		MethodStartDiff:    {Verdict: VerdictInSync, Value: 0, Tolerance: 0.01},
+		MethodFirstPackets: {Verdict: VerdictInSync, Value: 0, Tolerance: 0.01},
+		MethodTrackDiff:    {Verdict: VerdictInSync, Value: 0, Tolerance: 0.011},
+		MethodDrift:        {Verdict: VerdictInSync, Value: 0, Tolerance: 100},
+		MethodTrackDrift:   {Verdict: VerdictInSync, Value: 0, Tolerance: 100},
+		MethodContentSync:  {Verdict: VerdictInSync, Value: 0, Tolerance: 0.05},
+	},
+	"pts_offset": {
+		MethodStartDiff:    {Verdict: VerdictDesynced, Value: 5, Tolerance: 0.01},
+		MethodFirstPackets: {Verdict: VerdictDesynced, Value: 5, Tolerance: 0.01},
+		MethodTrackDiff:    {Verdict: VerdictInSync, Value: 0, Tolerance: 0.011},
+		MethodDrift:        {Verdict: VerdictInSync, Value: 0, Tolerance: 100},
+		MethodTrackDrift:   {Verdict: VerdictInSync, Value: 0, Tolerance: 100},
+		// contentsync only looks for lags up to contentMaxLag, 2 s either
+		// way. The flashes are scattered, so the pattern never lines up
+		// with itself at a shorter lag: no peak stands out and a 5 s
+		// offset, which startdiff already catches, is left inconclusive
+		MethodContentSync: {Verdict: ContentInconclusive},
+	},
+	"drift": {
+		MethodStartDiff:    {Verdict: VerdictInSync, Value: 0, Tolerance: 0.01},
+		MethodFirstPackets: {Verdict: VerdictInSync, Value: 0, Tolerance: 0.01},
+		MethodTrackDiff:    {Verdict: VerdictInSync, Value: 0, Tolerance: 0.011},
+		MethodDrift:        {Verdict: VerdictInSync, Value: 0, Tolerance: 100},
+		MethodTrackDrift:   {Verdict: VerdictInSync, Value: 0, Tolerance: 100},
+		// The offset moves by a second over the window, no single lag fits
+		MethodContentSync: {Verdict: ContentInconclusive},
+	},
+	"audio_dropout": {
+		MethodStartDiff:    {Verdict: VerdictInSync, Value: 0, Tolerance: 0.01},
+		MethodFirstPackets: {Verdict: VerdictInSync, Value: 0, Tolerance: 0.01},
+		// Lost audio is not a desync: video frames in the holes are left
+		// unpaired
+		MethodTrackDiff:   {Verdict: VerdictInSync, Value: 0, Tolerance: 0.011},
+		MethodDrift:       {Verdict: VerdictInSync, Value: 0, Tolerance: 100},
+		MethodTrackDrift:  {Verdict: VerdictInSync, Value: 0, Tolerance: 100},
+		MethodContentSync: {Verdict: VerdictInSync, Value: 0, Tolerance: 0.05},
+	},
+	"timestamp_drift": {
+		MethodStartDiff:    {Verdict: VerdictInSync, Value: 0, Tolerance: 0.01},
+		MethodFirstPackets: {Verdict: VerdictInSync, Value: 0, Tolerance: 0.01},
+		// 3 ms on average, 6 ms at the end of the window
+		MethodTrackDiff:   {Verdict: VerdictInSync, Value: 0.003, Tolerance: 0.011},
+		MethodDrift:       {Verdict: string(analysis.ProgressiveDrift), Value: 300, Tolerance: 30},
+		MethodTrackDrift:  {Verdict: string(analysis.ProgressiveDrift), Value: 300, Tolerance: 30},
+		MethodContentSync: {Verdict: VerdictInSync, Value: 0, Tolerance: 0.05},
+	},
+}
+
+// SelftestResult is one method run against one scenario.
+type SelftestResult struct {
+	Scenario string
+	Method   string
+	Expected SelftestExpectation
+	Verdict  string
+	Value    float64
+	// Skipped is why the method was not run, Err why it failed or does
+	// not match the expectation.
+	Skipped string
+	Err     error
+}
+
+// Passed reports whether the method was run and behaved as expected.
+func (r SelftestResult) Passed() bool {
+	return r.Skipped == "" && r.Err == nil
+}
+
+// Caught reports whether the method flagged the scenario as not in sync.
+func (r SelftestResult) Caught() bool {
+	return r.Skipped == "" && r.Verdict != VerdictInSync
+}
+
+// selftestValue is the number a measurement is checked on.
+func selftestValue(m Measurement) float64 {
+	switch m.Method {
+	case MethodDrift:
+		return m.Drift.Estimate.PPM()
+	case MethodTrackDrift:
+		return m.TrackDrift.Trend.PPM()
+	}
+	return m.Offset()
+}
+
+// Check compares a measurement with the expectation.
+func (e SelftestExpectation) Check(m Measurement) error {
+	if m.Err != nil {
+		return m.Err
+	}
+
+	if verdict := m.Verdict(); verdict != e.Verdict {
+		return fmt.Errorf("verdict %q, expected %q", verdict, e.Verdict)
+	}
+
+	if value := selftestValue(m); e.Tolerance > 0 && math.Abs(value-e.Value) > e.Tolerance {
+		return fmt.Errorf("value %.4f, expected %.4f ± %.4f", value, e.Value, e.Tolerance)
+	}
+
+	return nil
+}
+
+// GenerateScenario writes the test stream of a scenario into dir and
+// returns its file name.
+func GenerateScenario(ctx context.Context, dir string, scenario SelftestScenario) (string, error) {
+	file := filepath.Join(dir, scenario.Name+".ts")
+
+	err := Generate(ctx, GenerateOptions{
+		Config: synth.Config{
+			Duration:   selftestDuration,
+			FrameRate:  25,
+			SampleRate: 48000,
+			Interval:   1,
+			Start:      10,
+			Faults:     scenario.Faults,
+		},
+		Codec:  CodecNative,
+		Output: file,
+		Truth:  file + ".truth.json",
+		Out:    io.Discard,
+	})
+
+	return file, err
+}
+
+// SelftestScenario runs a method against the generated stream of a
+// scenario. Methods whose tool is missing are skipped.
+func (a *Analyzer) SelftestScenario(ctx context.Context, file string, scenario string, method string) SelftestResult {
+	result := SelftestResult{
+		Scenario: scenario,
+		Method:   method,
+		Expected: selftestExpectations[scenario][method],
+	}
+
+	if tool, ok := selftestTools[method]; ok {
+		if _, err := exec.LookPath(tool); err != nil {
+			result.Skipped = tool + " not found"
+			return result
+		}
+	}
+
+	camera := &Camera{Name: scenario, Uri: file}
+	m := a.Measure(ctx, method, camera, RunParams{Count: selftestWindow, UseTime: true, Direct: true})
+
+	result.Verdict = m.Verdict()
+	result.Value = selftestValue(m)
+	result.Err = result.Expected.Check(m)
+
+	return result
+}
+
+// Selftest generates every scenario into dir and runs every method
+// against it.
+func (a *Analyzer) Selftest(ctx context.Context, dir string) ([]SelftestResult, error) {
+	results := []SelftestResult{}
+
+	for _, scenario := range selftestScenarios {
+		file, err := GenerateScenario(ctx, dir, scenario)
+		if err != nil {
+			return nil, fmt.Errorf("generating %s: %w", scenario.Name, err)
+		}
+
+		for _, method := range selftestMethods {
+			if err := ctx.Err(); err != nil {
+				return results, err
+			}
+			results = append(results, a.SelftestScenario(ctx, file, scenario.Name, method))
+		}
+	}
+
+	return results, nil
+}
+
+func printSelftest(out io.Writer, results []SelftestResult) {
+	headerFmt := color.New(color.FgGreen, color.Underline).SprintfFunc()
+	columnFmt := color.New(color.FgYellow).SprintfFunc()
+
+	tbl := table.New("Scenario", "Method", "Verdict", "Value", "Expected", "Result")
+	tbl.WithHeaderFormatter(headerFmt).WithFirstColumnFormatter(columnFmt).WithWriter(out)
+
+	for _, r := range results {
+		expected := r.Expected.Verdict
+		if r.Expected.Tolerance > 0 {
+			expected += fmt.Sprintf(", %.3f ± %.3f", r.Expected.Value, r.Expected.Tolerance)
+		}
+
+		switch {
+		case r.Skipped != "":
+			tbl.AddRow(r.Scenario, r.Method, "", "", expected, "SKIP: "+r.Skipped)
+		case r.Err != nil:
+			tbl.AddRow(r.Scenario, r.Method, r.Verdict, fmt.Sprintf("%.4f", r.Value), expected, "FAIL: "+r.Err.Error())
+		default:
+			tbl.AddRow(r.Scenario, r.Method, r.Verdict, fmt.Sprintf("%.4f", r.Value), expected, "PASS")
+		}
+	}
+
+	tbl.Print()
+
+	// Which method flags which fault
+	fmt.Fprintf(out, "\n=== CAUGHT ===\n")
+
+	columns := []interface{}{"Method"}
+	for _, scenario := range selftestScenarios {
+		columns = append(columns, scenario.Name)
+	}
+	caught := table.New(columns...)
+	caught.WithHeaderFormatter(headerFmt).WithFirstColumnFormatter(columnFmt).WithWriter(out)
+
+	for _, method := range selftestMethods {
+		row := []interface{}{method}
+		for _, scenario := range selftestScenarios {
+			cell := ""
+			for _, r := range results {
+				if r.Scenario == scenario.Name && r.Method == method {
+					cell = caughtCell(scenario, r)
+				}
+			}
+			row = append(row, cell)
+		}
+		caught.AddRow(row...)
+	}
+
+	caught.Print()
+}
+
+// caughtCell tells whether a method flagged a desync, or wrongly flagged a
+// stream without any.
+func caughtCell(scenario SelftestScenario, r SelftestResult) string {
+	switch {
+	case r.Skipped != "":
+		return "-"
+	case !scenario.Desync && r.Caught():
+		return "false alarm"
+	case !scenario.Desync:
+		return "ok"
+	case r.Caught():
+		return r.Verdict
+	}
+	return "missed"
+}
+
+func selftestMain(args []string) {
+	if !runSelftest(args) {
+		os.Exit(1)
+	}
+}
+
+// runSelftest runs the selftest command and reports whether every method
+// behaved as expected.
+func runSelftest(args []string) bool {
+	parser := argparse.NewParser("find_desync selftest", "Generate streams with known faults and check what every method finds in them")
+
+	dir := parser.String("", "dir", &argparse.Options{Required: false, Help: "Keep the generated streams and their ground truth in this directory instead of a temporary one"})
+	verbose := parser.Flag("v", "verbose", &argparse.Options{Required: false, Help: "Print the output of every method"})
+
+	err := parser.Parse(args)
+
+	if err != nil {
+		fmt.Print(parser.Usage(err))
+		return true
+	}
+
+	workdir := *dir
+	if workdir == "" {
+		workdir, err = os.MkdirTemp("", "find_desync_selftest_")
+		if err == nil {
+			defer os.RemoveAll(workdir)
+		}
+	} else {
+		err = os.MkdirAll(workdir, 0o755)
+	}
+
+	if err != nil {
+		fmt.Printf("Cannot create the work directory: %v\n", err)
+		return false
+	}
+
+	methodOutput := io.Discard
+	if *verbose {
+		methodOutput = os.Stdout
+	}
+
+	analyzer := NewAnalyzer(FFmpegRunner{Out: methodOutput}, Options{Output: methodOutput, Capture: CaptureNone})
+	defer analyzer.options.Workspace.Cleanup()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	for _, scenario := range selftestScenarios {
+		fmt.Printf("%-14s %s\n", scenario.Name, scenario.Description)
+	}
+	fmt.Println()
+
+	results, err := analyzer.Selftest(ctx, workdir)
+	printSelftest(os.Stdout, results)
+
+	if err != nil {
+		fmt.Printf("Self-test stopped: %v\n", err)
+		return false
+	}
+
+	for _, r := range results {
+		if r.Err != nil {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"io"
+	"testing"
+)
+
+// TestSelftest checks every method against every generated fault, as the
+// selftest command does.
+func TestSelftest(t *testing.T) {
+	analyzer := NewAnalyzer(FFmpegRunner{Out: io.Discard}, Options{Output: io.Discard, Capture: CaptureNone})
+	t.Cleanup(analyzer.options.Workspace.Cleanup)
+
+	dir := t.TempDir()
+
+	for _, scenario := range selftestScenarios {
+		t.Run(scenario.Name, func(t *testing.T) {
+			file, err := GenerateScenario(context.Background(), dir, scenario)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, method := range selftestMethods {
+				t.Run(method, func(t *testing.T) {
+					r := analyzer.SelftestScenario(context.Background(), file, scenario.Name, method)
+					if r.Skipped != "" {
+						t.Skip(r.Skipped)
+					}
+					if r.Err != nil {
+						t.Error(r.Err)
+					}
+				})
+			}
+		})
+	}
+}
+
+// TestSelftestExpectations makes sure no scenario is left without the
+// golden behaviour of a method.
+func TestSelftestExpectations(t *testing.T) {
+	for _, scenario := range selftestScenarios {
+		for _, method := range selftestMethods {
+			if _, ok := selftestExpectations[scenario.Name][method]; !ok {
+				t.Errorf("no expectation for %s against %s", method, scenario.Name)
+			}
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package synth
+
+// H.264 is written the simplest way a decoder accepts: constrained
+// baseline, every frame an IDR picture of I_PCM macroblocks, whose samples
+// are stored as they are. It is large but needs no encoder and decodes to
+// exactly the pixels written.
+
+const (
+	nalSlice = 5
+	nalSPS   = 7
+	nalPPS   = 8
+	nalAUD   = 9
+
+	// mbTypePCM is the I slice mb_type of an I_PCM macroblock.
+	mbTypePCM = 25
+)
+
+// PictureWriter encodes 4:2:0 pictures of Width x Height pixels, both
+// multiples of 16, to H.264 access units.
+type PictureWriter struct {
+	Width  int
+	Height int
+	idr    int
+}
+
+// Encode returns the Annex B access unit of a picture with the given luma
+// plane, Width x Height bytes, and neutral chroma. Every access unit
+// carries the parameter sets, so decoding can start anywhere.
+func (p *PictureWriter) Encode(luma []byte) []byte {
+	au := nal(nalAUD, 0, []byte{0x10})
+	au = append(au, nal(nalSPS, 3, p.sps())...)
+	au = append(au, nal(nalPPS, 3, p.pps())...)
+	au = append(au, nal(nalSlice, 3, p.slice(luma))...)
+
+	// Two IDR pictures in a row must have different ids
+	p.idr ^= 1
+	return au
+}
+
+func (p *PictureWriter) sps() []byte {
+	var w bitWriter
+	// profile_idc 66, constraint_set0 and 1, level 3.0
+	w.bits(66, 8)
+	w.bits(0xc0, 8)
+	w.bits(30, 8)
+	w.ue(0) // seq_parameter_set_id
+	w.ue(0) // log2_max_frame_num_minus4
+	w.ue(2) // pic_order_cnt_type: output order is decoding order
+	w.ue(0) // max_num_ref_frames
+	w.bit(0)
+	w.ue(p.Width/16 - 1)
+	w.ue(p.Height/16 - 1)
+	w.bit(1) // frame_mbs_only_flag
+	w.bit(1) // direct_8x8_inference_flag
+	w.bit(0) // frame_cropping_flag
+	w.bit(0) // vui_parameters_present_flag
+	return w.trailing()
+}
+
+func (p *PictureWriter) pps() []byte {
+	var w bitWriter
+	w.ue(0)  // pic_parameter_set_id
+	w.ue(0)  // seq_parameter_set_id
+	w.bit(0) // entropy_coding_mode_flag: CAVLC
+	w.bit(0)
+	w.ue(0) // num_slice_groups_minus1
+	w.ue(0)
+	w.ue(0)
+	w.bit(0)
+	w.bits(0, 2)
+	w.se(0) // pic_init_qp_minus26
+	w.se(0)
+	w.se(0)
+	w.bit(1) // deblocking_filter_control_present_flag
+	w.bit(0)
+	w.bit(0)
+	return w.trailing()
+}
+
+func (p *PictureWriter) slice(luma []byte) []byte {
+	var w bitWriter
+	w.ue(0) // first_mb_in_slice
+	w.ue(7) // slice_type: I, as every slice of the picture
+	w.ue(0) // pic_parameter_set_id
+	w.bits(0, 4)
+	w.ue(p.idr)
+	w.bit(0) // no_output_of_prior_pics_flag
+	w.bit(0) // long_term_reference_flag
+	w.se(0)  // slice_qp_delta
+	w.ue(1)  // disable_deblocking_filter_idc
+
+	for y := 0; y < p.Height; y += 16 {
+		for x := 0; x < p.Width; x += 16 {
+			w.ue(mbTypePCM)
+			w.align()
+			for row := range 16 {
+				start := (y+row)*p.Width + x
+				w.bytes(luma[start : start+16])
+			}
+			// Cb then Cr, 8x8 each
+			for range 2 * 64 {
+				w.bits(128, 8)
+			}
+		}
+	}
+
+	return w.trailing()
+}
+
+// nal returns a NAL unit with its start code, emulation prevention bytes
+// inserted.
+func nal(unitType int, refIdc int, rbsp []byte) []byte {
+	unit := []byte{0, 0, 0, 1, byte(refIdc<<5 | unitType)}
+
+	zeros := 0
+	for _, b := range rbsp {
+		if zeros == 2 && b <= 3 {
+			unit = append(unit, 3)
+			zeros = 0
+		}
+		unit = append(unit, b)
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	return unit
+}
+
+// bitWriter writes the big endian bit strings of H.264 syntax elements.
+type bitWriter struct {
+	data  []byte
+	count int
+}
+
+func (w *bitWriter) bit(b int) {
+	if w.count%8 == 0 {
+		w.data = append(w.data, 0)
+	}
+	if b != 0 {
+		w.data[len(w.data)-1] |= 0x80 >> (w.count % 8)
+	}
+	w.count++
+}
+
+func (w *bitWriter) bits(v int, n int) {
+	for i := n - 1; i >= 0; i-- {
+		w.bit(v >> i & 1)
+	}
+}
+
+// ue writes an unsigned Exp-Golomb code.
+func (w *bitWriter) ue(v int) {
+	n := 0
+	for (v+1)>>n > 1 {
+		n++
+	}
+	w.bits(0, n)
+	w.bits(v+1, n+1)
+}
+
+// se writes a signed Exp-Golomb code.
+func (w *bitWriter) se(v int) {
+	if v > 0 {
+		w.ue(2*v - 1)
+	} else {
+		w.ue(-2 * v)
+	}
+}
+
+func (w *bitWriter) align() {
+	for w.count%8 != 0 {
+		w.bit(0)
+	}
+}
+
+// bytes writes whole bytes, the writer being aligned.
+func (w *bitWriter) bytes(b []byte) {
+	w.data = append(w.data, b...)
+	w.count += 8 * len(b)
+}
+
+// trailing ends the RBSP with its stop bit and returns it.
+func (w *bitWriter) trailing() []byte {
+	w.bit(1)
+	w.align()
+	return w.data
+}
@@ -0,0 +1,38 @@
+package synth
+
+import "fmt"
+
+// LPCM is written as on Blu-ray: a 4-byte header then big endian samples.
+// Mono is not padded right by every reader, so the tone goes to both
+// channels of a stereo stream.
+
+// lpcmRateCodes are the sample rates Blu-ray LPCM can carry.
+var lpcmRateCodes = map[int]int{48000: 1, 96000: 4, 192000: 5}
+
+const (
+	lpcmStereo = 3
+	lpcm16Bit  = 1
+)
+
+// ValidLPCMRate reports whether LPCM can carry audio at rate.
+func ValidLPCMRate(rate int) error {
+	if _, ok := lpcmRateCodes[rate]; !ok {
+		return fmt.Errorf("LPCM sample rate must be 48000, 96000 or 192000, not %d", rate)
+	}
+	return nil
+}
+
+// encodeLPCM returns the PES payload of mono samples at rate, written as
+// 16-bit stereo.
+func encodeLPCM(samples []int16, rate int) []byte {
+	size := 4 * len(samples)
+	data := make([]byte, 4, 4+size)
+	data[0], data[1] = byte(size>>8), byte(size)
+	data[2] = lpcmStereo<<4 | byte(lpcmRateCodes[rate])
+	data[3] = lpcm16Bit << 6
+
+	for _, s := range samples {
+		data = append(data, byte(s>>8), byte(s), byte(s>>8), byte(s))
+	}
+	return data
+}
@@ -0,0 +1,484 @@
+// Package synth generates a flash and beep sync pattern as an MPEG
+// transport stream, with sync faults injected at known places, together
+// with the ground truth a correct measurement of it must find.
+package synth
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+
+	"find_desync/mpegts"
+)
+
+const (
+	// Width and Height are the size of the pictures, in pixels.
+	Width  = 96
+	Height = 64
+
+	black = 16
+	white = 235
+
+	// audioFrameRate is the number of audio frames per second, 20 ms each.
+	audioFrameRate = 50
+
+	toneFrequency = 1000
+	toneAmplitude = 16384
+
+	// eventLength is how long a flash and a beep last, in seconds.
+	eventLength = 0.1
+
+	// muxDelay is how long before its PTS a frame is sent, on the PCR
+	// clock, and pcrInterval the longest time between two PCRs.
+	muxDelay    = 0.2
+	pcrInterval = 0.04
+
+	// epsilon absorbs rounding when a time falls exactly on a frame or a
+	// sample.
+	epsilon = 1e-9
+)
+
+// Faults are the sync faults to inject. Times are in seconds from the first
+// video frame, or for the audio faults from the first audio frame.
+type Faults struct {
+	// Offset is how many seconds the sound is stamped after the picture,
+	// negative when before.
+	Offset float64 `json:"offset"`
+	// DriftPPM plays the sound that much slower, its timestamps staying
+	// regular as after a tempo change: the offset grows by that many
+	// microseconds per second.
+	DriftPPM float64 `json:"drift_ppm"`
+	// DriftTimestamps puts DriftPPM in the timestamps instead of the
+	// sound: the audio PTS and the PCR run that many ppm fast against the
+	// video PTS, as from an encoder whose audio clock drives the PCR.
+	DriftTimestamps bool `json:"drift_timestamps,omitempty"`
+	// Every DropEvery seconds, DropLength seconds of audio are left out.
+	DropEvery  float64 `json:"drop_every,omitempty"`
+	DropLength float64 `json:"drop_length,omitempty"`
+	// Every timestamp and the PCR jump by JumpSize seconds once the stream
+	// has been sent for JumpAt seconds.
+	JumpAt   float64 `json:"jump_at,omitempty"`
+	JumpSize float64 `json:"jump_size,omitempty"`
+	// AudioStart leaves out the audio before that time.
+	AudioStart float64 `json:"audio_start,omitempty"`
+}
+
+// Config describes the stream to generate.
+type Config struct {
+	Duration   float64 `json:"duration"`
+	FrameRate  int     `json:"frame_rate"`
+	SampleRate int     `json:"sample_rate"`
+	// Interval is the mean number of seconds between two flashes.
+	Interval float64 `json:"interval"`
+	// Start is the PTS of the first video frame, in seconds.
+	Start  float64 `json:"start"`
+	Faults Faults  `json:"faults"`
+}
+
+// Validate checks the config can be generated.
+func (c Config) Validate() error {
+	switch {
+	case c.Duration <= 0:
+		return errors.New("duration must be positive")
+	case c.FrameRate < 1 || c.FrameRate > 120:
+		return fmt.Errorf("frame rate must be between 1 and 120, not %d", c.FrameRate)
+	case c.Interval < 6*eventLength:
+		// Scattered by up to half the interval, flashes stay 3 event
+		// lengths apart
+		return fmt.Errorf("flashes must be at least %.1f seconds apart on average", 6*eventLength)
+	case c.Faults.DropLength < 0 || c.Faults.DropEvery < 0 || c.Faults.AudioStart < 0 || c.Faults.JumpAt < 0:
+		return errors.New("drop, jump and audio start times cannot be negative")
+	case c.Faults.DropLength > 0 && c.Faults.DropLength >= c.Faults.DropEvery:
+		return errors.New("audio drops must be shorter than the time between them")
+	case c.Faults.DriftPPM <= -1e6:
+		return errors.New("drift must be above -1000000 ppm")
+	case c.Faults.DriftTimestamps && math.Abs(c.Faults.DriftPPM)*1e-6*c.Duration >= muxDelay:
+		// Further, the video would be sent after its PTS on the PCR clock
+		return fmt.Errorf("timestamp drift must stay below %.1f seconds over the duration", muxDelay)
+	}
+
+	// Timestamps before zero would wrap back to the end of the 33-bit range
+	if earliest := c.Start + min(c.Faults.Offset, 0) + min(c.Faults.JumpSize, 0); earliest < 0 {
+		return fmt.Errorf("timestamps would start %.3f seconds before zero, start later", -earliest)
+	}
+
+	return ValidLPCMRate(c.SampleRate)
+}
+
+// Event is a flash and its beep on the presentation timeline, in seconds
+// from the first video frame. Offset is how many seconds the beep comes
+// after the flash.
+type Event struct {
+	Flash  float64 `json:"flash"`
+	Beep   float64 `json:"beep"`
+	Offset float64 `json:"offset"`
+}
+
+// Drop is audio left out, in seconds of presentation time from the first
+// video frame.
+type Drop struct {
+	Time   float64 `json:"time"`
+	Length float64 `json:"length"`
+}
+
+// Discontinuity is a jump of every timestamp, Time being when it happens
+// in seconds of presentation time from the first video frame, before the
+// jump.
+type Discontinuity struct {
+	Time float64 `json:"time"`
+	Jump float64 `json:"jump"`
+}
+
+// Truth is what a correct measurement of the generated stream finds.
+// Offsets are audio minus video, in seconds.
+type Truth struct {
+	Config
+	VideoFrames int `json:"video_frames"`
+	AudioFrames int `json:"audio_frames"`
+	// FirstAudio is the PTS of the first audio frame minus the one of the
+	// first video frame, in seconds.
+	FirstAudio  float64 `json:"first_audio"`
+	OffsetStart float64 `json:"offset_start"`
+	OffsetEnd   float64 `json:"offset_end"`
+	DriftPPM    float64 `json:"drift_ppm"`
+	// MissingAudio is the total length of the drops, without the late
+	// start.
+	MissingAudio    float64         `json:"missing_audio"`
+	Drops           []Drop          `json:"drops"`
+	Discontinuities []Discontinuity `json:"discontinuities"`
+	// Wraps is the number of times the video PTS rolls over 33 bits.
+	Wraps  int     `json:"wraps"`
+	Events []Event `json:"events"`
+}
+
+// Generator writes the test pattern of a config.
+type Generator struct {
+	config      Config
+	videoFrames int
+	audioFrames int
+	// audioFrameSize is the number of samples of an audio frame.
+	audioFrameSize int
+	picture        PictureWriter
+}
+
+func New(config Config) (*Generator, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &Generator{
+		config:         config,
+		videoFrames:    int(math.Ceil(config.Duration*float64(config.FrameRate) - epsilon)),
+		audioFrames:    int(math.Ceil(config.Duration*audioFrameRate - epsilon)),
+		audioFrameSize: config.SampleRate / audioFrameRate,
+		picture:        PictureWriter{Width: Width, Height: Height},
+	}, nil
+}
+
+// videoClock is when video frame k is sent, before any jump: its PTS in
+// seconds.
+func (g *Generator) videoClock(k int) float64 {
+	return g.config.Start + float64(k)/float64(g.config.FrameRate)
+}
+
+// audioClock is when audio frame j is sent, before any jump: its PTS in
+// seconds.
+func (g *Generator) audioClock(j int) float64 {
+	return g.config.Start + g.config.Faults.Offset + float64(j)/audioFrameRate
+}
+
+// audioPTS is the PTS of audio frame j in seconds, before any jump.
+func (g *Generator) audioPTS(j int) float64 {
+	return g.config.Start + g.config.Faults.Offset + float64(j)/audioFrameRate*g.timestampRate()
+}
+
+// pcrStamp is the PCR in seconds, before any jump, sent at clock.
+func (g *Generator) pcrStamp(clock float64) float64 {
+	if !g.config.Faults.DriftTimestamps {
+		return clock
+	}
+	return g.config.Start + (clock-g.config.Start)*g.timestampRate()
+}
+
+// timestampRate is how fast the audio timestamps and the PCR run against
+// the video ones.
+func (g *Generator) timestampRate() float64 {
+	if g.config.Faults.DriftTimestamps {
+		return 1 + g.config.Faults.DriftPPM*1e-6
+	}
+	return 1
+}
+
+// contentRate is the sample rate the sound is generated at so that played
+// at the nominal rate it drifts by DriftPPM.
+func (g *Generator) contentRate() float64 {
+	if g.config.Faults.DriftTimestamps {
+		return float64(g.config.SampleRate)
+	}
+	return float64(g.config.SampleRate) * (1 + g.config.Faults.DriftPPM*1e-6)
+}
+
+// jump is how many seconds the timestamps of what is sent at clock jump.
+func (g *Generator) jump(clock float64) float64 {
+	f := g.config.Faults
+	if f.JumpSize != 0 && clock-g.config.Start >= f.JumpAt-epsilon {
+		return f.JumpSize
+	}
+	return 0
+}
+
+// dropped reports whether audio frame j is left out.
+func (g *Generator) dropped(j int) bool {
+	f := g.config.Faults
+	t := float64(j) / audioFrameRate
+
+	if t < f.AudioStart-epsilon {
+		return true
+	}
+
+	if f.DropEvery > 0 && f.DropLength > 0 {
+		n := math.Floor(t/f.DropEvery + epsilon)
+		return n >= 1 && t-n*f.DropEvery < f.DropLength-epsilon
+	}
+	return false
+}
+
+// eventTime is when flash and beep n start, in seconds of content. They
+// come every Interval, each pushed back by up to half of it in a fixed
+// irregular way, so the pattern only lines up with itself at one shift
+// and an offset of whole intervals cannot pass for none.
+func (g *Generator) eventTime(n int) float64 {
+	return (float64(n) + scatter(n)/2) * g.config.Interval
+}
+
+// scatter maps n to a number in [0, 1) that looks random, 0 for 0. It is
+// the splitmix64 finalizer.
+func scatter(n int) float64 {
+	x := uint64(n) * 0x9e3779b97f4a7c15
+	x = (x ^ x>>30) * 0xbf58476d1ce4e5b9
+	x = (x ^ x>>27) * 0x94d049bb133111eb
+	x ^= x >> 31
+	return float64(x>>11) / (1 << 53)
+}
+
+// eventStart is the index of the first frame or sample, at rate per
+// second, of flash and beep n.
+func (g *Generator) eventStart(n int, rate float64) int {
+	return int(math.Ceil(g.eventTime(n)*rate - epsilon))
+}
+
+// inEvent reports whether frame or sample i, at rate per second, belongs
+// to a flash or a beep, and how far into it.
+func (g *Generator) inEvent(i int, rate float64) (int, bool) {
+	n := int(math.Floor(float64(i)/(g.config.Interval*rate) + epsilon))
+	if i < g.eventStart(n, rate) {
+		n--
+	}
+	if n < 0 {
+		return 0, false
+	}
+
+	into := i - g.eventStart(n, rate)
+	return into, into < max(1, int(math.Round(eventLength*rate)))
+}
+
+func (g *Generator) videoFrame(k int, planes [2][]byte) []byte {
+	if _, ok := g.inEvent(k, float64(g.config.FrameRate)); ok {
+		return g.picture.Encode(planes[1])
+	}
+	return g.picture.Encode(planes[0])
+}
+
+func (g *Generator) audioFrame(j int) []byte {
+	rate := float64(g.config.SampleRate)
+	samples := make([]int16, g.audioFrameSize)
+
+	// The beeps are placed on the drifting content timeline but keep their
+	// pitch
+	for i := range samples {
+		if into, ok := g.inEvent(j*g.audioFrameSize+i, g.contentRate()); ok {
+			samples[i] = int16(toneAmplitude * math.Sin(2*math.Pi*toneFrequency*float64(into)/rate))
+		}
+	}
+	return encodeLPCM(samples, g.config.SampleRate)
+}
+
+// Write writes the stream to w. pace, when set, is called before every
+// frame and PCR with the PCR it carries in seconds, before any jump, so
+// the caller can send it in real time.
+func (g *Generator) Write(w io.Writer, pace func(clock float64) error) error {
+	mux := mpegts.NewMuxer(w)
+	// The HDMV registration makes 0x80 LPCM audio
+	mux.ProgramDescriptors = []byte{0x05, 4, 'H', 'D', 'M', 'V'}
+	video := mux.AddStream(mpegts.MuxStream{StreamType: 0x1b, StreamID: 0xe0})
+	audio := mux.AddStream(mpegts.MuxStream{StreamType: 0x80, StreamID: 0xbd})
+
+	var planes [2][]byte
+	for i, level := range []byte{black, white} {
+		planes[i] = make([]byte, Width*Height)
+		for p := range planes[i] {
+			planes[i][p] = level
+		}
+	}
+
+	// The first packet of each PID after the jump flags the discontinuity
+	var flagged [2]bool
+	lastPCR := math.Inf(-1)
+
+	k, j := 0, 0
+	for {
+		for j < g.audioFrames && g.dropped(j) {
+			j++
+		}
+		if k >= g.videoFrames && j >= g.audioFrames {
+			return nil
+		}
+
+		isVideo := j >= g.audioFrames || k < g.videoFrames && g.videoClock(k) <= g.audioClock(j)
+		clock := g.audioClock(j)
+		if isVideo {
+			clock = g.videoClock(k)
+		}
+
+		// At low frame rates, PCR-only packets keep the PCR interval
+		for !math.IsInf(lastPCR, -1) && lastPCR+pcrInterval < clock-muxDelay-epsilon {
+			lastPCR += pcrInterval
+			if pace != nil {
+				if err := pace(lastPCR); err != nil {
+					return err
+				}
+			}
+
+			jump := g.jump(lastPCR + muxDelay)
+			discontinuity := jump != 0 && !flagged[video]
+			flagged[video] = flagged[video] || discontinuity
+			if err := mux.WritePCR(ticks(g.pcrStamp(lastPCR)+jump, mpegts.PCRRate), discontinuity); err != nil {
+				return err
+			}
+		}
+
+		if pace != nil {
+			if err := pace(clock - muxDelay); err != nil {
+				return err
+			}
+		}
+
+		jump := g.jump(clock)
+		frame := mpegts.MuxFrame{Stream: audio, RandomAccess: true}
+		if isVideo {
+			frame.Stream = video
+			frame.PTS = ticks(clock+jump, mpegts.ClockRate)
+			frame.Data = g.videoFrame(k, planes)
+			frame.PCR = ticks(g.pcrStamp(clock-muxDelay)+jump, mpegts.PCRRate)
+			frame.HasPCR = true
+			lastPCR = clock - muxDelay
+			k++
+		} else {
+			frame.PTS = ticks(g.audioPTS(j)+jump, mpegts.ClockRate)
+			frame.Data = g.audioFrame(j)
+			j++
+		}
+
+		frame.Discontinuity = jump != 0 && !flagged[frame.Stream]
+		flagged[frame.Stream] = flagged[frame.Stream] || frame.Discontinuity
+
+		if err := mux.WriteFrame(frame); err != nil {
+			return err
+		}
+	}
+}
+
+func ticks(seconds float64, rate int64) int64 {
+	return int64(math.Round(seconds * float64(rate)))
+}
+
+// Truth returns what the generated stream should measure as.
+func (g *Generator) Truth() Truth {
+	c := g.config
+	f := c.Faults
+
+	truth := Truth{
+		Config:          c,
+		VideoFrames:     g.videoFrames,
+		OffsetStart:     f.Offset,
+		OffsetEnd:       f.Offset + f.DriftPPM*1e-6*c.Duration,
+		DriftPPM:        f.DriftPPM,
+		Drops:           []Drop{},
+		Discontinuities: []Discontinuity{},
+		Events:          []Event{},
+	}
+
+	first := -1
+	var drop *Drop
+	for j := range g.audioFrames {
+		if !g.dropped(j) {
+			truth.AudioFrames++
+			if first < 0 {
+				first = j
+			}
+			drop = nil
+			continue
+		}
+
+		// The late start is not a drop
+		if first < 0 {
+			continue
+		}
+
+		length := g.audioPTS(j+1) - g.audioPTS(j)
+		truth.MissingAudio += length
+		if drop == nil {
+			truth.Drops = append(truth.Drops, Drop{Time: g.audioPresentation(j)})
+			drop = &truth.Drops[len(truth.Drops)-1]
+		}
+		drop.Length += length
+	}
+
+	if first >= 0 {
+		truth.FirstAudio = g.audioPresentation(first)
+	}
+
+	if f.JumpSize != 0 && f.JumpAt < c.Duration {
+		truth.Discontinuities = append(truth.Discontinuities, Discontinuity{Time: f.JumpAt, Jump: f.JumpSize})
+	}
+
+	firstPTS := ticks(g.videoClock(0), mpegts.ClockRate)
+	lastPTS := ticks(g.presentation(g.videoClock(g.videoFrames-1))+c.Start, mpegts.ClockRate)
+	truth.Wraps = int(lastPTS>>mpegts.TimestampBits - firstPTS>>mpegts.TimestampBits)
+
+	for n := 0; ; n++ {
+		flash := g.eventStart(n, float64(c.FrameRate))
+		beep := g.eventStart(n, g.contentRate())
+		if flash >= g.videoFrames {
+			break
+		}
+
+		j := beep / g.audioFrameSize
+		if j >= g.audioFrames || g.dropped(j) {
+			continue
+		}
+
+		// Within its frame a sample plays at the nominal rate
+		event := Event{
+			Flash: g.presentation(g.videoClock(flash)),
+			Beep:  g.audioPresentation(j) + float64(beep-j*g.audioFrameSize)/float64(c.SampleRate),
+		}
+		event.Offset = event.Beep - event.Flash
+		truth.Events = append(truth.Events, event)
+	}
+
+	return truth
+}
+
+// presentation turns the clock a frame is sent at into its PTS, from the
+// first video frame, in seconds.
+func (g *Generator) presentation(clock float64) float64 {
+	return clock + g.jump(clock) - g.config.Start
+}
+
+// audioPresentation is the PTS of audio frame j from the first video
+// frame, in seconds.
+func (g *Generator) audioPresentation(j int) float64 {
+	return g.audioPTS(j) + g.jump(g.audioClock(j)) - g.config.Start
+}
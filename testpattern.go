@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"sort"
+
+	"find_desync/analysis"
+
+	"github.com/fatih/color"
+	"github.com/rodaine/table"
+)
+
+// The testpattern method decodes the video at 100 frames per second, so a
+// flash is timed to 10 ms whatever the source frame rate, and times the
+// beeps to 1 ms.
+const (
+	patternFrameRate = 100
+	patternBinRate   = 1000
+	// patternMinLuma and patternMinLevel are the brightness, out of 255,
+	// and the RMS amplitude, out of 32768, a flash and a beep must rise
+	// above the rest of the clip.
+	patternMinLuma  = 20
+	patternMinLevel = 300
+	// patternRefractory is the shortest time between two flashes or two
+	// beeps, shorter rises are part of the same one.
+	patternRefractory = 0.25
+)
+
+var ErrNoPattern = errors.New("no flash could be matched with a beep")
+
+// PatternEvent is a flash matched with its beep. Offset is how many
+// seconds the beep comes after the flash.
+type PatternEvent struct {
+	Flash  float64 `json:"flash"`
+	Beep   float64 `json:"beep"`
+	Offset float64 `json:"offset"`
+}
+
+// PatternInfo holds a testpattern measurement. Diff is the mean offset of
+// the events and Trend its fit over time, set when HasTrend is.
+type PatternInfo struct {
+	ApartName  string
+	CameraHash string
+	Source     string
+	Flashes    int
+	Beeps      int
+	Events     []PatternEvent
+	Diff       float64
+	StdDev     float64
+	Trend      analysis.DriftEstimate
+	HasTrend   bool
+	Verdict    string
+}
+
+func NewPatternInfo(apartName, uri string) PatternInfo {
+	return PatternInfo{
+		ApartName:  apartName,
+		CameraHash: CameraID(uri),
+		Source:     Redact(uri),
+	}
+}
+
+// TestPattern measures the offset of a sync test clip played into the
+// camera: it finds every flash in the picture and every beep in the sound
+// and reports the offset of each pair, the ground truth for the timestamp
+// based methods.
+func (a *Analyzer) TestPattern(ctx context.Context, uri string, count int, apart string, direct bool, useTime bool) (PatternInfo, error) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+
+	length := count
+	if !useTime {
+		length = max(count/contentFrameRate, 1)
+	}
+
+	var sourceFile string
+
+	if !direct {
+		var err error
+		sourceFile, err = a.recordTempFile(ctx, uri, length, false)
+		if err != nil {
+			return PatternInfo{}, err
+		}
+		defer a.options.Workspace.Release(sourceFile)
+	} else {
+		sourceFile = uri
+	}
+
+	audio, video, err := a.decodeMedia(ctx, sourceFile, length, patternFrameRate)
+	if err != nil {
+		logger.Error(fmt.Sprintf("Error decoding: %v", err))
+		return PatternInfo{}, err
+	}
+
+	flashes := analysis.Bursts(analysis.Luma(video, contentWidth*contentHeight), patternFrameRate, patternMinLuma, patternRefractory)
+	beeps := analysis.Bursts(analysis.RMS(samples(audio), contentSampleRate/patternBinRate), patternBinRate, patternMinLevel, patternRefractory)
+
+	fmt.Fprintf(a.out, "\n=== Stream: %s ===\n", Redact(uri))
+	fmt.Fprintf(a.out, "Found %d flashes and %d beeps\n", len(flashes), len(beeps))
+
+	pairs := analysis.PairEvents(flashes, beeps, patternMaxOffset(flashes))
+	if len(pairs) == 0 {
+		a.yellow("No flash matched with a beep, is the test clip playing?")
+		return PatternInfo{}, ErrNoPattern
+	}
+
+	patternInfo := NewPatternInfo(apart, uri)
+	patternInfo.Flashes = len(flashes)
+	patternInfo.Beeps = len(beeps)
+
+	offsets := make([]analysis.Sample, len(pairs))
+	for i, pair := range pairs {
+		patternInfo.Events = append(patternInfo.Events, PatternEvent{Flash: pair.Flash, Beep: pair.Beep, Offset: pair.Offset()})
+		offsets[i] = analysis.Sample{Time: pair.Flash, Offset: pair.Offset()}
+		patternInfo.Diff += pair.Offset()
+	}
+	patternInfo.Diff /= float64(len(pairs))
+
+	for _, event := range patternInfo.Events {
+		patternInfo.StdDev += (event.Offset - patternInfo.Diff) * (event.Offset - patternInfo.Diff)
+	}
+	patternInfo.StdDev = math.Sqrt(patternInfo.StdDev / float64(len(pairs)))
+
+	if trend, err := analysis.EstimateDrift(offsets); err == nil {
+		patternInfo.Trend = trend
+		patternInfo.HasTrend = true
+	}
+
+	if patternInfo.Diff > lipSyncLag || patternInfo.Diff < -lipSyncLead {
+		patternInfo.Verdict = VerdictDesynced
+	} else {
+		patternInfo.Verdict = VerdictInSync
+	}
+
+	a.printPattern(patternInfo)
+
+	return patternInfo, nil
+}
+
+// patternMaxOffset is half the usual time between flashes, so a beep is
+// never matched with the flash before or after its own, and at most
+// contentMaxLag.
+func patternMaxOffset(flashes []float64) float64 {
+	if len(flashes) < 2 {
+		return contentMaxLag
+	}
+
+	intervals := make([]float64, len(flashes)-1)
+	for i := range intervals {
+		intervals[i] = flashes[i+1] - flashes[i]
+	}
+	sort.Float64s(intervals)
+
+	return math.Min(intervals[len(intervals)/2]/2, contentMaxLag)
+}
+
+func (a *Analyzer) printPattern(p PatternInfo) {
+	headerFmt := color.New(color.FgGreen, color.Underline).SprintfFunc()
+	columnFmt := color.New(color.FgYellow).SprintfFunc()
+
+	tbl := table.New("#", "Flash time", "Beep time", "Offset ms")
+	tbl.WithHeaderFormatter(headerFmt).WithFirstColumnFormatter(columnFmt).WithWriter(a.out)
+
+	for i, event := range p.Events {
+		tbl.AddRow(i+1, fmt.Sprintf("%.3f", event.Flash), fmt.Sprintf("%.3f", event.Beep), fmt.Sprintf("%.0f", event.Offset*1000))
+	}
+
+	tbl.Print()
+
+	fmt.Fprintf(a.out, "\n=== ANALYSIS ===\n")
+	fmt.Fprintf(a.out, "Events:              %d of %d flashes and %d beeps matched\n", len(p.Events), p.Flashes, p.Beeps)
+	fmt.Fprintf(a.out, "Sound after picture: %.3f seconds mean, %.3f standard deviation\n", p.Diff, p.StdDev)
+	if p.HasTrend {
+		fmt.Fprintf(a.out, "Trend:               %.1f ppm, %.1f ms/hour (95%% CI %.1f .. %.1f ppm)\n",
+			p.Trend.PPM(), p.Trend.MsPerHour(), p.Trend.SlopeLow*1e6, p.Trend.SlopeHigh*1e6)
+	}
+
+	if p.Verdict == VerdictDesynced {
+		if p.Diff > 0 {
+			a.red("\nSOUND LATE by %.0f ms", p.Diff*1000)
+		} else {
+			a.red("\nSOUND EARLY by %.0f ms", -p.Diff*1000)
+		}
+	} else {
+		a.green("\nSound and picture are in sync")
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"find_desync/analysis"
+	"find_desync/probe"
+
+	"github.com/fatih/color"
+	"github.com/rodaine/table"
+)
+
+// defaultMaxJump is the forward timestamp step, in frame durations, taken
+// as a discontinuity when Options.MaxJump is not set.
+const defaultMaxJump = 10
+
+// DiscontinuityInfo is a timestamp jump in one stream. Frame is the number
+// of the first frame after the jump and Pos its byte offset, -1 when
+// unknown. Time is the timestamp before the jump and Jump the step beyond
+// one frame duration, negative when the timestamps went backwards.
+type DiscontinuityInfo struct {
+	Stream probe.MediaType `json:"stream"`
+	Frame  int             `json:"frame"`
+	Pos    int64           `json:"pos"`
+	Time   float64         `json:"time"`
+	Jump   float64         `json:"jump"`
+}
+
+// SegmentInfo is the drift fit of a stretch of the source where neither
+// stream has a discontinuity. Start and End are video PTS times.
+type SegmentInfo struct {
+	Start       float64 `json:"start"`
+	End         float64 `json:"end"`
+	VideoFrames int     `json:"video_frames"`
+	AudioFrames int     `json:"audio_frames"`
+	Pairs       int     `json:"pairs"`
+	Fitted      bool    `json:"fitted"`
+	Offset      float64 `json:"offset"`
+	PPM         float64 `json:"ppm"`
+}
+
+// decodeTimes returns the frame times in decoding order: the DTS when every
+// frame has one, the PTS otherwise.
+func decodeTimes(frames []probe.Frame) []float64 {
+	useDts := len(frames) > 0
+	for _, f := range frames {
+		if !f.HasPktDts {
+			useDts = false
+			break
+		}
+	}
+
+	times := make([]float64, len(frames))
+	for i, f := range frames {
+		if useDts {
+			times[i] = f.TimeBase.Seconds(f.PktDts)
+		} else {
+			times[i] = f.PtsTime()
+		}
+	}
+	return times
+}
+
+// findDiscontinuities returns the index of the first frame after each
+// timestamp jump of the stream, and the jumps themselves.
+func (a *Analyzer) findDiscontinuities(frames []probe.Frame) ([]int, []DiscontinuityInfo) {
+	cuts := []int{}
+	infos := []DiscontinuityInfo{}
+
+	for _, d := range analysis.FindDiscontinuities(decodeTimes(frames), a.options.MaxJump) {
+		f := frames[d.Index]
+		cuts = append(cuts, d.Index)
+		infos = append(infos, DiscontinuityInfo{
+			Stream: f.MediaType,
+			Frame:  f.Number,
+			Pos:    f.Pos,
+			Time:   d.Time,
+			Jump:   d.Jump,
+		})
+	}
+
+	return cuts, infos
+}
+
+// trackSegment is a stretch of both streams without discontinuities.
+type trackSegment struct {
+	video []probe.Frame
+	audio []probe.Frame
+}
+
+// splitSegments cuts both streams at every discontinuity of either. In
+// interleaved mode a jump of one stream cuts the other at the same point of
+// the probe output. Separately probed streams share no order, so each is
+// cut at its own jumps and the segments are matched by position.
+func (a *Analyzer) splitSegments(video, audio []probe.Frame, videoCuts, audioCuts []int) []trackSegment {
+	if len(videoCuts) == 0 && len(audioCuts) == 0 {
+		return []trackSegment{{video, audio}}
+	}
+
+	if a.options.ProbeMode == ProbeSeparate {
+		videoParts := splitAt(video, videoCuts)
+		audioParts := splitAt(audio, audioCuts)
+		if len(videoParts) != len(audioParts) {
+			a.yellow("Video has %d segments and audio %d, only the first %d are compared",
+				len(videoParts), len(audioParts), min(len(videoParts), len(audioParts)))
+		}
+
+		segments := []trackSegment{}
+		for i := 0; i < min(len(videoParts), len(audioParts)); i++ {
+			segments = append(segments, trackSegment{videoParts[i], audioParts[i]})
+		}
+		return segments
+	}
+
+	arrivals := []int{}
+	for _, i := range videoCuts {
+		arrivals = append(arrivals, video[i].Arrival)
+	}
+	for _, i := range audioCuts {
+		arrivals = append(arrivals, audio[i].Arrival)
+	}
+	sort.Ints(arrivals)
+
+	// A reset of both streams reaches the output a few frames apart: skip
+	// the cuts that would leave a segment without frames of one stream
+	videoAt, audioAt := cutsAt(video, arrivals), cutsAt(audio, arrivals)
+	videoKept, audioKept := []int{}, []int{}
+	lastVideo, lastAudio := 0, 0
+
+	for i := range arrivals {
+		if videoAt[i] == lastVideo || audioAt[i] == lastAudio {
+			continue
+		}
+		videoKept = append(videoKept, videoAt[i])
+		audioKept = append(audioKept, audioAt[i])
+		lastVideo, lastAudio = videoAt[i], audioAt[i]
+	}
+
+	if n := len(videoKept); n > 0 && (lastVideo == len(video) || lastAudio == len(audio)) {
+		videoKept, audioKept = videoKept[:n-1], audioKept[:n-1]
+	}
+
+	videoParts := splitAt(video, videoKept)
+	audioParts := splitAt(audio, audioKept)
+
+	segments := make([]trackSegment, len(videoParts))
+	for i := range segments {
+		segments[i] = trackSegment{videoParts[i], audioParts[i]}
+	}
+	return segments
+}
+
+// cutsAt returns, for each arrival, the index of the first frame that
+// arrived at or after it.
+func cutsAt(frames []probe.Frame, arrivals []int) []int {
+	cuts := make([]int, len(arrivals))
+	for i, arrival := range arrivals {
+		cuts[i] = sort.Search(len(frames), func(j int) bool { return frames[j].Arrival >= arrival })
+	}
+	return cuts
+}
+
+// splitAt cuts frames before each of the sorted indices.
+func splitAt(frames []probe.Frame, cuts []int) [][]probe.Frame {
+	parts := [][]probe.Frame{}
+	start := 0
+	for _, cut := range cuts {
+		parts = append(parts, frames[start:cut])
+		start = cut
+	}
+	return append(parts, frames[start:])
+}
+
+// segmentFit is the drift analysis of one trackSegment.
+type segmentFit struct {
+	trackSegment
+	pairs    []analysis.Pair
+	samples  []analysis.Sample
+	estimate analysis.DriftEstimate
+	err      error
+}
+
+// fitSegment pairs the frames of the segment and fits the offset of each
+// pair over media time. Only a pairing failure is returned as an error, a
+// segment too short to fit keeps it in err.
+func (a *Analyzer) fitSegment(segment trackSegment) (segmentFit, error) {
+	pairs, err := a.pairTracks(segment.video, segment.audio)
+	if err != nil {
+		return segmentFit{}, err
+	}
+
+	fit := segmentFit{trackSegment: segment, pairs: pairs}
+
+	// Offset of audio against video for each packet pair, over media time
+	fit.samples = make([]analysis.Sample, len(pairs))
+	for i, pair := range pairs {
+		fit.samples[i] = analysis.Sample{
+			Time:   segment.video[pair.Video].PtsTime(),
+			Offset: pair.Offset,
+		}
+	}
+
+	fit.estimate, fit.err = analysis.EstimateDrift(fit.samples)
+	return fit, nil
+}
+
+// longestFit returns the index of the fitted segment with the most pairs,
+// -1 when none could be fitted.
+func longestFit(fits []segmentFit) int {
+	best := -1
+	for i, fit := range fits {
+		if fit.err == nil && (best < 0 || len(fit.samples) > len(fits[best].samples)) {
+			best = i
+		}
+	}
+	return best
+}
+
+func segmentInfo(fit segmentFit) SegmentInfo {
+	info := SegmentInfo{
+		VideoFrames: len(fit.video),
+		AudioFrames: len(fit.audio),
+		Pairs:       len(fit.pairs),
+		Fitted:      fit.err == nil,
+	}
+
+	if len(fit.video) > 0 {
+		info.Start = fit.video[0].PtsTime()
+		info.End = fit.video[len(fit.video)-1].PtsTime()
+	}
+
+	if fit.err == nil {
+		info.Offset = fit.estimate.Intercept
+		info.PPM = fit.estimate.PPM()
+	}
+
+	return info
+}
+
+func (a *Analyzer) printDiscontinuities(discontinuities []DiscontinuityInfo) {
+	if len(discontinuities) == 0 {
+		return
+	}
+
+	a.yellow("%d timestamp discontinuities, analyzed as separate segments", len(discontinuities))
+
+	headerFmt := color.New(color.FgGreen, color.Underline).SprintfFunc()
+	columnFmt := color.New(color.FgYellow).SprintfFunc()
+
+	tbl := table.New("Stream", "Frame", "Byte offset", "Time", "Jump")
+	tbl.WithHeaderFormatter(headerFmt).WithFirstColumnFormatter(columnFmt).WithWriter(a.out)
+
+	for _, d := range discontinuities {
+		pos := "-"
+		if d.Pos >= 0 {
+			pos = fmt.Sprint(d.Pos)
+		}
+		tbl.AddRow(d.Stream, d.Frame, pos, fmt.Sprintf("%.3f", d.Time), fmt.Sprintf("%+.3f", d.Jump))
+	}
+
+	tbl.Print()
+}
+
+func (a *Analyzer) printSegments(segments []SegmentInfo, main int) {
+	headerFmt := color.New(color.FgGreen, color.Underline).SprintfFunc()
+	columnFmt := color.New(color.FgYellow).SprintfFunc()
+
+	tbl := table.New("Segment", "Video PTS time", "Frames", "Pairs", "Offset", "Drift ppm")
+	tbl.WithHeaderFormatter(headerFmt).WithFirstColumnFormatter(columnFmt).WithWriter(a.out)
+
+	for i, s := range segments {
+		name := fmt.Sprint(i + 1)
+		if i == main {
+			name += " *"
+		}
+
+		offset, ppm := "-", "-"
+		if s.Fitted {
+			offset = fmt.Sprintf("%.3f", s.Offset)
+			ppm = fmt.Sprintf("%.1f", s.PPM)
+		}
+
+		tbl.AddRow(name, fmt.Sprintf("%.3f .. %.3f", s.Start, s.End), s.VideoFrames, s.Pairs, offset, ppm)
+	}
+
+	tbl.Print()
+	fmt.Fprintln(a.out, "* the longest segment, used for the analysis below")
+}
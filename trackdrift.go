@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+
+	"find_desync/analysis"
+
+	"github.com/fatih/color"
+	"github.com/rodaine/table"
+)
+
+// trackDriftWindow is the length, in seconds, of the windows the paired
+// offsets are averaged over. Windows start every half window, and are
+// shortened so that even a short source gets at least five of them.
+const trackDriftWindow = 4.0
+
+// WindowInfo is the mean audio minus video offset of the pairs in one
+// window of a segment. Start and End are video PTS times, Change is the
+// offset change since the previous window of the segment and Drift since
+// its first window.
+type WindowInfo struct {
+	Segment int     `json:"segment"`
+	Start   float64 `json:"start"`
+	End     float64 `json:"end"`
+	Pairs   int     `json:"pairs"`
+	Offset  float64 `json:"offset"`
+	Change  float64 `json:"change"`
+	Drift   float64 `json:"drift"`
+}
+
+// TrackDriftInfo holds a trackdrift measurement: Diff is the offset of the
+// first window, Change how much it moved by the last one and MaxStep the
+// largest change between two windows in a row, all on the longest segment,
+// which Trend is fitted on.
+type TrackDriftInfo struct {
+	ApartName       string
+	CameraHash      string
+	Source          string
+	Diff            float64
+	Change          float64
+	MaxStep         float64
+	Window          float64
+	VideoFrames     int
+	AudioFrames     int
+	Windows         []WindowInfo
+	Trend           analysis.DriftEstimate
+	Verdict         analysis.Verdict
+	Discontinuities []DiscontinuityInfo
+}
+
+func NewTrackDriftInfo(apartName, uri string) TrackDriftInfo {
+	return TrackDriftInfo{
+		ApartName:  apartName,
+		CameraHash: CameraID(uri),
+		Source:     Redact(uri),
+	}
+}
+
+// TracksDrift follows the audio/video offset over time: it averages the
+// offsets of the paired frames over sliding windows and reports how the
+// average moves from one window to the next.
+func (a *Analyzer) TracksDrift(ctx context.Context, uri string, time int, apart string, direct bool, useTime bool) (TrackDriftInfo, error) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+
+	var sourceFile string
+
+	if !direct {
+		var err error
+		sourceFile, err = a.recordTempFile(ctx, uri, time, false)
+		if err != nil {
+			return TrackDriftInfo{}, err
+		}
+		defer a.options.Workspace.Release(sourceFile)
+	} else {
+		sourceFile = uri
+	}
+
+	videoPackets, audioPackets, err := a.probeTracks(ctx, sourceFile, time, useTime)
+
+	if err != nil {
+		logger.Error(fmt.Sprintf("Error probe command: %v", err))
+		return TrackDriftInfo{}, err
+	}
+
+	videoCuts, discontinuities := a.findDiscontinuities(videoPackets)
+	audioCuts, audioDiscontinuities := a.findDiscontinuities(audioPackets)
+	discontinuities = append(discontinuities, audioDiscontinuities...)
+
+	// Offsets are only comparable within a segment without discontinuities
+	fits := []segmentFit{}
+	pairCount := 0
+	span := 0.0
+
+	for _, segment := range a.splitSegments(videoPackets, audioPackets, videoCuts, audioCuts) {
+		fit, err := a.fitSegment(segment)
+
+		if err != nil {
+			logger.Error(fmt.Sprintf("Error pairing frames: %v", err))
+			return TrackDriftInfo{}, err
+		}
+
+		if n := len(fit.samples); n > 0 {
+			span = math.Max(span, fit.samples[n-1].Time-fit.samples[0].Time)
+		}
+		pairCount += len(fit.pairs)
+		fits = append(fits, fit)
+	}
+
+	length := math.Min(trackDriftWindow, span/3)
+
+	fmt.Fprintf(a.out, "\n=== Stream: %s ===\n", Redact(uri))
+	fmt.Fprintf(a.out, "Analyzing %d packet pairs in %.1f second windows every %.1f seconds (%s pairing)\n",
+		pairCount, length, length/2, a.options.Pairing)
+
+	a.printDiscontinuities(discontinuities)
+
+	info := NewTrackDriftInfo(apart, uri)
+	info.Window = length
+	info.VideoFrames = len(videoPackets)
+	info.AudioFrames = len(audioPackets)
+	info.Discontinuities = discontinuities
+
+	var main []analysis.Window
+
+	for i, fit := range fits {
+		windows := analysis.SlidingWindows(fit.samples, length, length/2)
+
+		for k, w := range windows {
+			row := WindowInfo{
+				Segment: i + 1,
+				Start:   w.Start,
+				End:     w.End,
+				Pairs:   w.Samples,
+				Offset:  w.Offset,
+				Drift:   w.Offset - windows[0].Offset,
+			}
+			if k > 0 {
+				row.Change = w.Offset - windows[k-1].Offset
+			}
+			info.Windows = append(info.Windows, row)
+		}
+
+		if len(windows) > len(main) {
+			main = windows
+		}
+	}
+
+	info.Trend, err = analysis.WindowTrend(main)
+
+	if err != nil {
+		a.yellow("Not enough packets to follow the offset: %v", err)
+		return TrackDriftInfo{}, err
+	}
+
+	info.Diff = main[0].Offset
+	info.Change = main[len(main)-1].Offset - main[0].Offset
+	for k := 1; k < len(main); k++ {
+		info.MaxStep = math.Max(info.MaxStep, math.Abs(main[k].Offset-main[k-1].Offset))
+	}
+	info.Verdict = info.Trend.Classify(driftResolution)
+
+	a.printTrackDrift(info)
+
+	return info, nil
+}
+
+func (a *Analyzer) printTrackDrift(info TrackDriftInfo) {
+	headerFmt := color.New(color.FgGreen, color.Underline).SprintfFunc()
+	columnFmt := color.New(color.FgYellow).SprintfFunc()
+
+	tbl := table.New("#", "Segment", "Video PTS time", "Pairs", "Offset", "Change", "Drift")
+	tbl.WithHeaderFormatter(headerFmt).WithFirstColumnFormatter(columnFmt).WithWriter(a.out)
+
+	for i, w := range info.Windows {
+		tbl.AddRow(i+1, w.Segment,
+			fmt.Sprintf("%.3f .. %.3f", w.Start, w.End),
+			w.Pairs,
+			fmt.Sprintf("%.4f", w.Offset),
+			fmt.Sprintf("%+.4f", w.Change),
+			fmt.Sprintf("%+.4f", w.Drift),
+		)
+	}
+
+	tbl.Print()
+
+	trend := info.Trend
+
+	fmt.Fprintf(a.out, "\n=== ANALYSIS ===\n")
+	fmt.Fprintf(a.out, "Windows:             %d over %.3f seconds\n", trend.Samples, trend.Span)
+	fmt.Fprintf(a.out, "Start offset:        %.3f seconds\n", info.Diff)
+	fmt.Fprintf(a.out, "End offset:          %.3f seconds\n", info.Diff+info.Change)
+	fmt.Fprintf(a.out, "Offset change:       %.3f seconds\n", info.Change)
+	fmt.Fprintf(a.out, "Largest step:        %.3f seconds between two windows\n", info.MaxStep)
+	fmt.Fprintf(a.out, "Drift rate:          %.1f ppm, %.1f ms/hour\n", trend.PPM(), trend.MsPerHour())
+	fmt.Fprintf(a.out, "Drift rate 95%% CI:   %.1f .. %.1f ppm\n", trend.SlopeLow*1e6, trend.SlopeHigh*1e6)
+	fmt.Fprintf(a.out, "R²:                  %.3f\n", trend.R2)
+
+	switch info.Verdict {
+	case analysis.ProgressiveDrift:
+		a.red(" DRIFT DETECTED: the offset moves %.3f seconds over %.3f seconds (%.1f ms/hour)", trend.TotalDrift(), trend.Span, trend.MsPerHour())
+	case analysis.FixedOffset:
+		a.yellow("\nFIXED OFFSET: %.3f seconds (no drift)", trend.Intercept)
+	default:
+		a.green("\nThe offset holds steady across the windows")
+	}
+}
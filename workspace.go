@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// workspacePrefix starts the name of every recording, so the quota only
+// counts the files find_desync wrote and Cleanup never touches others.
+const workspacePrefix = "find_desync-"
+
+// ErrWorkspaceFull is returned when the recordings already use the quota.
+var ErrWorkspaceFull = errors.New("recording workspace quota exceeded")
+
+// Workspace owns the directory sources are recorded into before they are
+// analyzed. Recordings are removed once analyzed, or kept under the camera
+// name and a timestamp when Keep is set.
+type Workspace struct {
+	Dir  string
+	Keep bool
+	// Quota caps the bytes the recordings in Dir may use, kept ones from
+	// earlier runs included. Zero means no cap.
+	Quota int64
+
+	mu sync.Mutex
+	// files maps the recordings in use to the bytes of the quota they
+	// hold until they are written.
+	files map[string]int64
+}
+
+// NewWorkspace returns a workspace in dir, or in os.TempDir() when dir is
+// empty. The directory is created on the first recording.
+func NewWorkspace(dir string, keep bool, quota int64) *Workspace {
+	if dir == "" {
+		dir = os.TempDir()
+	}
+
+	return &Workspace{Dir: dir, Keep: keep, Quota: quota, files: map[string]int64{}}
+}
+
+// Create reserves a file with extension ext for a new recording of the
+// named camera and returns its path together with the size the recording
+// may reach, 0 when there is no quota. The file holds size bytes of the
+// quota, all that is left when size is 0, until Settle, Release or Discard,
+// so recordings made at the same time do not count on the same room.
+func (w *Workspace) Create(camera, ext string, size int64) (string, int64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := os.MkdirAll(w.Dir, 0o755); err != nil {
+		return "", 0, err
+	}
+
+	var available int64
+	if w.Quota > 0 {
+		used, err := w.usage()
+		if err != nil {
+			return "", 0, err
+		}
+		if used >= w.Quota || used+size > w.Quota {
+			return "", 0, fmt.Errorf("%w: %d of %d bytes used in %s", ErrWorkspaceFull, used, w.Quota, w.Dir)
+		}
+		available = w.Quota - used
+		if size > 0 {
+			available = size
+		}
+	}
+
+	pattern := workspacePrefix + "*" + ext
+	if w.Keep {
+		pattern = workspacePrefix + safeName(camera) + "-" + time.Now().Format("20060102T150405") + "-*" + ext
+	}
+
+	file, err := os.CreateTemp(w.Dir, pattern)
+	if err != nil {
+		return "", 0, err
+	}
+	file.Close()
+
+	w.files[file.Name()] = available
+
+	return file.Name(), available, nil
+}
+
+// Settle is called once the recording has been written: from then on the
+// quota counts its size instead of what Create reserved for it.
+func (w *Workspace) Settle(path string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if _, ok := w.files[path]; ok {
+		w.files[path] = 0
+	}
+}
+
+// usage sums the size of the recordings in Dir, or what is reserved for
+// them when more.
+func (w *Workspace) usage() (int64, error) {
+	entries, err := os.ReadDir(w.Dir)
+	if err != nil {
+		return 0, err
+	}
+
+	var used int64
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || !strings.HasPrefix(entry.Name(), workspacePrefix) {
+			continue
+		}
+		var size int64
+		if info, err := entry.Info(); err == nil {
+			size = info.Size()
+		}
+		used += max(size, w.files[filepath.Join(w.Dir, entry.Name())])
+	}
+
+	return used, nil
+}
+
+// Release is called once the recording has been analyzed: it is removed
+// unless the workspace keeps recordings.
+func (w *Workspace) Release(path string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if _, ok := w.files[path]; !ok {
+		return
+	}
+
+	delete(w.files, path)
+	if !w.Keep {
+		os.Remove(path)
+	}
+}
+
+// Discard removes a recording that failed, kept or not.
+func (w *Workspace) Discard(path string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	delete(w.files, path)
+	os.Remove(path)
+}
+
+// Cleanup releases every recording still in use, for the paths that end
+// the program without returning through the analyzers.
+func (w *Workspace) Cleanup() {
+	w.mu.Lock()
+	paths := make([]string, 0, len(w.files))
+	for path := range w.files {
+		paths = append(paths, path)
+	}
+	w.mu.Unlock()
+
+	for _, path := range paths {
+		w.Release(path)
+	}
+}
+
+// safeName turns a camera name into something usable in a file name.
+func safeName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, Redact(name))
+
+	name = strings.Trim(name, "_")
+	if name == "" {
+		return "camera"
+	}
+	return name
+}
+
+type cameraKey struct{}
+
+// withCamera returns a context carrying the camera being measured, used to
+// name its recordings.
+func withCamera(ctx context.Context, camera *Camera) context.Context {
+	return context.WithValue(ctx, cameraKey{}, camera)
+}
+
+// cameraName returns the name of the camera measured in ctx, or the id of
+// uri outside a measurement.
+func cameraName(ctx context.Context, uri string) string {
+	if camera, ok := ctx.Value(cameraKey{}).(*Camera); ok && camera.Name != "" {
+		return camera.Name
+	}
+	return CameraID(uri)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWorkspaceQuotaReservations(t *testing.T) {
+	w := NewWorkspace(t.TempDir(), false, 1000)
+
+	// A recording from an earlier run
+	if err := os.WriteFile(filepath.Join(w.Dir, workspacePrefix+"kept.mkv"), make([]byte, 100), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Two recordings starting before either has written anything
+	first, size, err := w.Create("cam1", ".mkv", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 900 {
+		t.Errorf("first recording may reach %d bytes, want 900", size)
+	}
+	if _, _, err := w.Create("cam2", ".mkv", 0); !errors.Is(err, ErrWorkspaceFull) {
+		t.Errorf("second recording: error %v, want %v", err, ErrWorkspaceFull)
+	}
+
+	// Once written, the recording only holds its size
+	if err := os.WriteFile(first, make([]byte, 300), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	w.Settle(first)
+
+	_, size, err = w.Create("cam2", ".pcm", 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 200 {
+		t.Errorf("sized file may reach %d bytes, want 200", size)
+	}
+	if _, size, err := w.Create("cam3", ".mkv", 0); err != nil || size != 400 {
+		t.Errorf("third recording may reach %d bytes (%v), want 400", size, err)
+	}
+
+	// Releasing the reservations gives the room back
+	w.Cleanup()
+	if _, size, err := w.Create("cam4", ".mkv", 0); err != nil || size != 900 {
+		t.Errorf("recording after release may reach %d bytes (%v), want 900", size, err)
+	}
+}
+
+func TestWorkspaceSizedReservationOverQuota(t *testing.T) {
+	w := NewWorkspace(t.TempDir(), false, 1000)
+
+	if _, _, err := w.Create("cam1", ".gray", 1001); !errors.Is(err, ErrWorkspaceFull) {
+		t.Errorf("error %v, want %v", err, ErrWorkspaceFull)
+	}
+	if _, size, err := w.Create("cam1", ".gray", 1000); err != nil || size != 1000 {
+		t.Errorf("file may reach %d bytes (%v), want 1000", size, err)
+	}
+}